@@ -24,6 +24,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"qvm"
 	"qvmd"
@@ -33,10 +34,12 @@ import (
 )
 
 type Context struct {
-	disCtx   *qvmd.Context
-	dar      *dar.File
-	comments map[int]string
-	renames  map[int]string
+	disCtx        *qvmd.Context
+	dar           *dar.File
+	ann           *dar.Annotations
+	syscallArgc   map[int]int
+	syscallIssues []qvmd.Issue
+	userSyscalls  map[int]qvmd.Syscall //from the syscalls file, overriding the built-in ones
 }
 
 func printHeader(f *qvm.File) {
@@ -67,22 +70,305 @@ func printInfo(ctx *Context, proc *qvmd.Procedure) {
 	fmt.Printf("      File Offset: 0x%x\n", proc.StartOffset+int(ctx.dar.QvmFile.Header.CodeOffset))
 	fmt.Printf("Instruction Count: 0x%x\n", proc.InstructionCount)
 	fmt.Printf("       Frame Size: 0x%x\n", proc.FrameSize)
+	fmt.Printf("        Signature: %s\n", ctx.disCtx.Signature(proc))
 	fmt.Printf("Callees(%d):\n", len(proc.Callees))
 	for _, calleeProc := range proc.Callees {
-		fmt.Printf("\t%s\n", calleeProc.Name)
+		if ctx.disCtx.IsIndirect(proc, calleeProc) {
+			fmt.Printf("\t%s (indirect)\n", calleeProc.Name)
+		} else {
+			fmt.Printf("\t%s\n", calleeProc.Name)
+		}
 	}
 	fmt.Printf("Callers(%d):\n", len(proc.Callers))
 	for _, callerProc := range proc.Callers {
-		fmt.Printf("\t%s\n", callerProc.Name)
+		if ctx.disCtx.IsIndirect(callerProc, proc) {
+			fmt.Printf("\t%s (indirect)\n", callerProc.Name)
+		} else {
+			fmt.Printf("\t%s\n", callerProc.Name)
+		}
+	}
+}
+
+func printCFG(ctx *Context, proc *qvmd.Procedure) {
+	cfg := ctx.disCtx.CFG(proc)
+	for _, b := range cfg.Blocks {
+		succs, preds := make([]string, 0), make([]string, 0)
+		for _, succ := range b.Succs {
+			succs = append(succs, fmt.Sprintf("0x%08x", succ.Start))
+		}
+		for _, pred := range b.Preds {
+			preds = append(preds, fmt.Sprintf("0x%08x", pred.Start))
+		}
+		fmt.Printf("Block %d <0x%08x-0x%08x>\n", b.Index, b.Start, b.Last())
+		fmt.Printf("\tPreds: %s\n", strings.Join(preds, ", "))
+		fmt.Printf("\tSuccs: %s\n", strings.Join(succs, ", "))
+	}
+	for _, jump := range cfg.UnresolvedJumps {
+		fmt.Printf("Unresolved JUMP at 0x%08x\n", jump)
+	}
+}
+
+func printLoopHeader(loop *qvmd.Loop) {
+	backEdges, exits := make([]string, 0), make([]string, 0)
+	for _, b := range loop.BackEdges {
+		backEdges = append(backEdges, fmt.Sprintf("0x%08x", b.Last()))
+	}
+	for _, b := range loop.Exits {
+		exits = append(exits, fmt.Sprintf("0x%08x", b.Start))
+	}
+	fmt.Printf("; loop header (depth %d), back edges from %s, exits to %s\n", loop.Depth, strings.Join(backEdges, ", "), strings.Join(exits, ", "))
+}
+
+//branchLabels finds every branch target in proc. It returns the branch
+//sources of each target and, for each instruction whose operand is a
+//target, the label to print in place of the operand.
+func branchLabels(ctx *Context, proc *qvmd.Procedure) (map[int][]int, map[int]string) {
+	sources, operands := make(map[int][]int), make(map[int]string)
+	for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+		insn := ctx.disCtx.Insns[i]
+		switch {
+		case !insn.Valid:
+		case qvmd.IsBranch(insn.Op):
+			tgt := int(insn.IntArg())
+			sources[tgt] = append(sources[tgt], i)
+			operands[i] = fmt.Sprintf("loc_%08x", tgt)
+		case insn.Op == qvmd.OP_JUMP:
+			tgts, _ := ctx.disCtx.JumpTargets(proc, i)
+			for _, tgt := range tgts {
+				sources[tgt] = append(sources[tgt], i)
+			}
+			if i > proc.StartInstruction && ctx.disCtx.Insns[i-1].Op == qvmd.OP_CONST {
+				operands[i-1] = fmt.Sprintf("loc_%08x", ctx.disCtx.Insns[i-1].IntArg())
+			}
+		}
+	}
+	return sources, operands
+}
+
+//switchNotes describes the switch tables of proc: what each computed JUMP
+//switches over, and the cases landing on each target.
+func switchNotes(ctx *Context, proc *qvmd.Procedure) (map[int]string, map[int]string) {
+	jumps, cases := make(map[int]string), make(map[int]string)
+	for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+		if !ctx.disCtx.Insns[i].Valid || ctx.disCtx.Insns[i].Op != qvmd.OP_JUMP {
+			continue
+		}
+		sw, ok := ctx.disCtx.Switch(proc, i)
+		if !ok {
+			continue
+		}
+		jumps[i] = fmt.Sprintf("; switch %d..%d, table 0x%x", sw.Low, sw.Low+int32(len(sw.Targets))-1, sw.Table)
+		values := sw.Cases()
+		for _, tgt := range sw.UniqueTargets() {
+			strs := make([]string, len(values[tgt]))
+			for k, v := range values[tgt] {
+				strs[k] = strconv.Itoa(int(v))
+			}
+			cases[tgt] = fmt.Sprintf("; case %s", strings.Join(strs, ", "))
+		}
+		if sw.Default >= 0 {
+			jumps[i] += fmt.Sprintf(", default loc_%08x", sw.Default)
+			if cases[sw.Default] != "" {
+				cases[sw.Default] += ", default"
+			} else {
+				cases[sw.Default] = "; default"
+			}
+		}
+	}
+	return jumps, cases
+}
+
+func printLabel(tgt int, sources []int) {
+	refs := make([]string, len(sources))
+	for i, src := range sources {
+		refs[i] = fmt.Sprintf("0x%08x", src)
+	}
+	fmt.Printf("loc_%08x:%29s; xrefs: %s\n", tgt, "", strings.Join(refs, ", "))
+}
+
+func printIssues(ctx *Context, issues []qvmd.Issue) {
+	for _, issue := range issues {
+		if proc := ctx.disCtx.ProcAt(issue.Insn); proc != nil {
+			fmt.Printf("%s: %s\n", proc.Name, issue)
+		} else {
+			fmt.Println(issue)
+		}
+	}
+}
+
+//globalName names the global that instruction insn references at addr, or
+//returns "" if insn isn't a reference to a global.
+func globalName(ctx *Context, insn int, addr uint32) string {
+	isRef := false
+	for _, xref := range ctx.disCtx.DataXRefs[addr] {
+		isRef = isRef || xref.Insn == insn
+	}
+	if !isRef {
+		return ""
+	}
+	if g, exists := ctx.disCtx.Globals[addr]; exists {
+		return g.Name
+	}
+	return ""
+}
+
+//printData prints the initial value of each member of the object of type t
+//at addr, until limit lines were printed. Uninitialized memory is 0.
+func printData(ctx *Context, path string, addr uint32, t *qvmd.CType, limit *int) {
+	if *limit <= 0 {
+		return
+	}
+	hdr := ctx.dar.QvmFile.Header
+	read := func(addr uint32, size int) uint32 {
+		v := uint32(0)
+		for i := size - 1; i >= 0; i-- {
+			b, _ := ctx.dar.QvmFile.Byte(addr + uint32(i))
+			v = v<<8 | uint32(b)
+		}
+		return v
+	}
+	r := t.Resolve()
+	switch r.Kind {
+	case qvmd.CStruct, qvmd.CUnion:
+		for _, f := range r.Fields {
+			printData(ctx, path+"."+f.Name, addr+uint32(f.Offset), f.Type, limit)
+		}
+		return
+	case qvmd.CArray:
+		if elem := r.Elem.Resolve(); elem.Kind == qvmd.CBase && elem.Base == qvmd.TypeChar {
+			str := make([]byte, 0, r.Len)
+			for i := 0; i < r.Len; i++ {
+				b, _ := ctx.dar.QvmFile.Byte(addr + uint32(i))
+				if b == 0 {
+					break
+				}
+				str = append(str, b)
+			}
+			fmt.Printf("0x%08x %s = %s\n", addr, path, strconv.Quote(string(str)))
+			*limit--
+			return
+		}
+		for i := 0; i < r.Len && *limit > 0; i++ {
+			printData(ctx, fmt.Sprintf("%s[%d]", path, i), addr+uint32(i*r.Elem.Size()), r.Elem, limit)
+		}
+		if *limit <= 0 {
+			fmt.Println("...")
+		}
+		return
+	}
+
+	v := read(addr, r.Size())
+	value := fmt.Sprintf("%d", int32(v))
+	switch {
+	case r.Kind == qvmd.CBase && r.Base == qvmd.TypeFloat:
+		if f, ok := qvmd.FloatString(v); ok {
+			value = f
+		}
+	case r.Kind == qvmd.CBase && r.Unsigned:
+		value = fmt.Sprintf("%d", v)
+	case r.Kind == qvmd.CBase && r.Base == qvmd.TypeShort:
+		value = fmt.Sprintf("%d", int16(v))
+	case r.Kind == qvmd.CBase && r.Base == qvmd.TypeChar:
+		value = fmt.Sprintf("%d", int8(v))
+	case r.Kind == qvmd.CEnum:
+		if name, ok := r.EnumName(int(int32(v))); ok {
+			value = name
+		}
+	case r.Kind == qvmd.CPointer && v == 0:
+		value = "NULL"
+	case r.Kind == qvmd.CPointer && r.Elem.Resolve().Kind == qvmd.CFunc:
+		value = fmt.Sprintf("0x%x", v)
+		if proc, exists := ctx.disCtx.Procs[int(v)]; exists {
+			value = proc.Name
+		}
+	case r.Kind == qvmd.CPointer:
+		value = fmt.Sprintf("0x%x", v)
+		if g, exists := ctx.disCtx.Globals[v]; exists {
+			value = "&" + g.Name
+		} else if str, exists := ctx.disCtx.Strings[int(v)]; exists && v >= hdr.DataLength {
+			value = strconv.Quote(str)
+		}
+	}
+	fmt.Printf("0x%08x %s = %s\n", addr, path, value)
+	*limit--
+}
+
+func printFrame(ctx *Context, proc *qvmd.Procedure) {
+	frame := ctx.disCtx.Frame(proc)
+	fmt.Printf("Frame of %s, 0x%x bytes:\n", proc.Name, proc.FrameSize)
+	fmt.Printf("0x%04x %4d reserved\n", 0, 8)
+	if frame.ArgArea > 0 {
+		fmt.Printf("0x%04x %4d outgoing arguments\n", 8, frame.ArgArea)
+	}
+	for _, slot := range frame.Slots {
+		addrTaken := ""
+		if slot.AddrTaken {
+			addrTaken = " (address taken)"
+		}
+		fmt.Printf("0x%04x %4d %s%s\n", slot.Offset, slot.Size, ctx.disCtx.LocalDecl(proc, slot.Offset), addrTaken)
+	}
+	for n := 0; n < proc.Params; n++ {
+		off := proc.FrameSize + 8 + 4*n
+		fmt.Printf("0x%04x %4d %s\n", off, 4, ctx.disCtx.LocalDecl(proc, off))
+	}
+}
+
+func printDataXRefs(ctx *Context, addr uint32) {
+	xrefs := ctx.disCtx.DataXRefs[addr]
+	if len(xrefs) == 0 {
+		fmt.Printf("No references to 0x%08x\n", addr)
+		return
+	}
+	for _, xref := range xrefs {
+		fmt.Printf("%s <0x%08x>: %s\n", xref.Proc.Name, xref.Insn, xref.Kind)
+	}
+}
+
+func printCallXRefs(ctx *Context, proc *qvmd.Procedure) {
+	found := false
+	for _, caller := range ctx.disCtx.SortedProcs() {
+		for i := caller.StartInstruction; i+1 < caller.StartInstruction+caller.InstructionCount; i++ {
+			if ctx.disCtx.Insns[i].Op == qvmd.OP_CONST && ctx.disCtx.Insns[i+1].Op == qvmd.OP_CALL && int(ctx.disCtx.Insns[i].IntArg()) == proc.StartInstruction {
+				fmt.Printf("%s <0x%08x>: call\n", caller.Name, i+1)
+				found = true
+			}
+			for _, tgt := range ctx.disCtx.IndirectCalls[i] {
+				if tgt == proc {
+					fmt.Printf("%s <0x%08x>: indirect call\n", caller.Name, i)
+					found = true
+				}
+			}
+		}
+	}
+	if !found {
+		fmt.Printf("No calls to %s\n", proc.Name)
 	}
 }
 
 func disassemble(ctx *Context, proc *qvmd.Procedure) {
+	loopHeaders := make(map[int]*qvmd.Loop)
+	for _, loop := range ctx.disCtx.Loops(proc) {
+		loopHeaders[loop.Header.Start] = loop
+	}
+	labelSources, labelOperands := branchLabels(ctx, proc)
+	stack := ctx.disCtx.AnalyzeStack(proc)
+	fieldRefs := ctx.disCtx.FieldRefs(proc)
+	enums := ctx.disCtx.EnumRefs(proc)
+	switchJumps, switchCases := switchNotes(ctx, proc)
 	for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+		if sources, exists := labelSources[i]; exists {
+			printLabel(i, sources)
+		}
+		if note, exists := switchCases[i]; exists {
+			fmt.Println(note)
+		}
+		if loop, exists := loopHeaders[i]; exists {
+			printLoopHeader(loop)
+		}
 		arg := ""
 		info := ""
 		comment := ""
-		if cmnt, exists := ctx.comments[i]; exists {
+		if cmnt, exists := ctx.ann.Comments[i]; exists {
 			comment = fmt.Sprintf("; %s", cmnt)
 		}
 		switch {
@@ -104,6 +390,9 @@ func disassemble(ctx *Context, proc *qvmd.Procedure) {
 					} else {
 						info = fmt.Sprintf("; Unknown syscall: %d", dst)
 					}
+					if argc, exists := ctx.syscallArgc[int(dst)]; exists {
+						info += fmt.Sprintf(" argc %d", argc)
+					}
 				} else {
 					//Code xref...
 					if tgtProc, exists := ctx.disCtx.Procs[int(dst)]; exists {
@@ -112,6 +401,12 @@ func disassemble(ctx *Context, proc *qvmd.Procedure) {
 						info = fmt.Sprintf("; Unknown instruction num %d", dst)
 					}
 				}
+			case fieldRefs[i] != "":
+				info = fmt.Sprintf("; %s", fieldRefs[i])
+			case enums[i] != "":
+				//The operand is named already.
+			case globalName(ctx, i, uint32(dst)) != "":
+				info = fmt.Sprintf("; %s", globalName(ctx, i, uint32(dst)))
 			case uint32(dst) >= ctx.dar.QvmFile.Header.DataLength && uint32(dst) < ctx.dar.QvmFile.Header.DataLength+ctx.dar.QvmFile.Header.LitLength:
 				if str, exists := ctx.disCtx.Strings[int(uint32(dst))]; exists {
 					info = fmt.Sprintf("; String: \"%s\"", str)
@@ -119,6 +414,14 @@ func disassemble(ctx *Context, proc *qvmd.Procedure) {
 					info = fmt.Sprintf("; Unknown string ref: 0x%x", dst)
 				}
 			}
+		case ctx.disCtx.Insns[i].Op == qvmd.OP_CALL && len(ctx.disCtx.IndirectCalls[i]) > 0:
+			names := make([]string, 0, len(ctx.disCtx.IndirectCalls[i]))
+			for _, tgt := range ctx.disCtx.IndirectCalls[i] {
+				names = append(names, tgt.Name)
+			}
+			info = fmt.Sprintf("; indirect: %s", strings.Join(names, ", "))
+		case switchJumps[i] != "":
+			info = switchJumps[i]
 		case ctx.disCtx.Insns[i].Op == qvmd.OP_LOCAL:
 			tgtBuf := bytes.NewBuffer(ctx.disCtx.Insns[i].Arg)
 			var tgt uint32
@@ -126,8 +429,8 @@ func disassemble(ctx *Context, proc *qvmd.Procedure) {
 				fmt.Println(err)
 				continue
 			}
-			if int(tgt) > proc.FrameSize {
-				info = fmt.Sprintf("; arg_%d", (tgt-8-uint32(proc.FrameSize))/4)
+			if int(tgt) > proc.FrameSize || ctx.disCtx.Frame(proc).Slot(int(tgt)) != nil {
+				info = fmt.Sprintf("; %s", ctx.disCtx.LocalName(proc, int(tgt)))
 			}
 		}
 		if !ctx.disCtx.Insns[i].Valid {
@@ -145,12 +448,273 @@ func disassemble(ctx *Context, proc *qvmd.Procedure) {
 				break
 			}
 			arg = fmt.Sprintf("0x%08x", argNum)
+			if ctx.disCtx.Insns[i].Op == qvmd.OP_CONST && ctx.disCtx.Types.Const(i) == qvmd.TypeFloat {
+				if str, ok := qvmd.FloatString(argNum); ok {
+					arg = str
+				}
+			}
+		}
+		if name, exists := enums[i]; exists {
+			arg = name
+		}
+		if label, exists := labelOperands[i]; exists {
+			arg = label
+		}
+
+		depth := "?"
+		if d, ok := stack.DepthAt(i); ok {
+			depth = strconv.Itoa(d)
 		}
 
-		fmt.Printf("<0x%08x>: %-10s %10s %s%s\n", i, ctx.disCtx.Insns[i].Mnemonic(), arg, info, comment)
+		fmt.Printf("<0x%08x>: [%3s] %-10s %10s %s%s\n", i, depth, ctx.disCtx.Insns[i].Mnemonic(), arg, info, comment)
 	}
 }
 
+//selectSyscalls picks the built-in syscalls of the module and engine, with
+//the syscalls file overriding them, and works out the argument counts.
+func selectSyscalls(ctx *Context) {
+	ctx.disCtx.SelectSyscalls(ctx.userSyscalls)
+	ctx.syscallArgc, ctx.syscallIssues = ctx.disCtx.InferSyscallArgc()
+}
+
+//detectConfidence is how sure a detection has to be to be used.
+const detectConfidence = 0.5
+
+//detect sets the module and the engine neither the flags nor the
+//annotations name to the ones the QVM looks like, if it is clear enough.
+func detect(ctx *Context) {
+	if ctx.disCtx.Module != qvmd.ModuleUnknown && ctx.disCtx.Engine != qvmd.EngineUnknown {
+		return
+	}
+	d := ctx.disCtx.Detect()
+	if ctx.disCtx.Module == qvmd.ModuleUnknown && d.Module != qvmd.ModuleUnknown && d.ModuleConfidence >= detectConfidence {
+		ctx.disCtx.Module = d.Module
+		fmt.Printf("Detected %s module (%.0f%%)\n", d.Module, 100*d.ModuleConfidence)
+	}
+	if ctx.disCtx.Engine == qvmd.EngineUnknown && d.Engine != qvmd.EngineUnknown && d.EngineConfidence >= detectConfidence {
+		ctx.disCtx.Engine = d.Engine
+		fmt.Printf("Detected %s engine (%.0f%%)\n", d.Engine, 100*d.EngineConfidence)
+	}
+}
+
+//printDetection prints the module and engine in use next to what the QVM
+//looks like.
+func printDetection(ctx *Context) {
+	d := ctx.disCtx.Detect()
+	fmt.Printf("           Module: %s, detected %s (%.0f%%)\n", ctx.disCtx.Module, d.Module, 100*d.ModuleConfidence)
+	fmt.Printf("           Engine: %s, detected %s (%.0f%%)\n", ctx.disCtx.Engine, d.Engine, 100*d.EngineConfidence)
+	for _, clue := range d.Clues {
+		fmt.Printf("                   %s\n", clue)
+	}
+}
+
+//nameEntry names the handlers vmMain dispatches to after the exports of
+//the module, keeping the names with the other renames.
+func nameEntry(ctx *Context) {
+	renames := ctx.disCtx.NameEntry(ctx.disCtx.Module)
+	nums := make([]int, 0, len(renames))
+	for num, name := range renames {
+		ctx.ann.Renames[num] = name
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		fmt.Printf("Named %s <0x%08x>\n", renames[num], num)
+	}
+}
+
+//loadTypes applies the C types the annotations name to variables.
+func loadTypes(ctx *Context) {
+	for addr, typ := range ctx.ann.GlobalTypes {
+		t, err := ctx.disCtx.TypeLib.ParseType(typ)
+		if err != nil {
+			fmt.Printf("Type of global 0x%x: %s\n", addr, err)
+			continue
+		}
+		ctx.disCtx.GlobalTypes[addr] = t
+	}
+	for num, types := range ctx.ann.LocalTypes {
+		for off, typ := range types {
+			t, err := ctx.disCtx.TypeLib.ParseType(typ)
+			if err != nil {
+				fmt.Printf("Type of local %d of function 0x%x: %s\n", off, num, err)
+				continue
+			}
+			if ctx.disCtx.LocalTypes[num] == nil {
+				ctx.disCtx.LocalTypes[num] = make(map[int]*qvmd.CType)
+			}
+			ctx.disCtx.LocalTypes[num][off] = t
+		}
+	}
+	for num, typ := range ctx.ann.ProcTypes {
+		t, err := ctx.disCtx.TypeLib.ParseType(typ)
+		if err == nil && t.Kind != qvmd.CFunc {
+			err = fmt.Errorf("%s is not a prototype", typ)
+		}
+		if err != nil {
+			fmt.Printf("Prototype of function 0x%x: %s\n", num, err)
+			continue
+		}
+		ctx.disCtx.ProcTypes[num] = t
+	}
+	for num, name := range ctx.ann.EnumConsts {
+		if t, err := parseEnum(ctx, name); err != nil {
+			fmt.Printf("Enum of instruction %d: %s\n", num, err)
+		} else {
+			ctx.disCtx.EnumConsts[num] = t
+		}
+	}
+	for target, enums := range ctx.ann.EnumArgs {
+		for n, name := range enums {
+			t, err := parseEnum(ctx, name)
+			if err != nil {
+				fmt.Printf("Enum of argument %d of %d: %s\n", n, target, err)
+				continue
+			}
+			if ctx.disCtx.EnumArgs[target] == nil {
+				ctx.disCtx.EnumArgs[target] = make(map[int]*qvmd.CType)
+			}
+			ctx.disCtx.EnumArgs[target][n] = t
+		}
+	}
+}
+
+//parseEnum looks up the enum or typedef of an enum called name.
+func parseEnum(ctx *Context, name string) (*qvmd.CType, error) {
+	t, exists := ctx.disCtx.TypeLib.Lookup(name)
+	if !exists || t.Resolve().Kind != qvmd.CEnum {
+		return nil, fmt.Errorf("No enum named \"%s\"", name)
+	}
+	return t, nil
+}
+
+//printTypeErrors prints the declarations of a header that were skipped.
+func printTypeErrors(file string, errs []error) {
+	for _, err := range errs {
+		fmt.Printf("%s: %s\n", file, err)
+	}
+}
+
+//isCSource reports whether file is a C header or source, read for the
+//syscalls it defines rather than as q3asm equs.
+func isCSource(file string) bool {
+	return strings.HasSuffix(file, ".h") || strings.HasSuffix(file, ".c")
+}
+
+//loadSyscalls reads the syscalls files define over the ones the user
+//defined before. The C headers are read first so the wrappers of the
+//sources can refer to their enumerators.
+func loadSyscalls(ctx *Context, files []string) error {
+	ordered := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.HasSuffix(file, ".h") {
+			ordered = append(ordered, file)
+		}
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".h") {
+			ordered = append(ordered, file)
+		}
+	}
+	for _, file := range ordered {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sf := &dar.SyscallsFile{Data: data}
+		var syscalls map[int]qvmd.Syscall
+		if isCSource(file) {
+			var errs []error
+			syscalls, errs = sf.ParseC(ctx.disCtx.TypeLib)
+			printTypeErrors(file, errs)
+		} else if syscalls, err = sf.Parse(); err != nil {
+			return err
+		}
+		for num, sc := range syscalls {
+			ctx.userSyscalls[num] = sc
+		}
+		fmt.Printf("%s: %d syscalls\n", file, len(syscalls))
+	}
+	return nil
+}
+
+//savedSyscalls returns the syscalls the user defined to be written out,
+//with the argument counts inferred for the ones that didn't give one.
+func savedSyscalls(ctx *Context) map[int]qvmd.Syscall {
+	syscalls := make(map[int]qvmd.Syscall, len(ctx.userSyscalls))
+	for num, sc := range ctx.userSyscalls {
+		if known, exists := ctx.disCtx.Syscalls[num]; exists && sc.Argc < 0 {
+			sc.Argc = known.Argc
+		}
+		syscalls[num] = sc
+	}
+	return syscalls
+}
+
+//findSyscall returns the number of the syscall name refers to, by name or
+//number.
+func findSyscall(ctx *Context, name string) (int, bool) {
+	if num, err := strconv.ParseInt(name, 0, 32); err == nil {
+		_, exists := ctx.disCtx.Syscalls[int(num)]
+		return int(num), exists
+	}
+	for num, sc := range ctx.disCtx.Syscalls {
+		if sc.Name == name {
+			return num, true
+		}
+	}
+	return 0, false
+}
+
+//storeTypes puts the struct declarations and the types applied to
+//variables back into the annotations to be saved.
+func storeTypes(ctx *Context) {
+	ctx.dar.TypesFile = &dar.TypesFile{Data: []byte(ctx.disCtx.TypeLib.String())}
+	ctx.ann.GlobalTypes = make(map[uint32]string)
+	for addr, t := range ctx.disCtx.GlobalTypes {
+		ctx.ann.GlobalTypes[addr] = t.String()
+	}
+	ctx.ann.LocalTypes = make(map[int]map[int]string)
+	for num, types := range ctx.disCtx.LocalTypes {
+		ctx.ann.LocalTypes[num] = make(map[int]string)
+		for off, t := range types {
+			ctx.ann.LocalTypes[num][off] = t.String()
+		}
+	}
+	ctx.ann.ProcTypes = make(map[int]string)
+	for num, t := range ctx.disCtx.ProcTypes {
+		ctx.ann.ProcTypes[num] = t.String()
+	}
+	ctx.ann.EnumConsts = make(map[int]string)
+	for num, t := range ctx.disCtx.EnumConsts {
+		ctx.ann.EnumConsts[num] = t.Name
+	}
+	ctx.ann.EnumArgs = make(map[int]map[int]string)
+	for target, enums := range ctx.disCtx.EnumArgs {
+		ctx.ann.EnumArgs[target] = make(map[int]string)
+		for n, t := range enums {
+			ctx.ann.EnumArgs[target][n] = t.Name
+		}
+	}
+}
+
+//findLocal returns the offset of the local or argument of proc called name.
+func findLocal(ctx *Context, proc *qvmd.Procedure, name string) (int, bool) {
+	offsets := make([]int, 0)
+	for _, slot := range ctx.disCtx.Frame(proc).Slots {
+		offsets = append(offsets, slot.Offset)
+	}
+	for n := 0; n < proc.Params; n++ {
+		offsets = append(offsets, proc.FrameSize+8+4*n)
+	}
+	for _, off := range offsets {
+		if ctx.disCtx.LocalName(proc, off) == name {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
 func exitErrNotNil(err error) {
 	if err != nil {
 		fmt.Println(err)
@@ -159,9 +723,12 @@ func exitErrNotNil(err error) {
 }
 
 func main() {
-	cfFile, scFile := "", ""
+	cfFile, scFile, tyFile, modName, engName := "", "", "", "", ""
 	flag.StringVar(&cfFile, "comments", "", "Specify a file containing comments and data references")
-	flag.StringVar(&scFile, "syscalls", "", "Specify a file defining the syscalls")
+	flag.StringVar(&scFile, "syscalls", "", "Specify a file defining the syscalls, or C headers and sources separated by commas")
+	flag.StringVar(&tyFile, "types", "", "Specify a C header declaring the structs used by the comments")
+	flag.StringVar(&modName, "module", "", "Specify the module type, cgame, qagame or ui")
+	flag.StringVar(&engName, "engine", "", "Specify the engine family, q3 or quake3e")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -193,9 +760,9 @@ func main() {
 	exitErrNotNil(err)
 	ctx.disCtx, err = qvmd.NewContext(ctx.dar.QvmFile, true)
 	exitErrNotNil(err)
-	ctx.comments, ctx.renames, err = ctx.dar.CommentsFile.Parse()
+	ctx.ann, err = ctx.dar.CommentsFile.Parse()
 	exitErrNotNil(err)
-	ctx.disCtx.Syscalls, err = ctx.dar.SyscallsFile.Parse()
+	ctx.userSyscalls, err = ctx.dar.SyscallsFile.Parse()
 	exitErrNotNil(err)
 
 	if cfFile != "" {
@@ -203,28 +770,80 @@ func main() {
 		exitErrNotNil(err)
 		ctx.dar.CommentsFile, err = dar.NewCommentsFile(commentsFile)
 		exitErrNotNil(err)
-		ctx.comments, ctx.renames, err = ctx.dar.CommentsFile.Parse()
+		ctx.ann, err = ctx.dar.CommentsFile.Parse()
 		exitErrNotNil(err)
 		err = commentsFile.Close()
 		exitErrNotNil(err)
 	}
 
-	if scFile != "" {
+	scFiles := strings.Split(scFile, ",")
+	if scFile != "" && len(scFiles) == 1 && !isCSource(scFile) {
 		syscallsFile, err := os.OpenFile(scFile, os.O_RDWR, 0600)
 		exitErrNotNil(err)
 		ctx.dar.SyscallsFile, err = dar.NewSyscallsFile(syscallsFile)
 		exitErrNotNil(err)
-		ctx.disCtx.Syscalls, err = ctx.dar.SyscallsFile.Parse()
+		ctx.userSyscalls, err = ctx.dar.SyscallsFile.Parse()
 		exitErrNotNil(err)
 		err = syscallsFile.Close()
 		exitErrNotNil(err)
 	}
 
-	for num, rename := range ctx.renames {
+	if tyFile != "" {
+		typesFile, err := os.OpenFile(tyFile, os.O_RDWR, 0600)
+		exitErrNotNil(err)
+		ctx.dar.TypesFile, err = dar.NewTypesFile(typesFile)
+		exitErrNotNil(err)
+		err = typesFile.Close()
+		exitErrNotNil(err)
+	}
+	if ctx.dar.TypesFile != nil {
+		name := "types.h"
+		if tyFile != "" {
+			name = tyFile
+		}
+		printTypeErrors(name, ctx.disCtx.TypeLib.Parse(string(ctx.dar.TypesFile.Data)))
+	}
+	if scFile != "" && (len(scFiles) > 1 || isCSource(scFile)) {
+		exitErrNotNil(loadSyscalls(ctx, scFiles))
+	}
+
+	for num, rename := range ctx.ann.Renames {
 		if _, exists := ctx.disCtx.Procs[num]; exists {
 			ctx.disCtx.Procs[num].Name = rename
 		}
 	}
+	for addr, name := range ctx.ann.Globals {
+		if g, exists := ctx.disCtx.Globals[addr]; exists {
+			g.Name = name
+		}
+	}
+	ctx.disCtx.LocalNames = ctx.ann.Locals
+	loadTypes(ctx)
+	if modName != "" {
+		ctx.ann.Module = modName
+	}
+	if ctx.ann.Module != "" {
+		m, ok := qvmd.ParseModule(ctx.ann.Module)
+		if !ok {
+			fmt.Printf("Unknown module \"%s\"\n", ctx.ann.Module)
+		}
+		ctx.disCtx.Module = m
+	}
+	if engName != "" {
+		ctx.ann.Engine = engName
+	}
+	if ctx.ann.Engine != "" {
+		e, ok := qvmd.ParseEngine(ctx.ann.Engine)
+		if !ok {
+			fmt.Printf("Unknown engine \"%s\"\n", ctx.ann.Engine)
+		}
+		ctx.disCtx.Engine = e
+	}
+	detect(ctx)
+	nameEntry(ctx)
+	ctx.disCtx.ApplyTypeLib()
+	ctx.disCtx.RecoverStructs()
+	selectSyscalls(ctx)
 
 	stdin := bufio.NewReader(os.Stdin)
 
@@ -240,22 +859,64 @@ func main() {
 
 		switch cmd[0] {
 		case "help":
+			fmt.Println("addsyscall <num> <name> [argc] - Define syscall <num> as <name> taking [argc] arguments")
+			fmt.Println("             cfg <funcName> - Print the basic blocks of function <funcName>")
 			fmt.Println("                   comments - Print all comments")
 			fmt.Println("comment <insnNum> <comment> - Assign a comment to instruction number <insnNum>")
+			fmt.Println("         data <global|addr> - Print the initial value of each member of a global")
+			fmt.Println("          decomp <funcName> - Print C-like pseudocode for function <funcName>")
 			fmt.Println(" dis[as[semble]] <funcName> - Disassemble function <funcName>")
 			fmt.Println("             disi <insnNum> - Disassemble function containing instruction <insnNum>")
-			fmt.Println("                     header - Print the header for the QVM file")
+			fmt.Println("                   dispatch - Print the function vmMain calls for each command")
+			fmt.Println("        engine [q3|quake3e] - Print or set the engine family, choosing the built-in syscalls")
+			fmt.Println("  enum <name> <enumerators> - Declare enum <name> of NAME[=value] enumerators, or PREFIX* for #defined numbers")
+			fmt.Println("             exportc <tgtC> - Translate the whole QVM to portable C")
+			fmt.Println("       exportwasm <tgtWasm> - Compile the QVM to a WebAssembly module")
+			fmt.Println("           frame <funcName> - Print the stack frame layout of function <funcName>")
+			fmt.Println("                    globals - Print all global variables")
+			fmt.Println("                     header - Print the header for the QVM file and the detected module and engine")
 			fmt.Println("            info <funcName> - Print information about function <funcName>")
 			fmt.Println("            infoi <insnNum> - Print information about function containing instruction <insnNum>")
-			fmt.Println("      ren[ame] <orig> <new> - Rename function <orig> to <new>")
+			fmt.Println("loadsyscalls <file> [file...] - Import syscalls from q3asm equs, or C enums in headers and wrappers in sources")
+			fmt.Println("       loadtypes <header.h> - Import the types, prototypes and variables declared in a C header")
+			fmt.Println("   module [cgame|qagame|ui] - Print or set the module type, naming the functions vmMain calls and choosing the built-in syscalls")
+			fmt.Println("      ren[ame] <orig> <new> - Rename function or global <orig> to <new>")
+			fmt.Println("renfield <struct> <orig> <new> - Rename field <orig> of struct <struct> to <new>")
+			fmt.Println("renlocal <funcName> <orig> <new> - Rename local or argument <orig> of function <funcName> to <new>")
+			fmt.Println("     renstruct <orig> <new> - Rename struct, union, enum or typedef <orig> to <new>")
+			fmt.Println("rensyscall <num|name> <new> - Rename syscall <num|name> to <new>")
 			fmt.Println("              save [tgtDar] - Save your disassembly. If opened as a QVM [tgtDar] is required")
 			fmt.Println("      savecomments [tgtCsv] - Save all comments and renamed functions")
-			fmt.Println("      savesyscalls [tgtAsm] - Save all syscalls")
+			fmt.Println("      savesyscalls [tgtAsm] - Save the syscalls loaded, added or renamed as q3asm equs")
+			fmt.Println("           savetypes [tgtH] - Save the type library as C")
+			fmt.Println("setenum <insnNum|funcName argN> <enum> - Show a constant, or argument <argN> of calls to function or syscall <funcName>, as <enum>, or not if <enum> is -")
+			fmt.Println("setsig <funcName> <prototype> - Apply a C prototype to function <funcName>, renaming it")
+			fmt.Println("settype <global|funcName.local> <type> - Apply C type <type> to a global, local or argument")
 			fmt.Println("              sref <string> - Search for functions referencing strings containing <string>")
+			fmt.Println("             ssa <funcName> - Print the SSA form of function <funcName>")
+			fmt.Println("                    structs - Print the type library as C")
 			fmt.Println("                   syscalls - Print all known syscalls")
+			fmt.Println("          verify [funcName] - Check the QVM, or just <funcName>, the way the engine loader does")
+			fmt.Println("           xref <addr|name> - Print the instructions referencing data address <addr>, global or function <name>")
 
+		case "cfg":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: cfg <funcName>")
+				break
+			}
+			found := false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					printCFG(ctx, proc)
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+			}
 		case "comments":
-			for num, comment := range ctx.comments {
+			for num, comment := range ctx.ann.Comments {
 				fmt.Printf("0x%08x: %s\n", num, comment)
 			}
 		case "comment":
@@ -269,7 +930,7 @@ func main() {
 				break
 			}
 			goAhead := true
-			if _, exists := ctx.comments[int(insn)]; exists {
+			if _, exists := ctx.ann.Comments[int(insn)]; exists {
 				fmt.Print("Overwrite existing comment? [Y/n]: ")
 			Ans1:
 				for {
@@ -291,10 +952,53 @@ func main() {
 				}
 			}
 			if goAhead {
-				ctx.comments[int(insn)] = strings.Join(cmd[2:], " ")
+				ctx.ann.Comments[int(insn)] = strings.Join(cmd[2:], " ")
 			} else {
 				fmt.Println("Comment not replaced.")
 			}
+		case "data":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: data <global|addr>")
+				break
+			}
+			var g *qvmd.Global
+			for _, other := range ctx.disCtx.Globals {
+				if other.Name == cmd[1] {
+					g = other
+				}
+			}
+			if addr, err := strconv.ParseUint(cmd[1], 0, 32); err == nil {
+				g = ctx.disCtx.Globals[uint32(addr)]
+			}
+			if g == nil {
+				fmt.Printf("No global named or at \"%s\" found.\n", cmd[1])
+				break
+			}
+			t, exists := ctx.disCtx.GlobalTypes[g.Addr]
+			if !exists {
+				t = qvmd.BaseCType(g.Type)
+				if n := g.Size / t.Size(); n > 1 {
+					t = &qvmd.CType{Kind: qvmd.CArray, Elem: t, Len: n}
+				}
+			}
+			limit := 256
+			printData(ctx, g.Name, g.Addr, t, &limit)
+		case "decomp":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: decomp <funcName>")
+				break
+			}
+			found := false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					fmt.Print(ctx.disCtx.Decompile(proc))
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+			}
 		case "dis", "disas", "disassemble":
 			if len(cmd) < 2 {
 				fmt.Printf("Usage: %s <funcName>\n", cmd[0])
@@ -332,8 +1036,135 @@ func main() {
 			if !found {
 				fmt.Printf("No function containing instruction %d\n", tgt)
 			}
+		case "dispatch":
+			dispatch := ctx.disCtx.Dispatch()
+			if len(dispatch) == 0 {
+				fmt.Println("No dispatch found in vmMain.")
+				break
+			}
+			commands := make([]int, 0, len(dispatch))
+			for command := range dispatch {
+				commands = append(commands, int(command))
+			}
+			sort.Ints(commands)
+			enum := ctx.disCtx.ExportEnum(ctx.disCtx.Module)
+			for _, command := range commands {
+				name := strconv.Itoa(command)
+				if enum != nil {
+					if n, ok := enum.EnumName(command); ok {
+						name = fmt.Sprintf("%s(%d)", n, command)
+					}
+				}
+				fmt.Printf("%s: %s\n", name, dispatch[int32(command)].Name)
+			}
+		case "enum":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: enum <name> <enumerators>")
+				break
+			}
+			if _, err := ctx.disCtx.TypeLib.DefineEnum(cmd[1], cmd[2:]); err != nil {
+				fmt.Println(err)
+			}
+		case "exportc":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: exportc <tgtC>")
+				break
+			}
+			f, err := os.OpenFile(strings.Join(cmd[1:], " "), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if err := ctx.disCtx.WriteC(f); err != nil {
+				fmt.Println(err)
+				f.Close()
+				break
+			}
+			err = f.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "exportwasm":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: exportwasm <tgtWasm>")
+				break
+			}
+			module, err := ctx.disCtx.CompileWasm()
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if err := qvmd.ValidateWasm(module); err != nil {
+				fmt.Printf("Generated module failed validation: %s\n", err)
+				break
+			}
+			f, err := os.OpenFile(strings.Join(cmd[1:], " "), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if _, err := f.Write(module); err != nil {
+				fmt.Println(err)
+				f.Close()
+				break
+			}
+			err = f.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "verify":
+			issues := qvmd.Verify(ctx.dar.QvmFile, ctx.disCtx)
+			if len(cmd) < 2 {
+				printIssues(ctx, issues)
+				fmt.Printf("%d functions checked, %d issues found.\n", len(ctx.disCtx.Procs), len(issues))
+				break
+			}
+			found := false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					found = true
+					fmt.Printf("Max op stack depth: %d\n", ctx.disCtx.AnalyzeStack(proc).MaxDepth)
+					procIssues := make([]qvmd.Issue, 0)
+					for _, issue := range issues {
+						if ctx.disCtx.ProcAt(issue.Insn) == proc {
+							procIssues = append(procIssues, issue)
+						}
+					}
+					printIssues(ctx, procIssues)
+					fmt.Printf("%d issues found.\n", len(procIssues))
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+			}
+		case "frame":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: frame <funcName>")
+				break
+			}
+			found := false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					printFrame(ctx, proc)
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+			}
+		case "globals":
+			for _, g := range ctx.disCtx.SortedGlobals() {
+				decl := g.Type.String() + " " + g.Name
+				if t, exists := ctx.disCtx.GlobalTypes[g.Addr]; exists {
+					decl = t.Decl(g.Name)
+				}
+				fmt.Printf("0x%08x: %s, %d bytes\n", g.Addr, decl, g.Size)
+			}
 		case "header":
 			printHeader(ctx.dar.QvmFile)
+			printDetection(ctx)
 		case "info":
 			if len(cmd) < 2 {
 				fmt.Println("Usage: info <funcName>")
@@ -371,6 +1202,90 @@ func main() {
 			if !found {
 				fmt.Printf("No function containing instruction %d\n", tgt)
 			}
+		case "module":
+			if len(cmd) < 2 {
+				fmt.Println(ctx.disCtx.Module)
+				break
+			}
+			m, ok := qvmd.ParseModule(cmd[1])
+			if !ok || m == qvmd.ModuleUnknown {
+				fmt.Printf("Unknown module \"%s\"\n", cmd[1])
+				break
+			}
+			ctx.disCtx.Module = m
+			ctx.ann.Module = m.String()
+			nameEntry(ctx)
+			ctx.disCtx.ApplyTypeLib()
+			selectSyscalls(ctx)
+		case "engine":
+			if len(cmd) < 2 {
+				fmt.Println(ctx.disCtx.Engine)
+				break
+			}
+			e, ok := qvmd.ParseEngine(cmd[1])
+			if !ok || e == qvmd.EngineUnknown {
+				fmt.Printf("Unknown engine \"%s\"\n", cmd[1])
+				break
+			}
+			ctx.disCtx.Engine = e
+			ctx.ann.Engine = e.String()
+			selectSyscalls(ctx)
+		case "loadtypes":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: loadtypes <header.h>")
+				break
+			}
+			tgtFile := strings.Join(cmd[1:], " ")
+			data, err := ioutil.ReadFile(tgtFile)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			printTypeErrors(tgtFile, ctx.disCtx.TypeLib.Parse(string(data)))
+			ctx.disCtx.ApplyTypeLib()
+		case "loadsyscalls":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: loadsyscalls <file> [file...]")
+				break
+			}
+			if err := loadSyscalls(ctx, cmd[1:]); err != nil {
+				fmt.Println(err)
+			}
+			selectSyscalls(ctx)
+			ctx.disCtx.ApplyTypeLib()
+		case "addsyscall":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: addsyscall <num> <name> [argc]")
+				break
+			}
+			num, err := strconv.ParseInt(cmd[1], 0, 32)
+			if err != nil || num >= 0 {
+				fmt.Printf("Bad syscall number \"%s\"\n", cmd[1])
+				break
+			}
+			sc := qvmd.Syscall{Name: cmd[2], Argc: -1}
+			if len(cmd) >= 4 {
+				if sc.Argc, err = strconv.Atoi(cmd[3]); err != nil || sc.Argc < 0 {
+					fmt.Printf("Bad argument count \"%s\"\n", cmd[3])
+					break
+				}
+			}
+			ctx.userSyscalls[int(num)] = sc
+			selectSyscalls(ctx)
+		case "rensyscall":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: rensyscall <num|name> <new>")
+				break
+			}
+			num, found := findSyscall(ctx, cmd[1])
+			if !found {
+				fmt.Printf("No syscall named \"%s\" found.\n", cmd[1])
+				break
+			}
+			sc := ctx.disCtx.Syscalls[num]
+			sc.Name = cmd[2]
+			ctx.userSyscalls[num] = sc
+			selectSyscalls(ctx)
 		case "ren", "rename":
 			if len(cmd) < 3 {
 				fmt.Printf("Usage: %s <orig> <new>\n", cmd[0])
@@ -381,11 +1296,81 @@ func main() {
 				if proc.Name == cmd[1] {
 					proc.Name = cmd[2]
 					found = true
-					ctx.renames[proc.StartInstruction] = cmd[2]
+					ctx.ann.Renames[proc.StartInstruction] = cmd[2]
+				}
+			}
+			for _, g := range ctx.disCtx.Globals {
+				if g.Name == cmd[1] {
+					g.Name = cmd[2]
+					found = true
+					ctx.ann.Globals[g.Addr] = cmd[2]
 				}
 			}
 			if !found {
+				fmt.Printf("No function or global named \"%s\" found.\n", cmd[1])
+			}
+			ctx.disCtx.ApplyTypeLib()
+		case "renlocal":
+			if len(cmd) < 4 {
+				fmt.Println("Usage: renlocal <funcName> <orig> <new>")
+				break
+			}
+			var proc *qvmd.Procedure
+			for _, p := range ctx.disCtx.Procs {
+				if p.Name == cmd[1] {
+					proc = p
+				}
+			}
+			if proc == nil {
 				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+				break
+			}
+			off, found := findLocal(ctx, proc, cmd[2])
+			if !found {
+				fmt.Printf("No local named \"%s\" found in %s.\n", cmd[2], proc.Name)
+				break
+			}
+			if ctx.disCtx.LocalNames[proc.StartInstruction] == nil {
+				ctx.disCtx.LocalNames[proc.StartInstruction] = make(map[int]string)
+			}
+			ctx.disCtx.LocalNames[proc.StartInstruction][off] = cmd[3]
+		case "renfield":
+			if len(cmd) < 4 {
+				fmt.Println("Usage: renfield <struct> <orig> <new>")
+				break
+			}
+			t, exists := ctx.disCtx.TypeLib.Structs[cmd[1]]
+			if !exists {
+				fmt.Printf("No struct named \"%s\" found.\n", cmd[1])
+				break
+			}
+			found := false
+			for _, f := range t.Fields {
+				if f.Name == cmd[3] {
+					fmt.Printf("Struct %s already has a field named \"%s\".\n", t.Name, cmd[3])
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+			for _, f := range t.Fields {
+				if f.Name == cmd[2] {
+					f.Name = cmd[3]
+					found = true
+				}
+			}
+			if !found {
+				fmt.Printf("No field named \"%s\" found in %s.\n", cmd[2], t.Name)
+			}
+		case "renstruct":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: renstruct <orig> <new>")
+				break
+			}
+			if err := ctx.disCtx.TypeLib.Rename(cmd[1], cmd[2]); err != nil {
+				fmt.Println(err)
 			}
 		case "save":
 			tgtFile := flag.Arg(0)
@@ -396,7 +1381,12 @@ func main() {
 				fmt.Println("Opened as a single QVM. Please save to a new dar")
 				break
 			}
-			if err := ctx.dar.CommentsFile.Write(ctx.comments, ctx.renames); err != nil {
+			storeTypes(ctx)
+			if err := ctx.dar.CommentsFile.Write(ctx.ann); err != nil {
+				fmt.Println(err)
+				break
+			}
+			if err := ctx.dar.SyscallsFile.Write(savedSyscalls(ctx)); err != nil {
 				fmt.Println(err)
 				break
 			}
@@ -444,7 +1434,8 @@ func main() {
 				break
 			}
 
-			if err := ctx.dar.CommentsFile.Write(ctx.comments, ctx.renames); err != nil {
+			storeTypes(ctx)
+			if err := ctx.dar.CommentsFile.Write(ctx.ann); err != nil {
 				fmt.Println(err)
 				break
 			}
@@ -478,7 +1469,11 @@ func main() {
 			}
 
 		case "savesyscalls":
-			tgtFile := scFile
+			//C sources the syscalls were imported from aren't overwritten.
+			tgtFile := ""
+			if len(scFiles) == 1 && !isCSource(scFile) {
+				tgtFile = scFile
+			}
 			if len(cmd) >= 2 {
 				tgtFile = strings.Join(cmd[1:], " ")
 			}
@@ -487,6 +1482,14 @@ func main() {
 				fmt.Println("savesyscalls <file>")
 				break
 			}
+			if isCSource(tgtFile) {
+				fmt.Println("Syscalls are saved as q3asm equs, not C")
+				break
+			}
+			if err := ctx.dar.SyscallsFile.Write(savedSyscalls(ctx)); err != nil {
+				fmt.Println(err)
+				break
+			}
 
 			f, err := os.OpenFile(tgtFile, os.O_RDWR|os.O_CREATE, 0600)
 			if err != nil {
@@ -515,6 +1518,172 @@ func main() {
 			if err != nil {
 				fmt.Println(err)
 			}
+		case "savetypes":
+			tgtFile := tyFile
+			if len(cmd) >= 2 {
+				tgtFile = strings.Join(cmd[1:], " ")
+			}
+			if tgtFile == "" {
+				fmt.Println("Usage: savetypes <file>")
+				break
+			}
+			f, err := os.OpenFile(tgtFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if _, err := f.WriteString(ctx.disCtx.TypeLib.String()); err != nil {
+				fmt.Println(err)
+				f.Close()
+				break
+			}
+			err = f.Close()
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "setenum":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: setenum <insnNum|funcName argN> <enum|->")
+				break
+			}
+			t, err := parseEnum(ctx, cmd[len(cmd)-1])
+			if err != nil && cmd[len(cmd)-1] != "-" {
+				fmt.Println(err)
+				break
+			}
+			if len(cmd) == 3 {
+				insn, err := strconv.ParseUint(cmd[1], 0, 64)
+				if err != nil || int(insn) >= len(ctx.disCtx.Insns) || ctx.disCtx.Insns[insn].Op != qvmd.OP_CONST {
+					fmt.Printf("Instruction %s is not a CONST.\n", cmd[1])
+					break
+				}
+				if t == nil {
+					delete(ctx.disCtx.EnumConsts, int(insn))
+				} else {
+					ctx.disCtx.EnumConsts[int(insn)] = t
+				}
+				break
+			}
+			target, found := 0, false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					target, found = proc.StartInstruction, true
+				}
+			}
+			for num, sc := range ctx.disCtx.Syscalls {
+				if sc.Name == cmd[1] {
+					target, found = num, true
+				}
+			}
+			if num, err := strconv.ParseInt(cmd[1], 0, 32); err == nil && num < 0 {
+				target, found = int(num), true
+			}
+			if !found {
+				fmt.Printf("No function or syscall named \"%s\" found.\n", cmd[1])
+				break
+			}
+			n, err := strconv.ParseUint(cmd[2], 0, 8)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if t == nil {
+				delete(ctx.disCtx.EnumArgs[target], int(n))
+				break
+			}
+			if ctx.disCtx.EnumArgs[target] == nil {
+				ctx.disCtx.EnumArgs[target] = make(map[int]*qvmd.CType)
+			}
+			ctx.disCtx.EnumArgs[target][int(n)] = t
+		case "setsig":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: setsig <funcName> <prototype>")
+				break
+			}
+			var proc *qvmd.Procedure
+			for _, p := range ctx.disCtx.Procs {
+				if p.Name == cmd[1] {
+					proc = p
+				}
+			}
+			if proc == nil {
+				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+				break
+			}
+			name, t, err := ctx.disCtx.TypeLib.ParseDecl(strings.Join(cmd[2:], " "))
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if t.Kind != qvmd.CFunc {
+				fmt.Printf("%s is not a prototype.\n", strings.Join(cmd[2:], " "))
+				break
+			}
+			if name != "" && name != proc.Name {
+				proc.Name = name
+				ctx.ann.Renames[proc.StartInstruction] = name
+			}
+			ctx.disCtx.ApplyPrototype(proc, t)
+		case "settype":
+			if len(cmd) < 3 {
+				fmt.Println("Usage: settype <global|funcName.local> <type>")
+				break
+			}
+			t, err := ctx.disCtx.TypeLib.ParseType(strings.Join(cmd[2:], " "))
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			if dot := strings.Index(cmd[1], "."); dot >= 0 {
+				var proc *qvmd.Procedure
+				for _, p := range ctx.disCtx.Procs {
+					if p.Name == cmd[1][:dot] {
+						proc = p
+					}
+				}
+				if proc == nil {
+					fmt.Printf("No function named \"%s\" found.\n", cmd[1][:dot])
+					break
+				}
+				off, found := findLocal(ctx, proc, cmd[1][dot+1:])
+				if !found {
+					fmt.Printf("No local named \"%s\" found in %s.\n", cmd[1][dot+1:], proc.Name)
+					break
+				}
+				if ctx.disCtx.LocalTypes[proc.StartInstruction] == nil {
+					ctx.disCtx.LocalTypes[proc.StartInstruction] = make(map[int]*qvmd.CType)
+				}
+				ctx.disCtx.LocalTypes[proc.StartInstruction][off] = t
+				break
+			}
+			found := false
+			for _, g := range ctx.disCtx.Globals {
+				if g.Name == cmd[1] {
+					ctx.disCtx.GlobalTypes[g.Addr] = t
+					found = true
+				}
+			}
+			if !found {
+				fmt.Printf("No global named \"%s\" found.\n", cmd[1])
+			}
+		case "ssa":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: ssa <funcName>")
+				break
+			}
+			found := false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					f := ctx.disCtx.Lift(proc)
+					fmt.Print(f)
+					printIssues(ctx, f.Validate())
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("No function named \"%s\" found.\n", cmd[1])
+			}
 		case "sref":
 			if len(cmd) < 2 {
 				fmt.Println("Usage: sref <string>")
@@ -542,14 +1711,60 @@ func main() {
 			if !found {
 				fmt.Printf("No functions containing \"%s\"\n", strings.Join(cmd[1:], " "))
 			}
+		case "structs":
+			fmt.Print(ctx.disCtx.TypeLib.String())
 		case "syscalls":
-			keys := make([]int, len(ctx.disCtx.Syscalls))
+			keys := make([]int, 0, len(ctx.disCtx.Syscalls))
 			for key, _ := range ctx.disCtx.Syscalls {
 				keys = append(keys, key)
 			}
+			for key, _ := range ctx.syscallArgc {
+				if _, exists := ctx.disCtx.Syscalls[key]; !exists {
+					keys = append(keys, key)
+				}
+			}
 			sort.Sort(sort.IntSlice(keys))
 			for _, key := range keys {
-				fmt.Printf("%d: %s\n", key, ctx.disCtx.Syscalls[key].Name)
+				name := "Unknown syscall"
+				if sc, exists := ctx.disCtx.Syscalls[key]; exists {
+					name = sc.Name
+					if sc.Type != nil {
+						name = sc.Type.Decl(sc.Name)
+					}
+				}
+				if argc, exists := ctx.syscallArgc[key]; exists && argc >= 0 {
+					fmt.Printf("%d: %s argc %d\n", key, name, argc)
+				} else {
+					fmt.Printf("%d: %s\n", key, name)
+				}
+			}
+			printIssues(ctx, ctx.syscallIssues)
+		case "xref":
+			if len(cmd) < 2 {
+				fmt.Println("Usage: xref <addr|name>")
+				break
+			}
+			if addr, err := strconv.ParseUint(cmd[1], 0, 32); err == nil {
+				printDataXRefs(ctx, uint32(addr))
+				break
+			}
+			found := false
+			for _, proc := range ctx.disCtx.Procs {
+				if proc.Name == cmd[1] {
+					printCallXRefs(ctx, proc)
+					found = true
+					break
+				}
+			}
+			for _, g := range ctx.disCtx.Globals {
+				if g.Name == cmd[1] {
+					printDataXRefs(ctx, g.Addr)
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("No function or global named \"%s\" found.\n", cmd[1])
 			}
 		}
 	}
@@ -0,0 +1,346 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+//Number of arguments vmMain receives, including the command number.
+const cVmMainArgs = 13
+
+const cPrelude = `#include <stdint.h>
+#include <string.h>
+#include <stdio.h>
+#include <stdlib.h>
+
+/* Syscall callback. args[0] is the syscall number (-1 - target) and the
+   arguments follow it. Pointers are offsets into qvm_image. */
+typedef int32_t (*qvm_syscall_t)(int32_t *args);
+
+static qvm_syscall_t qvm_syscall;
+static int32_t qvm_programStack = VM_DATAMASK + 1;
+
+static inline int32_t vm_i(float f) { int32_t i; memcpy(&i, &f, 4); return i; }
+static inline float vm_f(int32_t i) { float f; memcpy(&f, &i, 4); return f; }
+
+static inline int32_t vm_load1(int32_t a) { return qvm_image[a & VM_DATAMASK]; }
+static inline int32_t vm_load2(int32_t a) { uint16_t v; memcpy(&v, &qvm_image[a & VM_DATAMASK], 2); return v; }
+static inline int32_t vm_load4(int32_t a) { int32_t v; memcpy(&v, &qvm_image[a & VM_DATAMASK], 4); return v; }
+static inline void vm_store1(int32_t a, int32_t v) { qvm_image[a & VM_DATAMASK] = (uint8_t)v; }
+static inline void vm_store2(int32_t a, int32_t v) { uint16_t s = (uint16_t)v; memcpy(&qvm_image[a & VM_DATAMASK], &s, 2); }
+static inline void vm_store4(int32_t a, int32_t v) { memcpy(&qvm_image[a & VM_DATAMASK], &v, 4); }
+
+static void vm_abort(const char *msg, int insn)
+{
+	fprintf(stderr, "qvm: %s at instruction %d\n", msg, insn);
+	abort();
+}
+
+static inline void vm_blockcopy(int32_t dest, int32_t src, int32_t n)
+{
+	dest &= VM_DATAMASK;
+	src &= VM_DATAMASK;
+	if (dest + n > VM_DATAMASK + 1 || src + n > VM_DATAMASK + 1)
+		vm_abort("BLOCK_COPY out of range", -1);
+	memmove(&qvm_image[dest], &qvm_image[src], n);
+}
+
+static int32_t vm_call(int32_t target, int32_t programStack);
+
+`
+
+//WriteC translates every procedure into portable C and writes the result to
+//w. The output contains the data image, one C function per procedure, a
+//dispatcher for calls through computed targets, and the dllEntry/vmMain
+//pair a native module exports. Syscalls go through the callback handed to
+//dllEntry, which receives the arguments exactly like the engine's VM does.
+func (ctx *Context) WriteC(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	hdr := ctx.QvmFile.Header
+	mask := ctx.QvmFile.DataMask()
+	procs := ctx.SortedProcs()
+	if len(procs) == 0 {
+		return fmt.Errorf("No procedures to translate")
+	}
+	names := cProcNames(procs)
+
+	fmt.Fprintf(buf, "/* Translated from QVM bytecode: %d instructions, %d procedures. */\n\n", hdr.InstructionCount, len(procs))
+	fmt.Fprintf(buf, "#define VM_DATAMASK 0x%08xu\n", mask)
+	fmt.Fprintf(buf, "#define VM_OPSTACK_SIZE %d\n\n", OpStackSize)
+
+	//Data and lit are initialised, bss is left to the implicit zero fill.
+	image := append(append([]byte{}, ctx.QvmFile.Data...), ctx.QvmFile.Lit...)
+	fmt.Fprintf(buf, "#include <stdint.h>\n\nuint8_t qvm_image[VM_DATAMASK + 1] = {")
+	for i, b := range image {
+		if i%16 == 0 {
+			fmt.Fprintf(buf, "\n\t")
+		}
+		fmt.Fprintf(buf, "0x%02x,", b)
+	}
+	fmt.Fprintf(buf, "\n};\n\n")
+	buf.WriteString(cPrelude)
+
+	for _, proc := range procs {
+		fmt.Fprintf(buf, "static int32_t %s(int32_t programStack);\n", names[proc])
+	}
+	buf.WriteString("\n")
+
+	for _, proc := range procs {
+		if err := ctx.writeCProc(buf, proc, names); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteString("static int32_t vm_call(int32_t target, int32_t programStack)\n{\n")
+	buf.WriteString("\tint32_t saved, r;\n\n")
+	buf.WriteString("\tif (target < 0) {\n")
+	buf.WriteString("\t\tvm_store4(programStack + 4, -1 - target);\n")
+	buf.WriteString("\t\tsaved = qvm_programStack;\n")
+	buf.WriteString("\t\tqvm_programStack = programStack - 4;\n")
+	buf.WriteString("\t\tr = qvm_syscall((int32_t *)&qvm_image[(programStack + 4) & VM_DATAMASK]);\n")
+	buf.WriteString("\t\tqvm_programStack = saved;\n")
+	buf.WriteString("\t\treturn r;\n\t}\n")
+	buf.WriteString("\tswitch (target) {\n")
+	for _, proc := range procs {
+		fmt.Fprintf(buf, "\tcase %d: return %s(programStack);\n", proc.StartInstruction, names[proc])
+	}
+	buf.WriteString("\t}\n\tvm_abort(\"call to a non-procedure\", target);\n\treturn 0;\n}\n\n")
+
+	buf.WriteString("void dllEntry(qvm_syscall_t syscallptr)\n{\n\tqvm_syscall = syscallptr;\n}\n\n")
+	buf.WriteString("intptr_t vmMain(int command")
+	for i := 0; i < cVmMainArgs-1; i++ {
+		fmt.Fprintf(buf, ", int arg%d", i)
+	}
+	buf.WriteString(")\n{\n")
+	buf.WriteString("\tint32_t saved = qvm_programStack;\n")
+	fmt.Fprintf(buf, "\tint32_t programStack = saved - (8 + 4 * %d);\n", cVmMainArgs)
+	buf.WriteString("\tint32_t r;\n\n")
+	buf.WriteString("\tvm_store4(programStack, -1);\n\tvm_store4(programStack + 4, 0);\n")
+	buf.WriteString("\tvm_store4(programStack + 8, command);\n")
+	for i := 0; i < cVmMainArgs-1; i++ {
+		fmt.Fprintf(buf, "\tvm_store4(programStack + %d, arg%d);\n", 12+4*i, i)
+	}
+	buf.WriteString("\tqvm_programStack = programStack;\n")
+	fmt.Fprintf(buf, "\tr = %s(programStack);\n", names[procs[0]])
+	buf.WriteString("\tqvm_programStack = saved;\n\treturn r;\n}\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+//cProcNames maps every procedure to a unique C identifier. Renamed
+//procedures keep their name where it is a valid identifier.
+func cProcNames(procs []*Procedure) map[*Procedure]string {
+	names := make(map[*Procedure]string, len(procs))
+	used := make(map[string]bool, len(procs))
+	for _, proc := range procs {
+		name := "qvm_" + proc.Name
+		if !cIdentifier(proc.Name) || used[name] {
+			name = fmt.Sprintf("qvm_sub_%08x", proc.StartInstruction)
+		}
+		used[name] = true
+		names[proc] = name
+	}
+	return names
+}
+
+func cIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var cIntCompare = map[int]string{
+	OP_EQ: "r1 == r0", OP_NE: "r1 != r0",
+	OP_LTI: "r1 < r0", OP_LEI: "r1 <= r0", OP_GTI: "r1 > r0", OP_GEI: "r1 >= r0",
+	OP_LTU: "(uint32_t)r1 < (uint32_t)r0", OP_LEU: "(uint32_t)r1 <= (uint32_t)r0",
+	OP_GTU: "(uint32_t)r1 > (uint32_t)r0", OP_GEU: "(uint32_t)r1 >= (uint32_t)r0",
+	OP_EQF: "vm_f(r1) == vm_f(r0)", OP_NEF: "vm_f(r1) != vm_f(r0)",
+	OP_LTF: "vm_f(r1) < vm_f(r0)", OP_LEF: "vm_f(r1) <= vm_f(r0)",
+	OP_GTF: "vm_f(r1) > vm_f(r0)", OP_GEF: "vm_f(r1) >= vm_f(r0)",
+}
+
+var cBinary = map[int]string{
+	OP_ADD:  "(int32_t)((uint32_t)r1 + (uint32_t)r0)",
+	OP_SUB:  "(int32_t)((uint32_t)r1 - (uint32_t)r0)",
+	OP_DIVI: "r1 / r0",
+	OP_DIVU: "(int32_t)((uint32_t)r1 / (uint32_t)r0)",
+	OP_MODI: "r1 % r0",
+	OP_MODU: "(int32_t)((uint32_t)r1 % (uint32_t)r0)",
+	OP_MULI: "(int32_t)((uint32_t)r1 * (uint32_t)r0)",
+	OP_MULU: "(int32_t)((uint32_t)r1 * (uint32_t)r0)",
+	OP_BAND: "r1 & r0",
+	OP_BOR:  "r1 | r0",
+	OP_BXOR: "r1 ^ r0",
+	OP_LSH:  "(int32_t)((uint32_t)r1 << (r0 & 31))",
+	OP_RSHI: "r1 >> (r0 & 31)",
+	OP_RSHU: "(int32_t)((uint32_t)r1 >> (r0 & 31))",
+	OP_ADDF: "vm_i(vm_f(r1) + vm_f(r0))",
+	OP_SUBF: "vm_i(vm_f(r1) - vm_f(r0))",
+	OP_DIVF: "vm_i(vm_f(r1) / vm_f(r0))",
+	OP_MULF: "vm_i(vm_f(r1) * vm_f(r0))",
+}
+
+var cUnary = map[int]string{
+	OP_SEX8:  "(int8_t)opStack[sp - 1]",
+	OP_SEX16: "(int16_t)opStack[sp - 1]",
+	OP_NEGI:  "(int32_t)(0u - (uint32_t)opStack[sp - 1])",
+	OP_BCOM:  "~opStack[sp - 1]",
+	OP_NEGF:  "vm_i(-vm_f(opStack[sp - 1]))",
+	OP_CVIF:  "vm_i((float)opStack[sp - 1])",
+	OP_CVFI:  "(int32_t)vm_f(opStack[sp - 1])",
+	OP_LOAD1: "vm_load1(opStack[sp - 1])",
+	OP_LOAD2: "vm_load2(opStack[sp - 1])",
+	OP_LOAD4: "vm_load4(opStack[sp - 1])",
+}
+
+var cStore = map[int]string{
+	OP_STORE1: "vm_store1",
+	OP_STORE2: "vm_store2",
+	OP_STORE4: "vm_store4",
+}
+
+func (ctx *Context) writeCProc(buf *bytes.Buffer, proc *Procedure, names map[*Procedure]string) error {
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+
+	//Work out which instructions need a label. A JUMP through a computed
+	//target can land anywhere in the procedure, so in that case all of
+	//them get one.
+	labels := make(map[int]bool)
+	computedJump := false
+	for i := start; i < end; i++ {
+		insn := ctx.Insns[i]
+		switch {
+		case !insn.Valid:
+		case insn.Op >= OP_EQ && insn.Op <= OP_GEF:
+			labels[int(insn.IntArg())] = true
+		case insn.Op == OP_JUMP:
+			if i > start && ctx.Insns[i-1].Op == OP_CONST {
+				labels[int(ctx.Insns[i-1].IntArg())] = true
+			} else {
+				computedJump = true
+			}
+		}
+	}
+	if computedJump {
+		for i := start; i < end; i++ {
+			labels[i] = true
+		}
+	}
+
+	fmt.Fprintf(buf, "/* %s: instructions 0x%x-0x%x, frame size 0x%x */\n", proc.Name, start, end-1, proc.FrameSize)
+	fmt.Fprintf(buf, "static int32_t %s(int32_t programStack)\n{\n", names[proc])
+	buf.WriteString("\tint32_t opStack[VM_OPSTACK_SIZE];\n\tint sp = 0;\n\tint32_t r0, r1;\n")
+	if computedJump {
+		buf.WriteString("\tint32_t target;\n")
+	}
+	buf.WriteString("\n\t(void)r0; (void)r1; (void)opStack;\n")
+
+	for i := start; i < end; i++ {
+		insn := ctx.Insns[i]
+		if labels[i] {
+			fmt.Fprintf(buf, "L_%08x:\n", i)
+		}
+		if !insn.Valid {
+			fmt.Fprintf(buf, "\tvm_abort(\"illegal opcode %d\", %d);\n", insn.Op, i)
+			continue
+		}
+		arg := insn.IntArg()
+		switch op := insn.Op; {
+		case op == OP_UNDEF, op == OP_IGNORE, op == OP_BREAK:
+			fmt.Fprintf(buf, "\t; /* %s */\n", insn.Mnemonic())
+		case op == OP_ENTER:
+			fmt.Fprintf(buf, "\tprogramStack -= %d;\n", arg)
+		case op == OP_LEAVE:
+			buf.WriteString("\treturn sp > 0 ? opStack[sp - 1] : 0;\n")
+		case op == OP_CALL:
+			target := -1
+			if i > start && ctx.Insns[i-1].Op == OP_CONST {
+				target = int(ctx.Insns[i-1].IntArg())
+			}
+			if tgtProc, exists := ctx.Procs[target]; exists {
+				fmt.Fprintf(buf, "\tsp--;\n\topStack[sp++] = %s(programStack);\n", names[tgtProc])
+			} else {
+				buf.WriteString("\tr0 = opStack[--sp];\n\topStack[sp++] = vm_call(r0, programStack);\n")
+			}
+		case op == OP_PUSH:
+			buf.WriteString("\topStack[sp++] = 0;\n")
+		case op == OP_POP:
+			buf.WriteString("\tsp--;\n")
+		case op == OP_CONST:
+			fmt.Fprintf(buf, "\topStack[sp++] = (int32_t)0x%08xu;\n", uint32(arg))
+		case op == OP_LOCAL:
+			fmt.Fprintf(buf, "\topStack[sp++] = programStack + %d;\n", arg)
+		case op == OP_JUMP:
+			if i > start && ctx.Insns[i-1].Op == OP_CONST {
+				target := int(ctx.Insns[i-1].IntArg())
+				if target >= start && target < end {
+					fmt.Fprintf(buf, "\tsp--;\n\tgoto L_%08x;\n", target)
+					break
+				}
+			}
+			if computedJump {
+				buf.WriteString("\ttarget = opStack[--sp];\n\tgoto dispatch;\n")
+			} else {
+				fmt.Fprintf(buf, "\tvm_abort(\"jump out of procedure\", %d);\n", i)
+			}
+		case op >= OP_EQ && op <= OP_GEF:
+			buf.WriteString("\tr0 = opStack[--sp];\n\tr1 = opStack[--sp];\n")
+			if target := int(arg); target >= start && target < end {
+				fmt.Fprintf(buf, "\tif (%s) goto L_%08x;\n", cIntCompare[op], target)
+			} else {
+				fmt.Fprintf(buf, "\tif (%s) vm_abort(\"branch out of procedure\", %d);\n", cIntCompare[op], i)
+			}
+		case cStore[op] != "":
+			fmt.Fprintf(buf, "\tr0 = opStack[--sp];\n\tr1 = opStack[--sp];\n\t%s(r1, r0);\n", cStore[op])
+		case op == OP_ARG:
+			fmt.Fprintf(buf, "\tvm_store4(programStack + %d, opStack[--sp]);\n", arg)
+		case op == OP_BLOCK_COPY:
+			fmt.Fprintf(buf, "\tr0 = opStack[--sp];\n\tr1 = opStack[--sp];\n\tvm_blockcopy(r1, r0, %d);\n", arg)
+		case cUnary[op] != "":
+			fmt.Fprintf(buf, "\topStack[sp - 1] = %s;\n", cUnary[op])
+		case cBinary[op] != "":
+			fmt.Fprintf(buf, "\tr0 = opStack[--sp];\n\tr1 = opStack[sp - 1];\n\topStack[sp - 1] = %s;\n", cBinary[op])
+		default:
+			return fmt.Errorf("Cannot translate %s at %d", insn.Mnemonic(), i)
+		}
+	}
+
+	//Falling off the end means the last instruction was not a LEAVE.
+	buf.WriteString("\treturn sp > 0 ? opStack[sp - 1] : 0;\n")
+	if computedJump {
+		buf.WriteString("dispatch:\n\tswitch (target) {\n")
+		for i := start; i < end; i++ {
+			fmt.Fprintf(buf, "\tcase %d: goto L_%08x;\n", i, i)
+		}
+		buf.WriteString("\t}\n\tvm_abort(\"jump out of procedure\", target);\n\treturn 0;\n")
+	}
+	buf.WriteString("}\n\n")
+	return nil
+}
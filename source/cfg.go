@@ -0,0 +1,193 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"sort"
+)
+
+//BasicBlock is a straight run of instructions [Start, End) that is only
+//entered at Start and only left after End-1.
+type BasicBlock struct {
+	Index      int
+	Start, End int
+	Succs      []*BasicBlock
+	Preds      []*BasicBlock
+}
+
+//CFG is the control flow graph of one procedure. Blocks are ordered by
+//their start instruction, so Blocks[0] is the entry block.
+type CFG struct {
+	Proc   *Procedure
+	Blocks []*BasicBlock
+	//JUMP instructions whose targets could not be resolved. Their blocks
+	//have no successors.
+	UnresolvedJumps []int
+	blockOf         []int
+}
+
+//IsBranch reports whether op is one of the conditional branches.
+func IsBranch(op int) bool {
+	return op >= OP_EQ && op <= OP_GEF
+}
+
+//Last returns the instruction number of the block's final instruction.
+func (b *BasicBlock) Last() int {
+	return b.End - 1
+}
+
+//BlockAt returns the block containing instruction insn, or nil if insn is
+//outside the procedure.
+func (cfg *CFG) BlockAt(insn int) *BasicBlock {
+	i := insn - cfg.Proc.StartInstruction
+	if i < 0 || i >= len(cfg.blockOf) {
+		return nil
+	}
+	return cfg.Blocks[cfg.blockOf[i]]
+}
+
+//Exits returns the blocks that end in a LEAVE.
+func (cfg *CFG) Exits(ctx *Context) []*BasicBlock {
+	exits := make([]*BasicBlock, 0)
+	for _, b := range cfg.Blocks {
+		if ctx.Insns[b.Last()].Op == OP_LEAVE {
+			exits = append(exits, b)
+		}
+	}
+	return exits
+}
+
+//CFG returns the control flow graph of proc, building it on first use.
+func (ctx *Context) CFG(proc *Procedure) *CFG {
+	if ctx.cfgs == nil {
+		ctx.cfgs = make(map[int]*CFG)
+	}
+	if cfg, exists := ctx.cfgs[proc.StartInstruction]; exists {
+		return cfg
+	}
+	cfg := ctx.BuildCFG(proc)
+	ctx.cfgs[proc.StartInstruction] = cfg
+	return cfg
+}
+
+//JumpTargets returns the instructions the JUMP at insn can land on inside
+//its procedure. A JUMP preceded by CONST has exactly one target. Computed
+//jumps go to the cases of their switch table, or else anywhere the
+//VM_MAGIC_VER2 jump table allows inside the procedure. The second result is
+//false when nothing could be resolved.
+func (ctx *Context) JumpTargets(proc *Procedure, insn int) ([]int, bool) {
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+	if insn > start && ctx.Insns[insn-1].Op == OP_CONST {
+		tgt := int(ctx.Insns[insn-1].IntArg())
+		if tgt < start || tgt >= end {
+			return nil, false
+		}
+		return []int{tgt}, true
+	}
+	if sw, ok := ctx.Switch(proc, insn); ok {
+		return sw.UniqueTargets(), true
+	}
+	targets := make([]int, 0)
+	for _, tgt := range ctx.QvmFile.JumpTableTargets() {
+		if tgt >= start && tgt < end {
+			targets = append(targets, tgt)
+		}
+	}
+	return targets, len(targets) > 0
+}
+
+//BuildCFG splits proc into basic blocks and links them. Blocks end at JUMP,
+//at the conditional branches and at LEAVE, and start at every branch
+//target. CALL does not end a block since control returns right after it.
+func (ctx *Context) BuildCFG(proc *Procedure) *CFG {
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+	cfg := &CFG{proc, nil, nil, nil}
+
+	//Find the leaders and the explicit targets of every block end.
+	leaders := map[int]bool{start: true}
+	targets := make(map[int][]int)
+	for i := start; i < end; i++ {
+		insn := ctx.Insns[i]
+		if !insn.Valid {
+			continue
+		}
+		switch {
+		case IsBranch(insn.Op):
+			if tgt := int(insn.IntArg()); tgt >= start && tgt < end {
+				targets[i] = []int{tgt}
+				leaders[tgt] = true
+			}
+			leaders[i+1] = true
+		case insn.Op == OP_JUMP:
+			tgts, ok := ctx.JumpTargets(proc, i)
+			if !ok {
+				cfg.UnresolvedJumps = append(cfg.UnresolvedJumps, i)
+			}
+			for _, tgt := range tgts {
+				leaders[tgt] = true
+			}
+			targets[i] = tgts
+			leaders[i+1] = true
+		case insn.Op == OP_LEAVE:
+			leaders[i+1] = true
+		}
+	}
+
+	starts := make([]int, 0, len(leaders))
+	for i := range leaders {
+		if i < end {
+			starts = append(starts, i)
+		}
+	}
+	sort.Ints(starts)
+
+	cfg.blockOf = make([]int, proc.InstructionCount)
+	for k, s := range starts {
+		e := end
+		if k+1 < len(starts) {
+			e = starts[k+1]
+		}
+		cfg.Blocks = append(cfg.Blocks, &BasicBlock{k, s, e, nil, nil})
+		for i := s; i < e; i++ {
+			cfg.blockOf[i-start] = k
+		}
+	}
+
+	for _, b := range cfg.Blocks {
+		last := ctx.Insns[b.Last()]
+		for _, tgt := range targets[b.Last()] {
+			cfg.link(b, cfg.BlockAt(tgt))
+		}
+		if last.Valid && (last.Op == OP_JUMP || last.Op == OP_LEAVE) {
+			continue
+		}
+		if b.End < end {
+			cfg.link(b, cfg.BlockAt(b.End))
+		}
+	}
+	return cfg
+}
+
+func (cfg *CFG) link(from, to *BasicBlock) {
+	for _, succ := range from.Succs {
+		if succ == to {
+			return
+		}
+	}
+	from.Succs = append(from.Succs, to)
+	to.Preds = append(to.Preds, from)
+}
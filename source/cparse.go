@@ -0,0 +1,1012 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//cParser reads C declarations into a TypeLib.
+type cParser struct {
+	lib    *TypeLib
+	tokens []string
+	lines  []int
+	pos    int
+	depth  int //of the braces being parsed
+	anon   int
+
+	unknownZero bool //in #if, where unknown identifiers are 0
+}
+
+//cToken is a token and the line it is on.
+type cToken struct {
+	text string
+	line int
+}
+
+//stripComments blanks out the comments of src, keeping its lines.
+func stripComments(src string) string {
+	buf := []byte(src)
+	for i := 0; i < len(buf); i++ {
+		switch {
+		case buf[i] == '"' || buf[i] == '\'':
+			quote := buf[i]
+			for i++; i < len(buf) && buf[i] != quote && buf[i] != '\n'; i++ {
+				if buf[i] == '\\' {
+					i++
+				}
+			}
+		case buf[i] == '/' && i+1 < len(buf) && buf[i+1] == '/':
+			for ; i < len(buf) && buf[i] != '\n'; i++ {
+				buf[i] = ' '
+			}
+		case buf[i] == '/' && i+1 < len(buf) && buf[i+1] == '*':
+			for ; i < len(buf) && !(buf[i] == '*' && i+1 < len(buf) && buf[i+1] == '/'); i++ {
+				if buf[i] != '\n' {
+					buf[i] = ' '
+				}
+			}
+			if i+1 < len(buf) {
+				buf[i], buf[i+1] = ' ', ' '
+				i++
+			}
+		}
+	}
+	return string(buf)
+}
+
+var cPunctuators = []string{"...", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||", "->"}
+
+//cSplit splits a line of C into identifiers, numbers, literals and
+//punctuation.
+func cSplit(line string) []string {
+	tokens := make([]string, 0)
+	for i := 0; i < len(line); {
+		c := line[i]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v' {
+			i++
+			continue
+		}
+		j := i + 1
+		switch {
+		case c == '"' || c == '\'':
+			for j < len(line) && line[j] != c {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(line) {
+				j++
+			}
+		case unicode.IsDigit(rune(c)):
+			for j < len(line) && (isIdentChar(line[j]) || line[j] == '.') {
+				j++
+			}
+		case isIdentChar(c):
+			for j < len(line) && isIdentChar(line[j]) {
+				j++
+			}
+		default:
+			for _, punct := range cPunctuators {
+				if strings.HasPrefix(line[i:], punct) {
+					j = i + len(punct)
+					break
+				}
+			}
+		}
+		if j > len(line) {
+			j = len(line)
+		}
+		tokens = append(tokens, line[i:j])
+		i = j
+	}
+	return tokens
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c < 0x80 && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)))
+}
+
+//expand replaces the object-like macros among tokens with their values.
+func (lib *TypeLib) expand(tokens []string, expanding map[string]bool) []string {
+	expanded := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		value, exists := lib.defines[tok]
+		if !exists || expanding[tok] {
+			expanded = append(expanded, tok)
+			continue
+		}
+		expanding[tok] = true
+		expanded = append(expanded, lib.expand(cSplit(value), expanding)...)
+		delete(expanding, tok)
+	}
+	return expanded
+}
+
+//preprocess tokenizes src, following #define, #undef and the conditionals
+//and expanding macros without arguments. Other directives are ignored.
+func (lib *TypeLib) preprocess(src string) ([]cToken, error) {
+	tokens := make([]cToken, 0)
+	//Each open conditional is active if its lines are used, and done
+	//once one of its branches was.
+	type cond struct{ active, done bool }
+	conds := make([]cond, 0)
+	active := func() bool {
+		return len(conds) == 0 || conds[len(conds)-1].active
+	}
+	lines := strings.Split(stripComments(src), "\n")
+	for n := 0; n < len(lines); n++ {
+		lineNum := n + 1
+		line := lines[n]
+		for strings.HasSuffix(line, "\\") && n+1 < len(lines) {
+			n++
+			line = line[:len(line)-1] + " " + lines[n]
+		}
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "#") {
+			if active() {
+				for _, tok := range lib.expand(cSplit(line), make(map[string]bool)) {
+					tokens = append(tokens, cToken{tok, lineNum})
+				}
+			}
+			continue
+		}
+		words := cSplit(trimmed[1:])
+		if len(words) == 0 {
+			continue
+		}
+		outer := len(conds) == 0 || len(conds) == 1 || conds[len(conds)-2].active
+		switch words[0] {
+		case "if", "ifdef", "ifndef":
+			if !active() {
+				conds = append(conds, cond{false, true})
+				break
+			}
+			taken := lib.condition(words)
+			conds = append(conds, cond{taken, taken})
+		case "elif", "else":
+			if len(conds) == 0 {
+				return nil, fmt.Errorf("Line %d: #%s without #if", lineNum, words[0])
+			}
+			c := &conds[len(conds)-1]
+			c.active = outer && !c.done && (words[0] == "else" || lib.condition(words))
+			c.done = c.done || c.active
+		case "endif":
+			if len(conds) == 0 {
+				return nil, fmt.Errorf("Line %d: #endif without #if", lineNum)
+			}
+			conds = conds[:len(conds)-1]
+		case "define":
+			if !active() || len(words) < 2 || !isIdent(words[1]) {
+				break
+			}
+			rest := strings.TrimSpace(trimmed[1:])
+			rest = strings.TrimSpace(rest[len("define"):])
+			rest = rest[len(words[1]):]
+			if strings.HasPrefix(rest, "(") {
+				//Macros with arguments are only known to be defined.
+				lib.functionMacros[words[1]] = true
+				break
+			}
+			lib.defines[words[1]] = strings.TrimSpace(rest)
+		case "undef":
+			if active() && len(words) >= 2 {
+				delete(lib.defines, words[1])
+				delete(lib.functionMacros, words[1])
+			}
+		}
+	}
+	if len(conds) > 0 {
+		return nil, fmt.Errorf("Unterminated #if")
+	}
+	return tokens, nil
+}
+
+//condition evaluates the condition of an #if, #ifdef, #ifndef or #elif.
+//Unknown identifiers are 0.
+func (lib *TypeLib) condition(words []string) bool {
+	isDefined := func(name string) bool {
+		_, exists := lib.defines[name]
+		return exists || lib.functionMacros[name]
+	}
+	switch words[0] {
+	case "ifdef":
+		return len(words) > 1 && isDefined(words[1])
+	case "ifndef":
+		return len(words) > 1 && !isDefined(words[1])
+	}
+	expr := make([]string, 0, len(words))
+	for i := 1; i < len(words); i++ {
+		if words[i] != "defined" {
+			expr = append(expr, lib.expand([]string{words[i]}, make(map[string]bool))...)
+			continue
+		}
+		name := ""
+		if i+1 < len(words) && words[i+1] == "(" && i+3 < len(words) {
+			name = words[i+2]
+			i += 3
+		} else if i+1 < len(words) {
+			name = words[i+1]
+			i++
+		}
+		if isDefined(name) {
+			expr = append(expr, "1")
+		} else {
+			expr = append(expr, "0")
+		}
+	}
+	p := &cParser{lib: lib, tokens: expr, unknownZero: true}
+	v, err := p.constExpr(0)
+	return err == nil && v != 0
+}
+
+func (p *cParser) peek() string {
+	return p.peekAt(0)
+}
+
+func (p *cParser) peekAt(n int) string {
+	if p.pos+n < len(p.tokens) {
+		return p.tokens[p.pos+n]
+	}
+	return ""
+}
+
+func (p *cParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *cParser) errorf(format string, args ...interface{}) error {
+	line := 0
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos]
+	} else if len(p.lines) > 0 {
+		line = p.lines[len(p.lines)-1]
+	}
+	return fmt.Errorf("Line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *cParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		p.pos--
+		return p.errorf("Expected \"%s\", got \"%s\"", tok, got)
+	}
+	return nil
+}
+
+func isIdent(tok string) bool {
+	return tok != "" && isIdentChar(tok[0]) && !unicode.IsDigit(rune(tok[0]))
+}
+
+var cQualifiers = map[string]bool{"const": true, "volatile": true, "register": true, "static": true,
+	"extern": true, "inline": true, "__inline": true, "__inline__": true}
+
+//isTypeName reports whether tok starts a type.
+func (p *cParser) isTypeName(tok string) bool {
+	switch tok {
+	case "void", "char", "short", "int", "long", "float", "double", "unsigned", "signed", "struct", "union", "enum":
+		return true
+	}
+	_, exists := p.lib.Lookup(tok)
+	return exists || cQualifiers[tok]
+}
+
+//tagged returns the struct, union or enum tagged name, declaring it if
+//it's new.
+func (p *cParser) tagged(kind CKind, name string) (*CType, error) {
+	if t, exists := p.lib.Structs[name]; exists {
+		if t.Kind != kind {
+			return nil, p.errorf("%s is not a %s", name, tagKeywords[kind])
+		}
+		return t, nil
+	}
+	t := &CType{Kind: kind, Name: name}
+	p.lib.Structs[name] = t
+	return t, nil
+}
+
+//nameTag names an anonymous struct, union or enum after the first thing
+//declared with it.
+func (p *cParser) nameTag(t *CType, name string) {
+	if t.Name != "" || tagKeywords[t.Kind] == "" {
+		return
+	}
+	if name == "" {
+		p.anon++
+		name = fmt.Sprintf("anon_%d", p.anon)
+	}
+	for p.lib.Structs[name] != nil {
+		name += "_"
+	}
+	t.Name = name
+	p.lib.Structs[name] = t
+}
+
+//typeSpec parses the type a declaration starts with.
+func (p *cParser) typeSpec() (*CType, error) {
+	for cQualifiers[p.peek()] {
+		p.next()
+	}
+	tok := p.next()
+	switch tok {
+	case "void":
+		return &CType{Kind: CVoid}, nil
+	case "char":
+		return BaseCType(TypeChar), nil
+	case "short":
+		if p.peek() == "int" {
+			p.next()
+		}
+		return BaseCType(TypeShort), nil
+	case "int", "long":
+		for p.peek() == "int" || p.peek() == "long" {
+			p.next()
+		}
+		if tok == "long" && p.peek() == "double" {
+			p.next()
+			return BaseCType(TypeFloat), nil
+		}
+		return BaseCType(TypeInt), nil
+	case "float", "double":
+		return BaseCType(TypeFloat), nil
+	case "unsigned", "signed":
+		t := BaseCType(TypeInt)
+		switch p.peek() {
+		case "char", "short", "int", "long":
+			var err error
+			if t, err = p.typeSpec(); err != nil {
+				return nil, err
+			}
+		}
+		t.Unsigned = tok == "unsigned"
+		return t, nil
+	case "struct", "union", "enum":
+		kind := map[string]CKind{"struct": CStruct, "union": CUnion, "enum": CEnum}[tok]
+		var t *CType
+		if isIdent(p.peek()) {
+			var err error
+			if t, err = p.tagged(kind, p.next()); err != nil {
+				return nil, err
+			}
+		} else if p.peek() == "{" {
+			t = &CType{Kind: kind}
+		} else {
+			return nil, p.errorf("Expected %s name, got \"%s\"", tok, p.peek())
+		}
+		if p.peek() != "{" {
+			return t, nil
+		}
+		if kind == CEnum {
+			return t, p.enumBody(t)
+		}
+		return t, p.structBody(t)
+	}
+	if t, exists := p.lib.Lookup(tok); exists {
+		return t, nil
+	}
+	p.pos--
+	return nil, p.errorf("Unknown type \"%s\"", tok)
+}
+
+//declarator parses the pointers, name, array sizes and parameters around
+//a declared name. The name may be missing when only a type is wanted.
+func (p *cParser) declarator(base *CType) (string, *CType, error) {
+	t := base
+	for p.peek() == "*" || cQualifiers[p.peek()] {
+		if p.next() == "*" {
+			t = PointerTo(t)
+		}
+	}
+
+	//A parenthesized declarator applies to the type its suffixes make,
+	//so it is parsed last.
+	nested, nestedEnd := -1, -1
+	name := ""
+	switch {
+	case p.peek() == "(" && (p.peekAt(1) == "*" || p.peekAt(1) == "("):
+		p.next()
+		nested = p.pos
+		for depth := 1; depth > 0; {
+			switch p.next() {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			case "":
+				return "", nil, p.errorf("Unbalanced parentheses")
+			}
+		}
+		nestedEnd = p.pos - 1
+	case isIdent(p.peek()):
+		name = p.next()
+	}
+
+	suffixes := make([]*CType, 0)
+	for p.peek() == "[" || p.peek() == "(" {
+		if p.next() == "[" {
+			n := 0
+			if p.peek() != "]" {
+				v, err := p.constExpr(0)
+				if err != nil {
+					return "", nil, err
+				}
+				if v <= 0 {
+					return "", nil, p.errorf("Array size %d is not positive", v)
+				}
+				n = v
+			}
+			if err := p.expect("]"); err != nil {
+				return "", nil, err
+			}
+			suffixes = append(suffixes, &CType{Kind: CArray, Len: n})
+			continue
+		}
+		fn := &CType{Kind: CFunc}
+		if err := p.params(fn); err != nil {
+			return "", nil, err
+		}
+		suffixes = append(suffixes, fn)
+	}
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		suffixes[i].Elem = t
+		t = suffixes[i]
+	}
+
+	if nested >= 0 {
+		end := p.pos
+		p.pos = nested
+		var err error
+		name, t, err = p.declarator(t)
+		if err != nil {
+			return "", nil, err
+		}
+		if p.pos != nestedEnd {
+			return "", nil, p.errorf("Expected \")\", got \"%s\"", p.peek())
+		}
+		p.pos = end
+	}
+	return name, t, nil
+}
+
+//params parses the parameter list of function type fn.
+func (p *cParser) params(fn *CType) error {
+	if p.peek() == "void" && p.peekAt(1) == ")" {
+		p.next()
+	}
+	for p.peek() != ")" {
+		if p.peek() == "..." {
+			p.next()
+			fn.Variadic = true
+			break
+		}
+		base, err := p.typeSpec()
+		if err != nil {
+			return err
+		}
+		name, t, err := p.declarator(base)
+		if err != nil {
+			return err
+		}
+		//Arrays and functions are passed as pointers.
+		switch t.Kind {
+		case CArray:
+			t = PointerTo(t.Elem)
+		case CFunc:
+			t = PointerTo(t)
+		}
+		fn.Params = append(fn.Params, &CField{name, 0, t, 0})
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	return p.expect(")")
+}
+
+//structBody parses the fields of t between braces and lays them out.
+//Padding fields named pad_ only keep the offsets and are dropped. A
+//definition replaces any earlier one.
+func (p *cParser) structBody(t *CType) error {
+	p.next()
+	p.depth++
+	fields := make([]*CField, 0)
+	for p.peek() != "}" {
+		if p.peek() == "" {
+			return p.errorf("Unterminated %s %s", tagKeywords[t.Kind], t.Name)
+		}
+		base, err := p.typeSpec()
+		if err != nil {
+			return err
+		}
+		for {
+			name, ft, err := p.declarator(base)
+			if err != nil {
+				return err
+			}
+			if name == "" {
+				return p.errorf("Expected field name in %s %s", tagKeywords[t.Kind], t.Name)
+			}
+			if ft.Resolve().Kind == CVoid || ft.Kind == CFunc || ft.Size() == 0 && ft.Resolve().Kind != CArray {
+				return p.errorf("Field %s of %s has incomplete type", name, t.Name)
+			}
+			if t.Name != "" {
+				p.nameTag(base, t.Name+"_"+name)
+			} else {
+				p.nameTag(base, name)
+			}
+			field := &CField{name, 0, ft, 0}
+			if p.peek() == ":" {
+				p.next()
+				bits, err := p.constExpr(0)
+				if err != nil {
+					return err
+				}
+				if r := ft.Resolve(); r.Kind != CBase && r.Kind != CEnum || r.Size() != 4 || bits <= 0 || bits > 32 {
+					return p.errorf("Bad bit field %s of %s", name, t.Name)
+				}
+				field.Bits = bits
+			}
+			fields = append(fields, field)
+			if p.peek() != "," {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(";"); err != nil {
+			return err
+		}
+	}
+	p.next()
+	p.depth--
+	t.Fields = fields
+	t.Layout()
+	kept := make([]*CField, 0, len(fields))
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, "pad_") {
+			kept = append(kept, f)
+		}
+	}
+	t.Fields = kept
+	return nil
+}
+
+//enumBody parses the enumerators of t between braces.
+func (p *cParser) enumBody(t *CType) error {
+	p.next()
+	p.depth++
+	values := make([]*CEnumValue, 0)
+	next := 0
+	for p.peek() != "}" {
+		name := p.next()
+		if !isIdent(name) {
+			p.pos--
+			return p.errorf("Expected enumerator, got \"%s\"", name)
+		}
+		if p.peek() == "=" {
+			p.next()
+			v, err := p.constExpr(0)
+			if err != nil {
+				return err
+			}
+			next = v
+		}
+		values = append(values, &CEnumValue{name, next})
+		p.lib.Consts[name] = next
+		next++
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("}"); err != nil {
+		return err
+	}
+	p.depth--
+	t.Values = values
+	return nil
+}
+
+var constBinaryOps = map[string]int{"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5, "==": 6, "!=": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7, "<<": 8, ">>": 8, "+": 9, "-": 9, "*": 10, "/": 10, "%": 10}
+
+//constExpr evaluates an integer constant expression of operators binding
+//tighter than prec.
+func (p *cParser) constExpr(prec int) (int, error) {
+	v, err := p.unaryExpr()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		opPrec, exists := constBinaryOps[op]
+		if !exists || opPrec <= prec {
+			return v, nil
+		}
+		p.next()
+		w, err := p.constExpr(opPrec)
+		if err != nil {
+			return 0, err
+		}
+		if (op == "/" || op == "%") && w == 0 {
+			return 0, p.errorf("Division by zero")
+		}
+		v = map[string]func() int{
+			"||": func() int { return cBool(v != 0 || w != 0) },
+			"&&": func() int { return cBool(v != 0 && w != 0) },
+			"|":  func() int { return v | w },
+			"^":  func() int { return v ^ w },
+			"&":  func() int { return v & w },
+			"==": func() int { return cBool(v == w) },
+			"!=": func() int { return cBool(v != w) },
+			"<":  func() int { return cBool(v < w) },
+			">":  func() int { return cBool(v > w) },
+			"<=": func() int { return cBool(v <= w) },
+			">=": func() int { return cBool(v >= w) },
+			"<<": func() int { return int(int32(v) << uint(w&31)) },
+			">>": func() int { return int(int32(v) >> uint(w&31)) },
+			"+":  func() int { return v + w },
+			"-":  func() int { return v - w },
+			"*":  func() int { return v * w },
+			"/":  func() int { return v / w },
+			"%":  func() int { return v % w },
+		}[op]()
+	}
+}
+
+func cBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *cParser) unaryExpr() (int, error) {
+	tok := p.next()
+	switch {
+	case tok == "-" || tok == "+" || tok == "~" || tok == "!":
+		v, err := p.unaryExpr()
+		return map[string]int{"-": -v, "+": v, "~": ^v, "!": cBool(v == 0)}[tok], err
+	case tok == "(" && p.isTypeName(p.peek()):
+		//A cast
+		if _, err := p.typeName(); err != nil {
+			return 0, err
+		}
+		if err := p.expect(")"); err != nil {
+			return 0, err
+		}
+		return p.unaryExpr()
+	case tok == "(":
+		v, err := p.constExpr(0)
+		if err != nil {
+			return 0, err
+		}
+		return v, p.expect(")")
+	case tok == "sizeof":
+		paren := p.peek() == "("
+		if paren {
+			p.next()
+		}
+		t, err := p.typeName()
+		if err != nil {
+			return 0, err
+		}
+		if paren {
+			err = p.expect(")")
+		}
+		return t.Size(), err
+	case strings.HasPrefix(tok, "'") && len(tok) >= 3:
+		c, _, _, err := strconv.UnquoteChar(tok[1:len(tok)-1], '\'')
+		if err != nil {
+			return 0, p.errorf("Bad character constant %s", tok)
+		}
+		return int(c), nil
+	case tok != "" && unicode.IsDigit(rune(tok[0])):
+		v, err := strconv.ParseInt(strings.TrimRight(tok, "uUlL"), 0, 64)
+		if err != nil {
+			p.pos--
+			return 0, p.errorf("Bad integer constant %s", tok)
+		}
+		return int(int32(v)), nil
+	case isIdent(tok):
+		if v, exists := p.lib.Consts[tok]; exists {
+			return v, nil
+		}
+		if p.unknownZero {
+			return 0, nil
+		}
+	}
+	p.pos--
+	return 0, p.errorf("Expected a constant, got \"%s\"", tok)
+}
+
+//typeName parses a type without a name.
+func (p *cParser) typeName() (*CType, error) {
+	base, err := p.typeSpec()
+	if err != nil {
+		return nil, err
+	}
+	name, t, err := p.declarator(base)
+	if err == nil && name != "" {
+		err = p.errorf("Unexpected name \"%s\" in type", name)
+	}
+	return t, err
+}
+
+//typedef declares name as another name of t.
+func (p *cParser) typedef(name string, t *CType) {
+	if t.Name == name && tagKeywords[t.Kind] != "" {
+		return
+	}
+	if td, exists := p.lib.Typedefs[name]; exists {
+		td.Elem = t
+		return
+	}
+	p.lib.Typedefs[name] = &CType{Kind: CTypedef, Name: name, Elem: t}
+}
+
+//skip skips a balanced run of tokens until one of the stop tokens outside
+//of the depth brackets it starts in.
+func (p *cParser) skip(depth int, stops ...string) {
+	for tok := p.peek(); tok != ""; tok = p.peek() {
+		if depth <= 0 {
+			for _, stop := range stops {
+				if tok == stop {
+					return
+				}
+			}
+		}
+		switch tok {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		p.next()
+	}
+}
+
+//recover skips the rest of the declaration an error was found in: up to a
+//; outside of the brackets it started in, or past the body of a function
+//definition.
+func (p *cParser) recover() {
+	depth := p.depth
+	for tok := p.peek(); tok != ""; tok = p.peek() {
+		switch {
+		case tok == ";" && depth <= 0:
+			p.next()
+			return
+		case tok == "{" && depth <= 0 && p.pos > 0 && p.tokens[p.pos-1] == ")":
+			p.next()
+			p.skip(0, "}")
+			p.next()
+			return
+		case tok == "(" || tok == "[" || tok == "{":
+			depth++
+		case tok == ")" || tok == "]" || tok == "}":
+			depth--
+		}
+		p.next()
+	}
+}
+
+//declaration parses one top level declaration: types, typedefs,
+//prototypes and function definitions, whose bodies are skipped, and
+//variables.
+func (p *cParser) declaration() error {
+	if p.peek() == ";" {
+		p.next()
+		return nil
+	}
+	typedef := false
+	for p.peek() == "typedef" || cQualifiers[p.peek()] {
+		if p.next() == "typedef" {
+			typedef = true
+		}
+	}
+	base, err := p.typeSpec()
+	if err != nil {
+		return err
+	}
+	if p.peek() == ";" {
+		p.nameTag(base, "")
+		p.next()
+		return nil
+	}
+	for {
+		name, t, err := p.declarator(base)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return p.errorf("Expected a name, got \"%s\"", p.peek())
+		}
+		p.nameTag(base, name)
+		switch {
+		case typedef:
+			p.typedef(name, t)
+		case t.Kind == CFunc:
+			p.lib.Funcs[name] = t
+			if p.peek() == "{" {
+				p.next()
+				p.skip(0, "}")
+				return p.expect("}")
+			}
+		default:
+			p.lib.Vars[name] = t
+		}
+		if p.peek() == "=" {
+			p.skip(0, ",", ";")
+		}
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	return p.expect(";")
+}
+
+//eval evaluates the integer constant expression expr.
+func (lib *TypeLib) eval(expr string) (int, error) {
+	p := &cParser{lib: lib, tokens: lib.expand(cSplit(expr), make(map[string]bool))}
+	v, err := p.constExpr(0)
+	if err == nil && p.peek() != "" {
+		err = fmt.Errorf("Malformed constant \"%s\"", expr)
+	}
+	return v, err
+}
+
+//DefineEnum declares enum name, or redefines it, with the given members.
+//A member is an enumerator NAME or NAME=value, or PREFIX* for every number
+//#defined under a name starting with PREFIX, such as CS_* for the
+//configstrings.
+func (lib *TypeLib) DefineEnum(name string, members []string) (*CType, error) {
+	t, exists := lib.Structs[name]
+	if exists && t.Kind != CEnum {
+		return nil, fmt.Errorf("%s is a %s", name, tagKeywords[t.Kind])
+	}
+	values := make([]*CEnumValue, 0)
+	next := 0
+	for _, member := range members {
+		if strings.HasSuffix(member, "*") {
+			defined := make([]*CEnumValue, 0)
+			for define := range lib.defines {
+				if !strings.HasPrefix(define, member[:len(member)-1]) {
+					continue
+				}
+				if v, err := lib.eval(define); err == nil {
+					defined = append(defined, &CEnumValue{define, v})
+				}
+			}
+			if len(defined) == 0 {
+				return nil, fmt.Errorf("No numbers are #defined as %s", member)
+			}
+			sort.Sort(enumValuesByValue(defined))
+			values = append(values, defined...)
+			continue
+		}
+		parts := strings.SplitN(member, "=", 2)
+		if !isIdent(parts[0]) {
+			return nil, fmt.Errorf("Bad enumerator \"%s\"", member)
+		}
+		if len(parts) == 2 {
+			v, err := lib.eval(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			next = v
+		}
+		values = append(values, &CEnumValue{parts[0], next})
+		next++
+	}
+	if !exists {
+		t = &CType{Kind: CEnum, Name: name}
+		lib.Structs[name] = t
+	}
+	t.Values = values
+	for _, ev := range values {
+		lib.Consts[ev.Name] = ev.Value
+	}
+	return t, nil
+}
+
+type enumValuesByValue []*CEnumValue
+
+func (evs enumValuesByValue) Len() int      { return len(evs) }
+func (evs enumValuesByValue) Swap(i, j int) { evs[i], evs[j] = evs[j], evs[i] }
+func (evs enumValuesByValue) Less(i, j int) bool {
+	if evs[i].Value != evs[j].Value {
+		return evs[i].Value < evs[j].Value
+	}
+	return evs[i].Name < evs[j].Name
+}
+
+//newParser tokenizes src for a parser adding to lib.
+func (lib *TypeLib) newParser(src string) (*cParser, error) {
+	tokens, err := lib.preprocess(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &cParser{lib: lib}
+	for _, tok := range tokens {
+		p.tokens = append(p.tokens, tok.text)
+		p.lines = append(p.lines, tok.line)
+	}
+	return p, nil
+}
+
+//Parse adds the types, prototypes and variables declared in the C source
+//src to lib. Declarations it can't parse are skipped and returned as
+//errors.
+func (lib *TypeLib) Parse(src string) []error {
+	p, err := lib.newParser(src)
+	if err != nil {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	for p.peek() != "" {
+		start := p.pos
+		if err := p.declaration(); err != nil {
+			errs = append(errs, err)
+			p.recover()
+			p.depth = 0
+			if p.pos <= start {
+				p.pos = start + 1
+			}
+		}
+	}
+	return errs
+}
+
+//ParseType parses a C type name such as "gentity_t *" using the types in
+//lib.
+func (lib *TypeLib) ParseType(src string) (*CType, error) {
+	name, t, err := lib.ParseDecl(src)
+	if err == nil && name != "" {
+		err = fmt.Errorf("Malformed type \"%s\"", src)
+	}
+	return t, err
+}
+
+//ParseDecl parses the declaration of one name, such as the prototype
+//"void G_Damage(gentity_t *targ, int damage)", using the types in lib.
+func (lib *TypeLib) ParseDecl(src string) (string, *CType, error) {
+	p, err := lib.newParser(src)
+	if err != nil {
+		return "", nil, err
+	}
+	base, err := p.typeSpec()
+	if err != nil {
+		return "", nil, err
+	}
+	name, t, err := p.declarator(base)
+	if err != nil {
+		return "", nil, err
+	}
+	if p.peek() == ";" {
+		p.next()
+	}
+	if p.peek() != "" {
+		return "", nil, fmt.Errorf("Malformed declaration \"%s\"", src)
+	}
+	return name, t, nil
+}
@@ -0,0 +1,448 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//CKind is the kind of a C type.
+type CKind int
+
+const (
+	CVoid CKind = iota
+	CBase
+	CPointer
+	CArray
+	CStruct
+	CUnion
+	CEnum
+	CTypedef
+	CFunc
+)
+
+//CType is a C type applied to a variable. Structs, unions, enums and
+//typedefs are shared by pointer, so renaming one renames it everywhere it
+//is used.
+type CType struct {
+	Kind     CKind
+	Name     string        //tag of a struct, union or enum, name of a typedef
+	Base     Type          //of CBase
+	Unsigned bool          //of CBase
+	Elem     *CType        //what a pointer points to, an array's element, a typedef's type, a function's return type
+	Len      int           //of an array
+	Fields   []*CField     //of a struct or union, by offset
+	Values   []*CEnumValue //of an enum
+	Params   []*CField     //of a function, Offset unused
+	Variadic bool          //of a function
+	size     int           //of a struct or union
+}
+
+//CField is a member of a struct at Offset bytes from its start. Bit
+//fields share the int at Offset with their neighbours.
+type CField struct {
+	Name   string
+	Offset int
+	Type   *CType
+	Bits   int //width of a bit field, else 0
+}
+
+//CEnumValue is an enumerator.
+type CEnumValue struct {
+	Name  string
+	Value int
+}
+
+var baseSizes = map[Type]int{TypeInt: 4, TypePointer: 4, TypeFloat: 4, TypeShort: 2, TypeChar: 1}
+
+//BaseCType returns the C type of t.
+func BaseCType(t Type) *CType {
+	if t == TypePointer {
+		return PointerTo(&CType{Kind: CVoid})
+	}
+	if t == TypeUnknown {
+		t = TypeInt
+	}
+	return &CType{Kind: CBase, Base: t}
+}
+
+//PointerTo returns a pointer to t.
+func PointerTo(t *CType) *CType {
+	return &CType{Kind: CPointer, Elem: t}
+}
+
+//Resolve returns the type a typedef stands for, or t itself.
+func (t *CType) Resolve() *CType {
+	for t != nil && t.Kind == CTypedef {
+		t = t.Elem
+	}
+	return t
+}
+
+//Size is the size of t in bytes.
+func (t *CType) Size() int {
+	switch t.Kind {
+	case CBase:
+		return baseSizes[t.Base]
+	case CPointer, CEnum:
+		return 4
+	case CArray:
+		return t.Len * t.Elem.Size()
+	case CStruct, CUnion:
+		return t.size
+	case CTypedef:
+		return t.Elem.Size()
+	}
+	return 0
+}
+
+//Align is the alignment LCC gives t.
+func (t *CType) Align() int {
+	switch t.Kind {
+	case CArray, CTypedef:
+		return t.Elem.Align()
+	case CStruct, CUnion:
+		align := 1
+		for _, f := range t.Fields {
+			if a := f.Type.Align(); a > align {
+				align = a
+			}
+		}
+		return align
+	}
+	if size := t.Size(); size > 0 {
+		return size
+	}
+	return 1
+}
+
+//Decl declares name with type t in C. An empty name gives the type name.
+func (t *CType) Decl(name string) string {
+	switch t.Kind {
+	case CVoid:
+		return cDecl("void", name)
+	case CBase:
+		if t.Unsigned {
+			return cDecl("unsigned "+t.Base.String(), name)
+		}
+		return cDecl(t.Base.String(), name)
+	case CStruct, CUnion, CEnum, CTypedef:
+		return cDecl(t.Name, name)
+	case CPointer:
+		if t.Elem.Kind == CArray || t.Elem.Kind == CFunc {
+			return t.Elem.Decl("(*" + name + ")")
+		}
+		return t.Elem.Decl("*" + name)
+	case CArray:
+		if t.Len == 0 {
+			return t.Elem.Decl(name + "[]")
+		}
+		return t.Elem.Decl(fmt.Sprintf("%s[%d]", name, t.Len))
+	case CFunc:
+		params := make([]string, 0, len(t.Params)+1)
+		for _, p := range t.Params {
+			params = append(params, p.Type.Decl(p.Name))
+		}
+		if t.Variadic {
+			params = append(params, "...")
+		}
+		if len(params) == 0 {
+			params = append(params, "void")
+		}
+		return t.Elem.Decl(fmt.Sprintf("%s(%s)", name, strings.Join(params, ", ")))
+	}
+	return cDecl("int", name)
+}
+
+func (t *CType) String() string {
+	return strings.TrimSpace(t.Decl(""))
+}
+
+//IsStructPointer reports whether t points to a struct or union.
+func (t *CType) IsStructPointer() bool {
+	t = t.Resolve()
+	if t == nil || t.Kind != CPointer {
+		return false
+	}
+	elem := t.Elem.Resolve()
+	return elem.Kind == CStruct || elem.Kind == CUnion
+}
+
+//Field returns the field of struct t that starts at off, or nil.
+func (t *CType) Field(off int) *CField {
+	for _, f := range t.Resolve().Fields {
+		if f.Offset == off {
+			return f
+		}
+	}
+	return nil
+}
+
+//FieldPath names the member of t at off that is width bytes wide, going
+//into nested structs, unions and arrays, e.g. ".ps.stats[3]". A width of 0
+//names the outermost member starting at off. It returns false if no member
+//fits.
+func (t *CType) FieldPath(off, width int) (string, *CType, bool) {
+	r := t.Resolve()
+	aggregate := r.Kind == CStruct || r.Kind == CUnion || r.Kind == CArray
+	switch {
+	case off == 0 && (width == 0 || !aggregate && r.Size() == width):
+		return "", t, true
+	case r.Kind == CStruct || r.Kind == CUnion:
+		for _, f := range r.Fields {
+			if off >= f.Offset && off < f.Offset+f.Type.Size() {
+				if path, ft, ok := f.Type.FieldPath(off-f.Offset, width); ok {
+					return "." + f.Name + path, ft, true
+				}
+			}
+		}
+	case r.Kind == CArray && r.Elem.Size() > 0:
+		n := off / r.Elem.Size()
+		if path, et, ok := r.Elem.FieldPath(off%r.Elem.Size(), width); ok && n < r.Len {
+			return fmt.Sprintf("[%d]%s", n, path), et, true
+		}
+	}
+	return "", nil, false
+}
+
+//Layout places fields one after another with LCC's alignment, or all at 0
+//in a union, and sets the size of t. Consecutive bit fields are packed into
+//ints.
+func (t *CType) Layout() {
+	off, end, bit := 0, 0, 0
+	for _, f := range t.Fields {
+		align := f.Type.Align()
+		if t.Kind == CUnion {
+			off, bit = 0, 0
+		}
+		if f.Bits > 0 && bit > 0 && bit+f.Bits <= 32 {
+			f.Offset = off - 4
+			bit += f.Bits
+			continue
+		}
+		bit = f.Bits
+		off = (off + align - 1) / align * align
+		f.Offset = off
+		off += f.Type.Size()
+		if off > end {
+			end = off
+		}
+	}
+	align := t.Align()
+	t.size = (end + align - 1) / align * align
+}
+
+//EnumName names the value v of enum t, or returns false.
+func (t *CType) EnumName(v int) (string, bool) {
+	t = t.Resolve()
+	if t == nil || t.Kind != CEnum {
+		return "", false
+	}
+	for _, ev := range t.Values {
+		if ev.Value == v {
+			return ev.Name, true
+		}
+	}
+	return "", false
+}
+
+//TypeLib holds the C types and declarations known by name.
+type TypeLib struct {
+	Structs  map[string]*CType //structs, unions and enums by tag
+	Typedefs map[string]*CType
+	Consts   map[string]int    //enumerators and #defined numbers
+	Funcs    map[string]*CType //prototypes
+	Vars     map[string]*CType //declared variables
+
+	defines        map[string]string //object-like macros
+	functionMacros map[string]bool
+}
+
+//NewTypeLib returns an empty library that parses headers the way they are
+//compiled for the QVM, with Q3_VM defined.
+func NewTypeLib() *TypeLib {
+	return &TypeLib{make(map[string]*CType), make(map[string]*CType), make(map[string]int),
+		make(map[string]*CType), make(map[string]*CType), map[string]string{"Q3_VM": "1"}, make(map[string]bool)}
+}
+
+//Sorted returns the structs, unions and enums ordered by tag.
+func (lib *TypeLib) Sorted() []*CType {
+	return sortedTypes(lib.Structs)
+}
+
+func sortedTypes(types map[string]*CType) []*CType {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := make([]*CType, len(names))
+	for i, name := range names {
+		sorted[i] = types[name]
+	}
+	return sorted
+}
+
+//Lookup returns the struct, union, enum or typedef called name.
+func (lib *TypeLib) Lookup(name string) (*CType, bool) {
+	if t, exists := lib.Typedefs[name]; exists {
+		return t, true
+	}
+	t, exists := lib.Structs[name]
+	return t, exists
+}
+
+//Rename renames struct, union, enum or typedef old to new.
+func (lib *TypeLib) Rename(old, new string) error {
+	t, exists := lib.Lookup(old)
+	if !exists {
+		return fmt.Errorf("No type named \"%s\"", old)
+	}
+	if _, exists := lib.Lookup(new); exists {
+		return fmt.Errorf("A type named \"%s\" already exists", new)
+	}
+	if t.Kind == CTypedef {
+		delete(lib.Typedefs, old)
+		lib.Typedefs[new] = t
+	} else {
+		delete(lib.Structs, old)
+		lib.Structs[new] = t
+	}
+	t.Name = new
+	return nil
+}
+
+//String prints the library as C. Tags are typedef'd to themselves so
+//pointers can refer to any struct or union, and types are defined after the ones
+//they contain. The gaps between fields are filled with padding so offsets
+//survive a round trip.
+func (lib *TypeLib) String() string {
+	buf := new(bytes.Buffer)
+	tags := lib.Sorted()
+	for _, t := range tags {
+		if _, exists := lib.Typedefs[t.Name]; !exists && t.Kind != CEnum {
+			fmt.Fprintf(buf, "typedef %s %s %s;\n", tagKeywords[t.Kind], t.Name, t.Name)
+		}
+	}
+
+	visited := make(map[*CType]bool)
+	var visit func(t *CType)
+	//uses visits the types t needs to be declared. Pointers only need
+	//a struct declared, which they are at the top.
+	var uses func(t *CType, pointer bool)
+	uses = func(t *CType, pointer bool) {
+		switch t.Kind {
+		case CPointer:
+			uses(t.Elem, true)
+		case CArray:
+			uses(t.Elem, pointer)
+		case CFunc:
+			uses(t.Elem, true)
+			for _, p := range t.Params {
+				uses(p.Type, true)
+			}
+		case CStruct, CUnion:
+			if !pointer {
+				visit(t)
+			}
+		case CEnum, CTypedef:
+			visit(t)
+		}
+	}
+	visit = func(t *CType) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		switch t.Kind {
+		case CTypedef:
+			uses(t.Elem, false)
+			fmt.Fprintf(buf, "\ntypedef %s;\n", t.Elem.Decl(t.Name))
+		case CEnum:
+			fmt.Fprintf(buf, "\nenum %s {\n", t.Name)
+			for _, ev := range t.Values {
+				fmt.Fprintf(buf, "\t%s = %d,\n", ev.Name, ev.Value)
+			}
+			buf.WriteString("};\n")
+			if _, exists := lib.Typedefs[t.Name]; !exists {
+				fmt.Fprintf(buf, "typedef enum %s %s;\n", t.Name, t.Name)
+			}
+		case CStruct, CUnion:
+			if len(t.Fields) == 0 {
+				//Only declared
+				return
+			}
+			for _, f := range t.Fields {
+				uses(f.Type, false)
+			}
+			fmt.Fprintf(buf, "\n%s %s {\n", tagKeywords[t.Kind], t.Name)
+			off := 0
+			for n, f := range t.Fields {
+				//Bit fields packed into the int of the one before need no
+				//padding.
+				shared := n > 0 && f.Bits > 0 && t.Fields[n-1].Bits > 0 && f.Offset == t.Fields[n-1].Offset
+				align := f.Type.Align()
+				if aligned := (off + align - 1) / align * align; t.Kind == CStruct && !shared && aligned != f.Offset && f.Offset > off {
+					fmt.Fprintf(buf, "\tchar pad_%x[%d];\n", off, f.Offset-off)
+				}
+				if f.Bits > 0 {
+					fmt.Fprintf(buf, "\t%s : %d; //0x%x\n", f.Type.Decl(f.Name), f.Bits, f.Offset)
+				} else {
+					fmt.Fprintf(buf, "\t%s; //0x%x\n", f.Type.Decl(f.Name), f.Offset)
+				}
+				if end := f.Offset + f.Type.Size(); end > off {
+					off = end
+				}
+			}
+			if off < t.size && t.Kind == CStruct {
+				fmt.Fprintf(buf, "\tchar pad_%x[%d];\n", off, t.size-off)
+			}
+			buf.WriteString("};\n")
+		}
+	}
+	for _, t := range tags {
+		visit(t)
+	}
+	for _, t := range sortedTypes(lib.Typedefs) {
+		visit(t)
+	}
+
+	for _, decls := range []map[string]*CType{lib.Vars, lib.Funcs} {
+		names := make([]string, 0, len(decls))
+		for name := range decls {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			buf.WriteString("\n")
+		}
+		for _, name := range names {
+			uses(decls[name], true)
+			if decls[name].Kind == CFunc {
+				fmt.Fprintf(buf, "%s;\n", decls[name].Decl(name))
+			} else {
+				fmt.Fprintf(buf, "extern %s;\n", decls[name].Decl(name))
+			}
+		}
+	}
+	return buf.String()
+}
+
+var tagKeywords = map[CKind]string{CStruct: "struct", CUnion: "union", CEnum: "enum"}
@@ -0,0 +1,89 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"testing"
+)
+
+//TestTypeLibRoundTrip checks a header printed by String parses back to
+//the same library, as when the types are saved in a .dar and reopened.
+func TestTypeLibRoundTrip(t *testing.T) {
+	const header = `
+typedef unsigned char byte;
+
+typedef struct gentity_s {
+	int inuse:1;
+	int team:4;
+	int health;
+	byte name[3];
+	unsigned int flags:30;
+	int more:4;
+	unsigned short s;
+	struct gentity_s *enemy;
+} gentity_t;
+
+typedef union {
+	int i;
+	float f;
+} number_t;
+
+int G_Damage(gentity_t *targ, int damage);
+extern gentity_t g_entities[64];
+`
+	lib := NewTypeLib()
+	if errs := lib.Parse(header); len(errs) > 0 {
+		t.Fatalf("Parsing the header: %v", errs)
+	}
+	printed := lib.String()
+
+	again := NewTypeLib()
+	if errs := again.Parse(printed); len(errs) > 0 {
+		t.Fatalf("Parsing the printed header: %v\n%s", errs, printed)
+	}
+	if reprinted := again.String(); reprinted != printed {
+		t.Fatalf("Round trip changed the library from\n%s\nto\n%s", printed, reprinted)
+	}
+
+	ent, exists := again.Lookup("gentity_t")
+	if !exists {
+		t.Fatalf("gentity_t is missing from\n%s", printed)
+	}
+	if b, exists := again.Lookup("byte"); !exists || !b.Resolve().Unsigned {
+		t.Errorf("byte lost its unsigned in\n%s", printed)
+	}
+	unsigned := map[string]bool{"flags": true, "s": true}
+	offsets := map[string]int{"inuse": 0, "team": 0, "health": 4, "name": 8, "flags": 12, "more": 16, "s": 20, "enemy": 24}
+	for _, f := range ent.Resolve().Fields {
+		if off, exists := offsets[f.Name]; !exists || off != f.Offset {
+			t.Errorf("Field %s at 0x%x, want 0x%x", f.Name, f.Offset, off)
+		}
+		if f.Type.Resolve().Unsigned != unsigned[f.Name] {
+			t.Errorf("Field %s is %s", f.Name, f.Type.Decl(""))
+		}
+		delete(offsets, f.Name)
+	}
+	for name := range offsets {
+		t.Errorf("Field %s is missing", name)
+	}
+	if size := ent.Size(); size != 28 {
+		t.Errorf("gentity_t is %d bytes, want 28", size)
+	}
+	if _, exists := again.Vars["health"]; exists {
+		t.Errorf("Fields were declared as variables")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"qvm"
 	"qvmd"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -46,6 +47,7 @@ type File struct {
 	QvmFile      *qvm.File
 	CommentsFile *CommentsFile
 	SyscallsFile *SyscallsFile
+	TypesFile    *TypesFile //nil in archives made before there were types
 }
 
 type CommentsFile struct {
@@ -85,7 +87,7 @@ L:
 			if err != nil {
 				return nil, err
 			}
-			_, _, err = f.CommentsFile.Parse()
+			_, err = f.CommentsFile.Parse()
 			if err != nil {
 				return nil, fmt.Errorf("Malformed comments file: %s", err)
 			}
@@ -100,6 +102,11 @@ L:
 				return nil, fmt.Errorf("Malformed syscalls file: %s", err)
 			}
 			gotSyscalls = true
+		case strings.HasSuffix(hdr.Name, ".h"):
+			f.TypesFile, err = NewTypesFile(rdr)
+			if err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("Malformed dar: Extra file %s in archive.", hdr.Name)
 		}
@@ -119,6 +126,7 @@ func (f *File) WriteTo(w io.Writer) error {
 		hdr.Size += 4
 	}
 	hdr.Size += int64(f.QvmFile.Header.CodeLength + f.QvmFile.Header.DataLength + f.QvmFile.Header.LitLength)
+	hdr.Size += int64(len(f.QvmFile.JumpTable))
 	if err := tw.WriteHeader(hdr); err != nil {
 		return err
 	}
@@ -142,6 +150,9 @@ func (f *File) WriteTo(w io.Writer) error {
 	if _, err := tw.Write(f.QvmFile.Lit); err != nil {
 		return err
 	}
+	if _, err := tw.Write(f.QvmFile.JumpTable); err != nil {
+		return err
+	}
 
 	hdr.Name = "comments.csv"
 	hdr.Size = int64(len(f.CommentsFile.Data))
@@ -160,6 +171,17 @@ func (f *File) WriteTo(w io.Writer) error {
 	if _, err := tw.Write(f.SyscallsFile.Data); err != nil {
 		return err
 	}
+
+	if f.TypesFile != nil {
+		hdr.Name = "types.h"
+		hdr.Size = int64(len(f.TypesFile.Data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.TypesFile.Data); err != nil {
+			return err
+		}
+	}
 	if err := tw.Flush(); err != nil {
 		return err
 	}
@@ -173,7 +195,7 @@ func NewCommentsFile(r io.Reader) (*CommentsFile, error) {
 		return nil, err
 	}
 	cf := &CommentsFile{data}
-	_, _, err = cf.Parse()
+	_, err = cf.Parse()
 
 	if err != nil {
 		return nil, err
@@ -181,13 +203,50 @@ func NewCommentsFile(r io.Reader) (*CommentsFile, error) {
 	return cf, nil
 }
 
-func (cf *CommentsFile) Parse() (map[int]string, map[int]string, error) {
+//Annotations are what the user added to the disassembly: comments, names,
+//and the C types applied to variables, which name types of the TypesFile.
+type Annotations struct {
+	Comments    map[int]string
+	Renames     map[int]string //procedure names by start instruction
+	Globals     map[uint32]string
+	Locals      map[int]map[int]string //by procedure start, then frame offset
+	GlobalTypes map[uint32]string
+	LocalTypes  map[int]map[int]string
+	ProcTypes   map[int]string         //prototypes by procedure start
+	EnumConsts  map[int]string         //enums shown for CONST instructions
+	EnumArgs    map[int]map[int]string //by call target, then argument
+	Module      string                 //cgame, qagame or ui
+	Engine      string                 //q3 or quake3e
+}
+
+func NewAnnotations() *Annotations {
+	return &Annotations{make(map[int]string, 0), make(map[int]string, 0), make(map[uint32]string, 0),
+		make(map[int]map[int]string, 0), make(map[uint32]string, 0), make(map[int]map[int]string, 0), make(map[int]string, 0),
+		make(map[int]string, 0), make(map[int]map[int]string, 0), "", ""}
+}
+
+func (cf *CommentsFile) Parse() (*Annotations, error) {
 	lines := strings.SplitN(string(cf.Data), string([]byte{'\n'}), -1)
-	comments, renames := make(map[int]string, 0), make(map[int]string, 0)
+	ann := NewAnnotations()
+	//setLocal parses the procedure and offset of a local's line.
+	setLocal := func(m map[int]map[int]string, parts []string) {
+		procKey, err := strconv.ParseUint(parts[1], 0, 64)
+		if err != nil {
+			return
+		}
+		off, err := strconv.ParseUint(parts[2], 0, 64)
+		if err != nil {
+			return
+		}
+		if m[int(procKey)] == nil {
+			m[int(procKey)] = make(map[int]string)
+		}
+		m[int(procKey)][int(off)] = strings.Join(parts[3:], ",")
+	}
 	for _, line := range lines {
 		parts := strings.SplitN(line, ",", -1)
 		switch parts[0] {
-		case "name":
+		case "name", "ftype":
 			if len(parts) < 3 {
 				continue
 			}
@@ -195,7 +254,66 @@ func (cf *CommentsFile) Parse() (map[int]string, map[int]string, error) {
 			if err != nil {
 				continue
 			}
-			renames[int(procKey)] = parts[2]
+			if parts[0] == "name" {
+				ann.Renames[int(procKey)] = parts[2]
+			} else {
+				ann.ProcTypes[int(procKey)] = strings.Join(parts[2:], ",")
+			}
+		case "global", "gtype":
+			if len(parts) < 3 {
+				continue
+			}
+			addr, err := strconv.ParseUint(parts[1], 0, 32)
+			if err != nil {
+				continue
+			}
+			if parts[0] == "global" {
+				ann.Globals[uint32(addr)] = parts[2]
+			} else {
+				ann.GlobalTypes[uint32(addr)] = strings.Join(parts[2:], ",")
+			}
+		case "local":
+			if len(parts) >= 4 {
+				setLocal(ann.Locals, parts)
+			}
+		case "ltype":
+			if len(parts) >= 4 {
+				setLocal(ann.LocalTypes, parts)
+			}
+		case "enum":
+			if len(parts) < 3 {
+				continue
+			}
+			num, err := strconv.ParseUint(parts[1], 0, 64)
+			if err != nil {
+				continue
+			}
+			ann.EnumConsts[int(num)] = parts[2]
+		case "enumarg":
+			if len(parts) < 4 {
+				continue
+			}
+			//Syscalls are negative targets.
+			target, err := strconv.ParseInt(parts[1], 0, 64)
+			if err != nil {
+				continue
+			}
+			n, err := strconv.ParseUint(parts[2], 0, 64)
+			if err != nil {
+				continue
+			}
+			if ann.EnumArgs[int(target)] == nil {
+				ann.EnumArgs[int(target)] = make(map[int]string)
+			}
+			ann.EnumArgs[int(target)][int(n)] = parts[3]
+		case "module":
+			if len(parts) >= 2 {
+				ann.Module = parts[1]
+			}
+		case "engine":
+			if len(parts) >= 2 {
+				ann.Engine = parts[1]
+			}
 		case "comment":
 			if len(parts) < 3 {
 				continue
@@ -204,23 +322,70 @@ func (cf *CommentsFile) Parse() (map[int]string, map[int]string, error) {
 			if err != nil {
 				continue
 			}
-			comments[int(num)] = strings.Join(parts[2:], ",")
+			ann.Comments[int(num)] = strings.Join(parts[2:], ",")
 		}
 	}
-	return comments, renames, nil
+	return ann, nil
 }
 
-func (cf *CommentsFile) Write(comments, renames map[int]string) error {
+func (cf *CommentsFile) Write(ann *Annotations) error {
 	cf.Data = make([]byte, 0)
-	for num, comment := range comments {
+	if ann.Module != "" {
+		cf.Data = append(cf.Data, []byte(fmt.Sprintf("module,%s\n", ann.Module))...)
+	}
+	if ann.Engine != "" {
+		cf.Data = append(cf.Data, []byte(fmt.Sprintf("engine,%s\n", ann.Engine))...)
+	}
+	for num, comment := range ann.Comments {
 		cf.Data = append(cf.Data, []byte(fmt.Sprintf("comment,%d,%s\n", num, comment))...)
 	}
-	for num, name := range renames {
+	for num, name := range ann.Renames {
 		cf.Data = append(cf.Data, []byte(fmt.Sprintf("name,%d,%s\n", num, name))...)
 	}
+	for addr, name := range ann.Globals {
+		cf.Data = append(cf.Data, []byte(fmt.Sprintf("global,%d,%s\n", addr, name))...)
+	}
+	for num, names := range ann.Locals {
+		for off, name := range names {
+			cf.Data = append(cf.Data, []byte(fmt.Sprintf("local,%d,%d,%s\n", num, off, name))...)
+		}
+	}
+	for addr, typ := range ann.GlobalTypes {
+		cf.Data = append(cf.Data, []byte(fmt.Sprintf("gtype,%d,%s\n", addr, typ))...)
+	}
+	for num, types := range ann.LocalTypes {
+		for off, typ := range types {
+			cf.Data = append(cf.Data, []byte(fmt.Sprintf("ltype,%d,%d,%s\n", num, off, typ))...)
+		}
+	}
+	for num, typ := range ann.ProcTypes {
+		cf.Data = append(cf.Data, []byte(fmt.Sprintf("ftype,%d,%s\n", num, typ))...)
+	}
+	for num, name := range ann.EnumConsts {
+		cf.Data = append(cf.Data, []byte(fmt.Sprintf("enum,%d,%s\n", num, name))...)
+	}
+	for target, enums := range ann.EnumArgs {
+		for n, name := range enums {
+			cf.Data = append(cf.Data, []byte(fmt.Sprintf("enumarg,%d,%d,%s\n", target, n, name))...)
+		}
+	}
 	return nil
 }
 
+//TypesFile holds the C declarations of the structs used by the
+//annotations.
+type TypesFile struct {
+	Data []byte
+}
+
+func NewTypesFile(r io.Reader) (*TypesFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &TypesFile{data}, nil
+}
+
 func NewSyscallsFile(r io.Reader) (*SyscallsFile, error) {
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -244,15 +409,43 @@ func (sf *SyscallsFile) Parse() (map[int]qvmd.Syscall, error) {
 		if n, err := fmt.Sscanf(line, "equ %s %d", &name, &val); err != nil || n != 2 {
 			continue
 		}
-		syscalls[val] = qvmd.Syscall{name, 0}
+		//The argument count is kept in a comment q3asm ignores.
+		argc := -1
+		if i := strings.Index(line, ";"); i >= 0 {
+			fmt.Sscanf(strings.TrimSpace(line[i+1:]), "argc %d", &argc)
+		}
+		syscalls[val] = qvmd.Syscall{Name: name, Argc: argc}
 	}
 	return syscalls, nil
 }
 
+//ParseC reads the syscalls the file defines as C: the import enums of the
+//engine headers, such as cg_public.h, number them and the wrappers of
+//cg_syscalls.c or g_syscalls.c name and type them. The declarations are
+//added to lib, and the ones it can't parse are returned as errors.
+func (sf *SyscallsFile) ParseC(lib *qvmd.TypeLib) (map[int]qvmd.Syscall, []error) {
+	return lib.ImportSyscalls(string(sf.Data))
+}
+
+//Write replaces the file with syscalls as the q3asm equs Parse reads,
+//from -1 down.
 func (sf *SyscallsFile) Write(syscalls map[int]qvmd.Syscall) error {
-	sf.Data = make([]byte, 0)
+	nums := make([]int, 0, len(syscalls))
 	for num, sc := range syscalls {
-		sf.Data = append(sf.Data, []byte(fmt.Sprintf("asm %s %d\n", num, sc.Name))...)
+		if sc.Name == "" || strings.ContainsAny(sc.Name, " \t\r\n;") {
+			return fmt.Errorf("Bad name \"%s\" for syscall %d", sc.Name, num)
+		}
+		nums = append(nums, num)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+	data := make([]byte, 0)
+	for _, num := range nums {
+		line := fmt.Sprintf("equ %s %d", syscalls[num].Name, num)
+		if syscalls[num].Argc >= 0 {
+			line += fmt.Sprintf(" ; argc %d", syscalls[num].Argc)
+		}
+		data = append(data, []byte(line+"\n")...)
 	}
+	sf.Data = data
 	return nil
 }
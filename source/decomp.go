@@ -0,0 +1,1147 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//Expression kinds that don't correspond to an opcode.
+const (
+	exprTemp  = -1 - iota //Value is the op stack slot the temp stands for
+	exprVoid              //What PUSH leaves for a void return
+	exprAnd               //Args[0] && Args[1], made from nested ifs
+	exprFloat             //CONST whose Value is the bits of a float
+	exprEnum              //CONST named by an enumerator, Value is its instruction
+	exprStr               //CONST of the address of a string
+)
+
+//dExpr is an expression tree node. Op is the opcode that produced it. For
+//CALL, Args[0] is the call target and the arguments follow. Loads and the
+//left hand side of assignments use the LOADn opcodes with the address in
+//Args[0].
+type dExpr struct {
+	Op    int
+	Value int32
+	Args  []*dExpr
+}
+
+const (
+	stmtExpr = iota
+	stmtAssign
+	stmtReturn
+	stmtIf
+	stmtWhile
+	stmtDoWhile
+	stmtFor
+	stmtSwitch
+	stmtBreak
+	stmtContinue
+	stmtGoto
+	stmtLabel
+)
+
+type dStmt struct {
+	kind       int
+	expr       *dExpr //expression, condition, switch value or return value
+	lhs        *dExpr
+	body, els  []*dStmt
+	init, incr *dStmt
+	cases      []dCase
+	label      int
+	backEdges  int //of a while loop; only single back edge loops become for
+}
+
+type dCase struct {
+	values []int32 //empty when the value could not be recovered
+	target int
+	def    bool
+	body   []*dStmt
+}
+
+//loopCtx tells the structurer where break and continue go. loop is nil in
+//a switch outside of any loop.
+type loopCtx struct {
+	loop        *Loop
+	breakTarget *BasicBlock //follow of the innermost loop or switch
+	latch       *BasicBlock //do-while latch whose branch ends the body
+	latchCond   *dExpr      //true when the latch branches back
+}
+
+type decompiler struct {
+	ctx      *Context
+	proc     *Procedure
+	cfg      *CFG
+	pdom     *DomTree
+	stack    *StackInfo
+	loops    map[*BasicBlock]*Loop
+	emitted  map[*BasicBlock]bool
+	gotos    map[int]bool
+	locals   map[int32]bool
+	maxTemp  int
+	blocks   map[*BasicBlock]decompBlock
+	caseVals map[int]map[int][]int32 //JUMP insn -> target -> values
+	defaults map[int]int             //JUMP insn -> default target
+	checks   map[int]bool            //bounds checks of decoded switches
+	loopPdom map[*Loop][]*BasicBlock
+	enums    map[int]string //CONST insn -> enumerator
+	strs     map[int]bool   //CONST insns printed as string literals
+}
+
+//decompBlock holds the statements of a block and the expression its last
+//instruction consumes: the condition of a branch, the target of a computed
+//JUMP, or the value returned by LEAVE.
+type decompBlock struct {
+	stmts []*dStmt
+	term  *dExpr
+}
+
+//Decompile prints proc as C-like pseudocode. Expressions are rebuilt from
+//the op stack, and if/else, while, do-while, for and switch statements are
+//recovered from the CFG. Control flow that doesn't fit those shapes falls
+//back to goto.
+func (ctx *Context) Decompile(proc *Procedure) string {
+	d := &decompiler{
+		ctx:      ctx,
+		proc:     proc,
+		cfg:      ctx.CFG(proc),
+		pdom:     ctx.PostDominators(proc),
+		stack:    ctx.AnalyzeStack(proc),
+		loops:    make(map[*BasicBlock]*Loop),
+		emitted:  make(map[*BasicBlock]bool),
+		gotos:    make(map[int]bool),
+		locals:   make(map[int32]bool),
+		maxTemp:  -1,
+		blocks:   make(map[*BasicBlock]decompBlock),
+		caseVals: make(map[int]map[int][]int32),
+		defaults: make(map[int]int),
+		checks:   make(map[int]bool),
+		loopPdom: make(map[*Loop][]*BasicBlock),
+		enums:    ctx.EnumRefs(proc),
+		strs:     ctx.stringConsts(proc),
+	}
+	for _, loop := range ctx.Loops(proc) {
+		if _, exists := d.loops[loop.Header]; !exists {
+			d.loops[loop.Header] = loop
+		}
+	}
+	for _, b := range d.cfg.Blocks {
+		d.blocks[b] = d.translateBlock(b)
+	}
+
+	body, _ := d.structure(d.cfg.Blocks[0], nil, nil, false)
+	//Whatever the structurer didn't reach is only entered through goto.
+	for _, b := range d.cfg.Blocks {
+		if d.emitted[b] {
+			continue
+		}
+		if _, reachable := d.stack.DepthAt(b.Start); !reachable {
+			continue
+		}
+		d.gotos[b.Start] = true
+		rest, _ := d.structure(b, nil, nil, false)
+		body = append(body, rest...)
+	}
+	body = d.simplify(body, false)
+	if n := len(body); n > 0 && body[n-1].kind == stmtReturn && body[n-1].expr.Op == exprVoid {
+		body = body[:n-1]
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s\n{\n", ctx.Signature(proc))
+	offsets := make([]int, 0, len(d.locals))
+	for off := range d.locals {
+		offsets = append(offsets, int(off))
+	}
+	sort.Ints(offsets)
+	for _, off := range offsets {
+		fmt.Fprintf(buf, "\t%s;\n", ctx.LocalDecl(proc, off))
+	}
+	for i := 0; i <= d.maxTemp; i++ {
+		fmt.Fprintf(buf, "\tint stk_%d;\n", i)
+	}
+	if len(offsets) > 0 || d.maxTemp >= 0 {
+		buf.WriteString("\n")
+	}
+	d.printStmts(buf, body, 1)
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+func (d *decompiler) temp(slot int) *dExpr {
+	if slot > d.maxTemp {
+		d.maxTemp = slot
+	}
+	return &dExpr{exprTemp, int32(slot), nil}
+}
+
+//hasCall reports whether evaluating e calls something.
+func hasCall(e *dExpr) bool {
+	if e.Op == OP_CALL {
+		return true
+	}
+	for _, arg := range e.Args {
+		if hasCall(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+//readsMemory reports whether e loads or calls something, meaning it can't
+//be moved across a store or a call.
+func readsMemory(e *dExpr) bool {
+	if e.Op == OP_CALL || (e.Op >= OP_LOAD1 && e.Op <= OP_LOAD4) {
+		return true
+	}
+	for _, arg := range e.Args {
+		if readsMemory(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *decompiler) translateBlock(b *BasicBlock) decompBlock {
+	var db decompBlock
+	stack := make([]*dExpr, 0)
+	if depth, ok := d.stack.DepthAt(b.Start); ok {
+		for k := 0; k < depth; k++ {
+			stack = append(stack, d.temp(k))
+		}
+	}
+	pop := func() *dExpr {
+		if len(stack) == 0 {
+			return &dExpr{OP_CONST, 0, nil}
+		}
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return e
+	}
+	push := func(e *dExpr) {
+		stack = append(stack, e)
+	}
+	//spill moves values that read memory or call out into their slot
+	//temps, so that they are evaluated before the statement that follows.
+	spill := func() {
+		for k, e := range stack {
+			if readsMemory(e) {
+				db.stmts = append(db.stmts, &dStmt{kind: stmtAssign, lhs: d.temp(k), expr: e})
+				stack[k] = d.temp(k)
+			}
+		}
+	}
+	args := make(map[int32]*dExpr)
+
+	for i := b.Start; i < b.End; i++ {
+		insn := d.ctx.Insns[i]
+		if !insn.Valid {
+			db.stmts = append(db.stmts, &dStmt{kind: stmtExpr, expr: &dExpr{OP_UNDEF, int32(insn.Op), nil}})
+			continue
+		}
+		arg := insn.IntArg()
+		switch op := insn.Op; {
+		case op == OP_CONST, op == OP_LOCAL:
+			if op == OP_LOCAL {
+				d.noteLocal(arg)
+			} else if _, exists := d.enums[i]; exists {
+				op, arg = exprEnum, int32(i)
+			} else if _, ok := FloatString(uint32(arg)); ok && d.ctx.Types.Const(i) == TypeFloat {
+				op = exprFloat
+			} else if d.strs[i] {
+				op = exprStr
+			}
+			push(&dExpr{op, arg, nil})
+		case op == OP_PUSH:
+			push(&dExpr{exprVoid, 0, nil})
+		case op == OP_POP:
+			if e := pop(); hasCall(e) {
+				db.stmts = append(db.stmts, &dStmt{kind: stmtExpr, expr: e})
+			}
+		case op >= OP_LOAD1 && op <= OP_LOAD4, op >= OP_SEX8 && op <= OP_NEGI,
+			op == OP_BCOM, op == OP_NEGF, op == OP_CVIF, op == OP_CVFI:
+			push(&dExpr{op, 0, []*dExpr{pop()}})
+		case op >= OP_ADD && op <= OP_RSHU, op >= OP_ADDF && op <= OP_MULF:
+			r := pop()
+			l := pop()
+			push(&dExpr{op, 0, []*dExpr{l, r}})
+		case op >= OP_STORE1 && op <= OP_STORE4:
+			value := pop()
+			addr := pop()
+			spill()
+			lhs := &dExpr{op - OP_STORE1 + OP_LOAD1, 0, []*dExpr{addr}}
+			db.stmts = append(db.stmts, &dStmt{kind: stmtAssign, lhs: lhs, expr: value})
+		case op == OP_ARG:
+			args[arg] = pop()
+		case op == OP_CALL:
+			target := pop()
+			spill()
+			offsets := make([]int, 0, len(args))
+			for off := range args {
+				offsets = append(offsets, int(off))
+			}
+			sort.Ints(offsets)
+			call := &dExpr{OP_CALL, 0, []*dExpr{target}}
+			for _, off := range offsets {
+				call.Args = append(call.Args, args[int32(off)])
+			}
+			args = make(map[int32]*dExpr)
+			push(call)
+		case op == OP_BLOCK_COPY:
+			src := pop()
+			dst := pop()
+			spill()
+			db.stmts = append(db.stmts, &dStmt{kind: stmtExpr, expr: &dExpr{op, arg, []*dExpr{dst, src}}})
+		case IsBranch(op):
+			r := pop()
+			l := pop()
+			db.term = &dExpr{op, 0, []*dExpr{l, r}}
+		case op == OP_JUMP:
+			target := pop()
+			if i == b.Start || d.ctx.Insns[i-1].Op != OP_CONST {
+				db.term = target
+				d.decodeSwitch(b, i, target)
+			}
+		case op == OP_LEAVE:
+			db.term = pop()
+		}
+	}
+
+	//Values still on the stack flow into the next block through the
+	//slot temps.
+	for k, e := range stack {
+		if e.Op != exprTemp || int(e.Value) != k {
+			db.stmts = append(db.stmts, &dStmt{kind: stmtAssign, lhs: d.temp(k), expr: e})
+		}
+	}
+	return db
+}
+
+//decodeSwitch recovers case values for a computed JUMP compiled the way
+//LCC does it: a load from table + (index << 2), where index may have the
+//lowest case value subtracted. Tables the Switch decoder finds also give
+//the default, and their bounds checks are left out of the output.
+func (d *decompiler) decodeSwitch(b *BasicBlock, insn int, target *dExpr) {
+	if sw, ok := d.ctx.Switch(d.proc, insn); ok {
+		d.caseVals[insn] = sw.Cases()
+		if sw.Default >= 0 {
+			d.defaults[insn] = sw.Default
+			for _, check := range sw.Checks {
+				d.checks[check] = true
+			}
+		}
+		return
+	}
+	if target.Op != OP_LOAD4 || target.Args[0].Op != OP_ADD {
+		return
+	}
+	l, r := target.Args[0].Args[0], target.Args[0].Args[1]
+	if l.Op == OP_CONST {
+		l, r = r, l
+	}
+	if r.Op != OP_CONST || l.Op != OP_LSH || l.Args[1].Op != OP_CONST || l.Args[1].Value != 2 {
+		return
+	}
+	base := uint32(r.Value)
+	low := int32(0)
+	if index := l.Args[0]; index.Op == OP_SUB && index.Args[1].Op == OP_CONST {
+		low = index.Args[1].Value
+	}
+	succs := make(map[int]bool)
+	for _, succ := range b.Succs {
+		succs[succ.Start] = true
+	}
+	values := make(map[int][]int32)
+	for k := uint32(0); ; k++ {
+		tgt, ok := d.ctx.QvmFile.Word(base + 4*k)
+		if !ok || !succs[int(tgt)] {
+			break
+		}
+		values[int(tgt)] = append(values[int(tgt)], low+int32(k))
+	}
+	d.caseVals[insn] = values
+}
+
+func (d *decompiler) noteLocal(off int32) {
+	if _, ok := argIndex(d.proc, int(off)); !ok {
+		d.locals[off] = true
+	}
+}
+
+//maxArgs is the most arguments a call can pass, as many as the engine
+//passes to a syscall.
+const maxArgs = 16
+
+//argIndex returns which argument of proc the frame offset off refers to.
+func argIndex(proc *Procedure, off int) (int, bool) {
+	n := off - proc.FrameSize - 8
+	if n < 0 || n%4 != 0 || n/4 >= maxArgs {
+		return 0, false
+	}
+	return n / 4, true
+}
+
+//global returns the global a load of width op from addr reads as a whole,
+//or nil.
+func (d *decompiler) global(op int, addr *dExpr) *Global {
+	if addr.Op != OP_CONST {
+		return nil
+	}
+	g, exists := d.ctx.Globals[uint32(addr.Value)]
+	if !exists {
+		return nil
+	}
+	switch g.Type {
+	case TypeChar:
+		op -= OP_LOAD1
+	case TypeShort:
+		op -= OP_LOAD2
+	default:
+		op -= OP_LOAD4
+	}
+	if op != 0 {
+		return nil
+	}
+	return g
+}
+
+//valueCType returns the C type of the value of e as far as the types
+//applied to variables tell, or nil.
+func (d *decompiler) valueCType(e *dExpr) *CType {
+	switch {
+	case e.Op == OP_LOAD4:
+		if _, t, ok := d.typedPath(e.Args[0], 4); ok {
+			return t
+		}
+	case e.Op == OP_LOCAL:
+		if t := d.ctx.LocalCType(d.proc, int(e.Value)); t != nil {
+			return PointerTo(t)
+		}
+	}
+	return nil
+}
+
+//typedPath names the object width bytes wide at addr using the C types
+//applied to variables, e.g. "ent->client->ps.stats[3]". A width of 0 names
+//the outermost object at addr.
+func (d *decompiler) typedPath(addr *dExpr, width int) (string, *CType, bool) {
+	base, off := addr, 0
+	if addr.Op == OP_ADD && addr.Args[1].Op == OP_CONST {
+		base, off = addr.Args[0], int(addr.Args[1].Value)
+	}
+	switch base.Op {
+	case OP_LOCAL:
+		if t := d.ctx.LocalCType(d.proc, int(base.Value)); t != nil {
+			if path, ft, ok := t.FieldPath(off, width); ok {
+				return d.localName(base.Value) + path, ft, true
+			}
+		}
+		return "", nil, false
+	case OP_CONST:
+		if g, t, goff := d.ctx.GlobalCType(uint32(int(base.Value) + off)); t != nil {
+			if path, ft, ok := t.FieldPath(goff, width); ok {
+				return g.Name + path, ft, true
+			}
+		}
+		return "", nil, false
+	}
+	pt := d.valueCType(base).Resolve()
+	if pt == nil || pt.Kind != CPointer {
+		return "", nil, false
+	}
+	path, ft, ok := pt.Elem.FieldPath(off, width)
+	switch {
+	case !ok:
+	case strings.HasPrefix(path, "."):
+		return d.exprString(base, 15) + "->" + path[1:], ft, true
+	case path == "":
+		return "*" + d.exprString(base, 14), ft, true
+	}
+	return "", nil, false
+}
+
+func (d *decompiler) localName(off int32) string {
+	return d.ctx.LocalName(d.proc, int(off))
+}
+
+//LocalName names the frame slot at offset off of proc: its name from
+//LocalNames if it was renamed, else arg_N for the arguments above the frame
+//and local_N, N being the offset, for the rest.
+func (ctx *Context) LocalName(proc *Procedure, off int) string {
+	if n, ok := argIndex(proc, off); ok {
+		return ctx.argName(proc, n)
+	}
+	if name, exists := ctx.LocalNames[proc.StartInstruction][off]; exists {
+		return name
+	}
+	return fmt.Sprintf("local_%d", off)
+}
+
+func (ctx *Context) argName(proc *Procedure, n int) string {
+	if name, exists := ctx.LocalNames[proc.StartInstruction][proc.FrameSize+8+4*n]; exists {
+		return name
+	}
+	return fmt.Sprintf("arg_%d", n)
+}
+
+//structure emits statements starting at block b until one of the stop
+//blocks is reached, which it returns. It returns nil when the path ended
+//in a return, break, continue or goto instead.
+func (d *decompiler) structure(b *BasicBlock, stops map[*BasicBlock]bool, lc *loopCtx, first bool) ([]*dStmt, *BasicBlock) {
+	stmts := make([]*dStmt, 0)
+	for b != nil {
+		switch {
+		case stops[b]:
+			return stmts, b
+		case lc != nil && b == lc.breakTarget:
+			return append(stmts, &dStmt{kind: stmtBreak}), nil
+		case lc != nil && lc.loop != nil && b == lc.loop.Header && !first:
+			return append(stmts, &dStmt{kind: stmtContinue}), nil
+		case d.emitted[b], lc != nil && lc.loop != nil && !lc.loop.Contains(b):
+			d.gotos[b.Start] = true
+			return append(stmts, &dStmt{kind: stmtGoto, label: b.Start}), nil
+		}
+		if loop, exists := d.loops[b]; exists && !(first && lc != nil && lc.loop == loop) {
+			var follow *BasicBlock
+			stmts, follow = d.structureLoop(stmts, loop, lc)
+			b = follow
+			continue
+		}
+		first = false
+
+		d.emitted[b] = true
+		stmts = append(stmts, &dStmt{kind: stmtLabel, label: b.Start})
+		db := d.blocks[b]
+		stmts = append(stmts, db.stmts...)
+		last := d.ctx.Insns[b.Last()]
+		switch {
+		case lc != nil && b == lc.latch:
+			lc.latchCond = db.term
+			if int(last.IntArg()) != lc.loop.Header.Start {
+				lc.latchCond = negate(db.term)
+			}
+			return stmts, nil
+		case last.Valid && last.Op == OP_LEAVE:
+			return append(stmts, &dStmt{kind: stmtReturn, expr: db.term}), nil
+		case last.Valid && IsBranch(last.Op) && d.checks[b.Last()]:
+			//Going to the default is part of the switch.
+			b = d.cfg.BlockAt(b.End)
+		case last.Valid && IsBranch(last.Op):
+			var next *BasicBlock
+			stmts, next = d.structureIf(stmts, b, db.term, stops, lc)
+			if next == nil {
+				return stmts, nil
+			}
+			b = next
+		case last.Valid && last.Op == OP_JUMP && db.term != nil:
+			var next *BasicBlock
+			stmts, next = d.structureSwitch(stmts, b, db.term, stops, lc)
+			if next == nil {
+				return stmts, nil
+			}
+			b = next
+		case len(b.Succs) == 1:
+			b = b.Succs[0]
+		default:
+			return stmts, nil
+		}
+	}
+	return stmts, nil
+}
+
+//follow returns the block where the paths leaving b meet again. Inside a
+//loop it has to be part of the loop, the paths leaving the loop end in
+//break or goto instead.
+func (d *decompiler) follow(b *BasicBlock, lc *loopCtx) *BasicBlock {
+	f := d.pdom.Idom[b.Index]
+	if lc != nil && lc.loop != nil && (f == nil || !lc.loop.Contains(f)) {
+		f = d.loopFollow(lc.loop, b)
+	}
+	if f == nil || d.emitted[f] {
+		return nil
+	}
+	return f
+}
+
+//loopFollow returns the immediate post-dominator of b within the body of
+//loop, ignoring the paths that leave the loop. Paths end when they go back
+//to the header, so the header is returned when only the back edges are
+//left in common.
+func (d *decompiler) loopFollow(loop *Loop, b *BasicBlock) *BasicBlock {
+	pdom, exists := d.loopPdom[loop]
+	if !exists {
+		n := len(loop.Body)
+		index := make(map[*BasicBlock]int, n)
+		for i, blk := range loop.Body {
+			index[blk] = i
+		}
+		//Node n is the virtual exit the back edges go to. The graph is
+		//walked backwards from it.
+		succs := func(i int) []int {
+			if i == n {
+				return blockIndicesIn(loop.BackEdges, index)
+			}
+			if loop.Body[i] == loop.Header {
+				return nil
+			}
+			return blockIndicesIn(loop.Body[i].Preds, index)
+		}
+		preds := func(i int) []int {
+			if i == n {
+				return nil
+			}
+			out := make([]int, 0)
+			for _, succ := range loop.Body[i].Succs {
+				if succ == loop.Header {
+					out = append(out, n)
+				} else if k, exists := index[succ]; exists {
+					out = append(out, k)
+				}
+			}
+			return out
+		}
+		idom := computeIdom(n+1, n, succs, preds)
+		pdom = make([]*BasicBlock, n)
+		for i, p := range idom[:n] {
+			switch {
+			case p == n:
+				pdom[i] = loop.Header
+			case p >= 0 && p != i:
+				pdom[i] = loop.Body[p]
+			}
+		}
+		d.loopPdom[loop] = pdom
+	}
+	for i, blk := range loop.Body {
+		if blk == b {
+			return pdom[i]
+		}
+	}
+	return nil
+}
+
+//blockIndicesIn maps the blocks found in index to their position there.
+func blockIndicesIn(blocks []*BasicBlock, index map[*BasicBlock]int) []int {
+	out := make([]int, 0, len(blocks))
+	for _, b := range blocks {
+		if i, exists := index[b]; exists {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func withStop(stops map[*BasicBlock]bool, extra ...*BasicBlock) map[*BasicBlock]bool {
+	s := make(map[*BasicBlock]bool, len(stops)+len(extra))
+	for b := range stops {
+		s[b] = true
+	}
+	for _, b := range extra {
+		if b != nil {
+			s[b] = true
+		}
+	}
+	return s
+}
+
+//arm structures one arm of an if or a case, ending in a goto if it reached
+//a stop other than the expected one.
+func (d *decompiler) arm(b *BasicBlock, stops map[*BasicBlock]bool, expected *BasicBlock, lc *loopCtx) []*dStmt {
+	stmts, reached := d.structure(b, stops, lc, false)
+	if reached != nil && reached != expected {
+		d.gotos[reached.Start] = true
+		stmts = append(stmts, &dStmt{kind: stmtGoto, label: reached.Start})
+	}
+	return stmts
+}
+
+func (d *decompiler) structureIf(stmts []*dStmt, b *BasicBlock, cond *dExpr, stops map[*BasicBlock]bool, lc *loopCtx) ([]*dStmt, *BasicBlock) {
+	taken := d.cfg.BlockAt(int(d.ctx.Insns[b.Last()].IntArg()))
+	fall := d.cfg.BlockAt(b.End)
+	if taken == nil || fall == nil || taken == fall {
+		if fall == nil {
+			fall = taken
+		}
+		return stmts, fall
+	}
+	follow := d.follow(b, lc)
+	inner := withStop(stops, follow)
+	switch follow {
+	case fall:
+		body := d.arm(taken, inner, follow, lc)
+		stmts = append(stmts, &dStmt{kind: stmtIf, expr: cond, body: body})
+	case taken:
+		body := d.arm(fall, inner, follow, lc)
+		stmts = append(stmts, &dStmt{kind: stmtIf, expr: negate(cond), body: body})
+	default:
+		body := d.arm(fall, inner, follow, lc)
+		els := d.arm(taken, inner, follow, lc)
+		stmts = append(stmts, &dStmt{kind: stmtIf, expr: negate(cond), body: body, els: els})
+	}
+	return stmts, follow
+}
+
+func (d *decompiler) structureSwitch(stmts []*dStmt, b *BasicBlock, value *dExpr, stops map[*BasicBlock]bool, lc *loopCtx) ([]*dStmt, *BasicBlock) {
+	follow := d.follow(b, lc)
+	values := d.caseVals[b.Last()]
+	//With decoded values, targets without one belong to another switch
+	//sharing the VER2 jump table.
+	targets := make([]*BasicBlock, 0, len(b.Succs))
+	for _, succ := range b.Succs {
+		if succ != follow && (len(values) == 0 || len(values[succ.Start]) > 0) {
+			targets = append(targets, succ)
+		}
+	}
+	//Without a case of its own, the default is only reached through the
+	//bounds checks.
+	var def *BasicBlock
+	if tgt, exists := d.defaults[b.Last()]; exists {
+		def = d.cfg.BlockAt(tgt)
+		if def != nil && def != follow && len(values[tgt]) == 0 {
+			targets = append(targets, def)
+		}
+	}
+	sort.Sort(blocksByIndex(targets))
+
+	sw := &dStmt{kind: stmtSwitch, expr: switchValue(value)}
+	//Cases landing on the follow itself break right away.
+	if follow != nil && len(values[follow.Start]) > 0 {
+		sw.cases = append(sw.cases, dCase{values[follow.Start], follow.Start, false, []*dStmt{{kind: stmtBreak}}})
+	}
+	//break leaves the switch, continue still belongs to the enclosing loop.
+	inner := &loopCtx{breakTarget: follow}
+	if lc != nil {
+		inner.loop = lc.loop
+	}
+	for k, tgt := range targets {
+		caseStops := withStop(stops, targets...)
+		delete(caseStops, tgt)
+		var next *BasicBlock
+		if k+1 < len(targets) {
+			next = targets[k+1]
+		}
+		body, reached := d.structure(tgt, caseStops, inner, false)
+		if reached != nil && reached != next {
+			d.gotos[reached.Start] = true
+			body = append(body, &dStmt{kind: stmtGoto, label: reached.Start})
+		}
+		sw.cases = append(sw.cases, dCase{values[tgt.Start], tgt.Start, tgt == def, body})
+	}
+	return append(stmts, sw), follow
+}
+
+//switchValue strips the table lookup from the target of a computed JUMP,
+//leaving the value switched on.
+func switchValue(target *dExpr) *dExpr {
+	if target.Op != OP_LOAD4 || target.Args[0].Op != OP_ADD {
+		return target
+	}
+	l, r := target.Args[0].Args[0], target.Args[0].Args[1]
+	if l.Op == OP_CONST {
+		l, r = r, l
+	}
+	if r.Op != OP_CONST || l.Op != OP_LSH {
+		return target
+	}
+	index := l.Args[0]
+	if index.Op == OP_SUB && index.Args[1].Op == OP_CONST {
+		return index.Args[0]
+	}
+	return index
+}
+
+func (d *decompiler) structureLoop(stmts []*dStmt, loop *Loop, outer *loopCtx) ([]*dStmt, *BasicBlock) {
+	h := loop.Header
+	var follow *BasicBlock
+	if len(loop.Exits) > 0 {
+		follow = loop.Exits[0]
+	}
+	last := d.ctx.Insns[h.Last()]
+	db := d.blocks[h]
+
+	//while (cond) when the header only tests the condition.
+	if last.Valid && IsBranch(last.Op) && len(db.stmts) == 0 && len(h.Succs) == 2 {
+		in, out := h.Succs[0], h.Succs[1]
+		if loop.Contains(out) {
+			in, out = out, in
+		}
+		if !loop.Contains(out) && loop.Contains(in) {
+			follow = out
+			cond := db.term
+			if in.Start != int(last.IntArg()) {
+				cond = negate(cond)
+			}
+			lc := &loopCtx{loop: loop, breakTarget: follow}
+			d.emitted[h] = true
+			stmts = append(stmts, &dStmt{kind: stmtLabel, label: h.Start})
+			body, reached := d.structure(in, nil, lc, false)
+			if reached != nil {
+				d.gotos[reached.Start] = true
+				body = append(body, &dStmt{kind: stmtGoto, label: reached.Start})
+			}
+			return append(stmts, &dStmt{kind: stmtWhile, expr: cond, body: body, backEdges: len(loop.BackEdges)}), follow
+		}
+	}
+
+	lc := &loopCtx{loop: loop, breakTarget: follow}
+	//do { } while (cond) when the only back edge is a branch that
+	//otherwise leaves the loop.
+	if len(loop.BackEdges) == 1 {
+		latch := loop.BackEdges[0]
+		ll := d.ctx.Insns[latch.Last()]
+		if ll.Valid && IsBranch(ll.Op) && len(latch.Succs) == 2 {
+			other := latch.Succs[0]
+			if other == h {
+				other = latch.Succs[1]
+			}
+			if !loop.Contains(other) {
+				follow = other
+				lc.breakTarget, lc.latch = other, latch
+				body, _ := d.structure(h, nil, lc, true)
+				return append(stmts, &dStmt{kind: stmtDoWhile, expr: lc.latchCond, body: body}), follow
+			}
+		}
+	}
+
+	body, _ := d.structure(h, nil, lc, true)
+	return append(stmts, &dStmt{kind: stmtWhile, expr: nil, body: body}), follow
+}
+
+//negate returns the opposite of a branch condition.
+func negate(cond *dExpr) *dExpr {
+	if cond == nil {
+		return nil
+	}
+	opposite := map[int]int{
+		OP_EQ: OP_NE, OP_NE: OP_EQ, OP_LTI: OP_GEI, OP_GEI: OP_LTI, OP_LEI: OP_GTI, OP_GTI: OP_LEI,
+		OP_LTU: OP_GEU, OP_GEU: OP_LTU, OP_LEU: OP_GTU, OP_GTU: OP_LEU,
+		OP_EQF: OP_NEF, OP_NEF: OP_EQF, OP_LTF: OP_GEF, OP_GEF: OP_LTF, OP_LEF: OP_GTF, OP_GTF: OP_LEF,
+	}
+	if op, exists := opposite[cond.Op]; exists {
+		return &dExpr{op, cond.Value, cond.Args}
+	}
+	return cond
+}
+
+//simplify drops labels nobody jumps to and the continue at the end of a
+//loop body, joins nested ifs into &&, and turns
+//"init; while (cond) { ...; incr; }" into a for loop.
+func (d *decompiler) simplify(stmts []*dStmt, loopBody bool) []*dStmt {
+	out := make([]*dStmt, 0, len(stmts))
+	for _, s := range stmts {
+		if s.kind == stmtLabel && !d.gotos[s.label] {
+			continue
+		}
+		switch s.kind {
+		case stmtIf:
+			s.body = d.simplify(s.body, false)
+			s.els = d.simplify(s.els, false)
+			if inner := s.body; len(s.els) == 0 && len(inner) == 1 && inner[0].kind == stmtIf && len(inner[0].els) == 0 {
+				s.expr = &dExpr{exprAnd, 0, []*dExpr{s.expr, inner[0].expr}}
+				s.body = inner[0].body
+			}
+		case stmtWhile, stmtDoWhile:
+			s.body = d.simplify(s.body, true)
+		case stmtSwitch:
+			for k := range s.cases {
+				s.cases[k].body = d.simplify(s.cases[k].body, false)
+			}
+		}
+		out = append(out, s)
+	}
+	if loopBody && len(out) > 0 && out[len(out)-1].kind == stmtContinue {
+		out = out[:len(out)-1]
+	}
+
+	for k := 1; k < len(out); k++ {
+		init, loop := out[k-1], out[k]
+		if init.kind != stmtAssign || loop.kind != stmtWhile || loop.expr == nil || loop.backEdges != 1 || len(loop.body) == 0 {
+			continue
+		}
+		incr := loop.body[len(loop.body)-1]
+		v := d.exprString(init.lhs, 0)
+		if incr.kind != stmtAssign || d.exprString(incr.lhs, 0) != v || !strings.Contains(d.exprString(loop.expr, 0), v) {
+			continue
+		}
+		loop.kind, loop.init, loop.incr = stmtFor, init, incr
+		loop.body = loop.body[:len(loop.body)-1]
+		out = append(out[:k-1], out[k:]...)
+		k--
+	}
+	return out
+}
+
+func (d *decompiler) printStmts(buf *bytes.Buffer, stmts []*dStmt, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, s := range stmts {
+		switch s.kind {
+		case stmtLabel:
+			fmt.Fprintf(buf, "%sloc_%08x:\n", strings.Repeat("\t", depth-1), s.label)
+		case stmtExpr:
+			fmt.Fprintf(buf, "%s%s;\n", indent, d.exprString(s.expr, 0))
+		case stmtAssign:
+			fmt.Fprintf(buf, "%s%s;\n", indent, d.assignString(s))
+		case stmtReturn:
+			if s.expr == nil || s.expr.Op == exprVoid {
+				fmt.Fprintf(buf, "%sreturn;\n", indent)
+			} else {
+				fmt.Fprintf(buf, "%sreturn %s;\n", indent, d.exprString(s.expr, 0))
+			}
+		case stmtBreak:
+			fmt.Fprintf(buf, "%sbreak;\n", indent)
+		case stmtContinue:
+			fmt.Fprintf(buf, "%scontinue;\n", indent)
+		case stmtGoto:
+			fmt.Fprintf(buf, "%sgoto loc_%08x;\n", indent, s.label)
+		case stmtIf:
+			fmt.Fprintf(buf, "%sif (%s) {\n", indent, d.exprString(s.expr, 0))
+			d.printStmts(buf, s.body, depth+1)
+			for len(s.els) == 1 && s.els[0].kind == stmtIf {
+				s = s.els[0]
+				fmt.Fprintf(buf, "%s} else if (%s) {\n", indent, d.exprString(s.expr, 0))
+				d.printStmts(buf, s.body, depth+1)
+			}
+			if len(s.els) > 0 {
+				fmt.Fprintf(buf, "%s} else {\n", indent)
+				d.printStmts(buf, s.els, depth+1)
+			}
+			fmt.Fprintf(buf, "%s}\n", indent)
+		case stmtWhile:
+			cond := "1"
+			if s.expr != nil {
+				cond = d.exprString(s.expr, 0)
+			}
+			fmt.Fprintf(buf, "%swhile (%s) {\n", indent, cond)
+			d.printStmts(buf, s.body, depth+1)
+			fmt.Fprintf(buf, "%s}\n", indent)
+		case stmtDoWhile:
+			fmt.Fprintf(buf, "%sdo {\n", indent)
+			d.printStmts(buf, s.body, depth+1)
+			cond := "1"
+			if s.expr != nil {
+				cond = d.exprString(s.expr, 0)
+			}
+			fmt.Fprintf(buf, "%s} while (%s);\n", indent, cond)
+		case stmtFor:
+			fmt.Fprintf(buf, "%sfor (%s; %s; %s) {\n", indent, d.assignString(s.init), d.exprString(s.expr, 0), d.assignString(s.incr))
+			d.printStmts(buf, s.body, depth+1)
+			fmt.Fprintf(buf, "%s}\n", indent)
+		case stmtSwitch:
+			fmt.Fprintf(buf, "%sswitch (%s) {\n", indent, d.exprString(s.expr, 0))
+			enum := d.valueCType(s.expr)
+			for _, c := range s.cases {
+				if len(c.values) == 0 && !c.def {
+					fmt.Fprintf(buf, "%scase ?: /* loc_%08x */\n", indent, c.target)
+				}
+				for _, v := range c.values {
+					value := d.constString(v)
+					if name, ok := enum.EnumName(int(v)); ok {
+						value = name
+					}
+					fmt.Fprintf(buf, "%scase %s:\n", indent, value)
+				}
+				if c.def {
+					fmt.Fprintf(buf, "%sdefault:\n", indent)
+				}
+				d.printStmts(buf, c.body, depth+1)
+			}
+			fmt.Fprintf(buf, "%s}\n", indent)
+		}
+	}
+}
+
+func (d *decompiler) assignString(s *dStmt) string {
+	lhs := d.exprString(s.lhs, 0)
+	//x = x op y is printed as x op= y.
+	if e := s.expr; len(e.Args) == 2 && cBinaryOps[e.Op] != "" && !IsBranch(e.Op) {
+		if d.exprString(e.Args[0], 0) == lhs {
+			if e.Args[1].Op == OP_CONST && e.Args[1].Value == 1 && (e.Op == OP_ADD || e.Op == OP_SUB) {
+				return d.exprString(s.lhs, 15) + cBinaryOps[e.Op] + cBinaryOps[e.Op]
+			}
+			return fmt.Sprintf("%s %s= %s", lhs, cBinaryOps[e.Op], d.exprString(e.Args[1], 2))
+		}
+	}
+	return fmt.Sprintf("%s = %s", lhs, d.exprString(s.expr, 2))
+}
+
+//C operators of the binary opcodes and comparisons, with their precedence.
+var cBinaryOps = map[int]string{
+	OP_ADD: "+", OP_SUB: "-", OP_DIVI: "/", OP_DIVU: "/", OP_MODI: "%", OP_MODU: "%",
+	OP_MULI: "*", OP_MULU: "*", OP_BAND: "&", OP_BOR: "|", OP_BXOR: "^",
+	OP_LSH: "<<", OP_RSHI: ">>", OP_RSHU: ">>",
+	OP_ADDF: "+", OP_SUBF: "-", OP_DIVF: "/", OP_MULF: "*",
+	OP_EQ: "==", OP_NE: "!=", OP_LTI: "<", OP_LEI: "<=", OP_GTI: ">", OP_GEI: ">=",
+	OP_LTU: "<", OP_LEU: "<=", OP_GTU: ">", OP_GEU: ">=",
+	OP_EQF: "==", OP_NEF: "!=", OP_LTF: "<", OP_LEF: "<=", OP_GTF: ">", OP_GEF: ">=",
+	exprAnd: "&&",
+}
+
+var cPrecedence = map[string]int{
+	"*": 13, "/": 13, "%": 13, "+": 12, "-": 12, "<<": 11, ">>": 11,
+	"<": 10, "<=": 10, ">": 10, ">=": 10, "==": 9, "!=": 9, "&": 8, "^": 7, "|": 6,
+	"&&": 5,
+}
+
+var cUnaryOps = map[int]string{
+	OP_SEX8: "(signed char)", OP_SEX16: "(short)", OP_NEGI: "-", OP_NEGF: "-",
+	OP_BCOM: "~", OP_CVIF: "(float)", OP_CVFI: "(int)",
+}
+
+var cLoadTypes = map[int]string{
+	OP_LOAD1: "unsigned char", OP_LOAD2: "unsigned short", OP_LOAD4: "int",
+}
+
+//constString prints small numbers in decimal and everything else in hex.
+//stringConsts returns the CONST instructions of proc that push the address
+//of a string and are typed as a pointer, or untyped and used as one: passed
+//as an argument or loaded, stored or copied through. A number that happens
+//to equal the address of a string stays a number.
+func (ctx *Context) stringConsts(proc *Procedure) map[int]bool {
+	strs := make(map[int]bool)
+	isString := func(src int) bool {
+		if src < 0 || ctx.Insns[src].Op != OP_CONST {
+			return false
+		}
+		_, exists := ctx.Strings[int(uint32(ctx.Insns[src].IntArg()))]
+		return exists
+	}
+	for i, operands := range ctx.OperandSources(proc) {
+		addrs := operands[:0]
+		switch op := ctx.Insns[i].Op; {
+		case op == OP_ARG, op >= OP_LOAD1 && op <= OP_LOAD4, op >= OP_STORE1 && op <= OP_STORE4:
+			addrs = operands[:1]
+		case op == OP_BLOCK_COPY:
+			addrs = operands
+		}
+		for _, src := range addrs {
+			if isString(src) && ctx.Types.Const(src) == TypeUnknown {
+				strs[src] = true
+			}
+		}
+	}
+	for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+		if isString(i) && ctx.Types.Const(i) == TypePointer {
+			strs[i] = true
+		}
+	}
+	return strs
+}
+
+func (d *decompiler) constString(v int32) string {
+	if v > -0x1000 && v < 0x1000 {
+		return fmt.Sprintf("%d", v)
+	}
+	return fmt.Sprintf("0x%x", uint32(v))
+}
+
+func (d *decompiler) callName(target *dExpr) string {
+	if target.Op == OP_CONST {
+		if target.Value < 0 {
+			if sc, exists := d.ctx.Syscalls[int(target.Value)]; exists {
+				return sc.Name
+			}
+			return fmt.Sprintf("syscall_%d", -1-target.Value)
+		}
+		if proc, exists := d.ctx.Procs[int(target.Value)]; exists {
+			return proc.Name
+		}
+	}
+	return fmt.Sprintf("(*%s)", d.exprString(target, 14))
+}
+
+//exprString prints e, parenthesised if its precedence is below prec.
+func (d *decompiler) exprString(e *dExpr, prec int) string {
+	paren := func(s string, p int) string {
+		if p < prec {
+			return "(" + s + ")"
+		}
+		return s
+	}
+	switch {
+	case e == nil:
+		return "?"
+	case e.Op == exprTemp:
+		return fmt.Sprintf("stk_%d", e.Value)
+	case e.Op == exprVoid:
+		return "void"
+	case e.Op == exprFloat:
+		str, _ := FloatString(uint32(e.Value))
+		return str
+	case e.Op == exprEnum:
+		return d.enums[int(e.Value)]
+	case e.Op == OP_UNDEF:
+		return fmt.Sprintf("__illegal_opcode(%d)", e.Value)
+	case e.Op == exprStr:
+		str := d.ctx.Strings[int(uint32(e.Value))]
+		return fmt.Sprintf("\"%s\"", strings.Replace(str, "\"", "\\\"", -1))
+	case e.Op == OP_CONST:
+		return d.constString(e.Value)
+	case e.Op == OP_LOCAL:
+		if slot := d.ctx.Frame(d.proc).Slot(int(e.Value)); slot != nil && slot.Size > 4 {
+			//Arrays decay to pointers.
+			return d.localName(e.Value)
+		}
+		return paren("&"+d.localName(e.Value), 14)
+	case e.Op >= OP_LOAD1 && e.Op <= OP_LOAD4:
+		addr := e.Args[0]
+		if path, _, ok := d.typedPath(addr, 1<<uint(e.Op-OP_LOAD1)); ok {
+			if strings.HasPrefix(path, "*") {
+				return paren(path, 14)
+			}
+			return path
+		}
+		if addr.Op == OP_LOCAL {
+			return d.localName(addr.Value)
+		}
+		if g := d.global(e.Op, addr); g != nil {
+			return g.Name
+		}
+		typ := cLoadTypes[e.Op] + " *"
+		if e.Op == OP_LOAD4 && addr.Op == OP_CONST {
+			typ = d.ctx.Types.Global(uint32(addr.Value)).PointerTo()
+		}
+		return paren(fmt.Sprintf("*(%s)%s", typ, d.exprString(addr, 14)), 14)
+	case e.Op == OP_CALL:
+		args := make([]string, 0, len(e.Args)-1)
+		for _, arg := range e.Args[1:] {
+			args = append(args, d.exprString(arg, 2))
+		}
+		return fmt.Sprintf("%s(%s)", d.callName(e.Args[0]), strings.Join(args, ", "))
+	case e.Op == OP_BLOCK_COPY:
+		return fmt.Sprintf("memcpy(%s, %s, %d)", d.exprString(e.Args[0], 2), d.exprString(e.Args[1], 2), e.Value)
+	case cUnaryOps[e.Op] != "":
+		return paren(cUnaryOps[e.Op]+d.exprString(e.Args[0], 14), 14)
+	case e.Op == OP_ADD && e.Args[1].Op == OP_CONST && d.valueCType(e.Args[0]).IsStructPointer():
+		if path, _, ok := d.typedPath(e, 0); ok {
+			return paren("&"+path, 14)
+		}
+		fallthrough
+	case cBinaryOps[e.Op] != "":
+		op := cBinaryOps[e.Op]
+		p := cPrecedence[op]
+		l, r := d.exprString(e.Args[0], p), d.exprString(e.Args[1], p+1)
+		switch e.Op {
+		case OP_DIVU, OP_MODU, OP_RSHU, OP_LTU, OP_LEU, OP_GTU, OP_GEU:
+			l = "(unsigned)" + d.exprString(e.Args[0], 14)
+		}
+		return paren(fmt.Sprintf("%s %s %s", l, op, r), p)
+	}
+	return "?"
+}
@@ -0,0 +1,206 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"qvm"
+	"sort"
+	"strings"
+)
+
+//Detection is a guess at the module a QVM implements and the engine it was
+//built for, with the clues it rests on. The confidences run from 0 to 1.
+type Detection struct {
+	Module           Module
+	ModuleConfidence float64
+	Engine           Engine
+	EngineConfidence float64
+	Clues            []string
+}
+
+//detectModules are the modules Detect chooses from.
+var detectModules = []Module{ModuleCgame, ModuleQagame, ModuleUI}
+
+//moduleMarkers are strings only one module is likely to contain: cvars
+//nothing else registers, messages it prints and paths it loads from.
+var moduleMarkers = map[Module][]string{
+	ModuleCgame:  {"cg_gun_x", "cg_errorDecay", "cg_noPlayerAnims", "cg_thirdPersonRange", "CG_ConfigString: bad index"},
+	ModuleQagame: {"g_motd", "g_inactivity", "g_debugMove", "------- Game Initialization -------", "ShutdownGame:"},
+	ModuleUI:     {"ui_browserMaster", "ui_ffa_fraglimit", "ui_spSelection", "menu/art/", "ui/menus.txt"},
+}
+
+//quake3eMarker ends the names mods pass to trap_GetValue to look up the
+//Quake3e extensions.
+const quake3eMarker = "_Q3E"
+
+//Detect guesses the module and the engine of the QVM.
+//
+//The module follows from the syscalls it calls: one outside the table of a
+//module rules that module out, and the ones whose argument counts only fit
+//some of the tables count for those. Strings only one module uses count
+//for it, and so does vmMain handling exactly its range of commands, while
+//a command past the range rules a module out.
+//
+//Calling a Quake3e extension, or asking for one by name, means Quake3e. A
+//QVM sticking to the syscalls of the module on Quake III is taken for it,
+//more so if an original q3asm wrote the VM_MAGIC_VER1 header.
+func (ctx *Context) Detect() Detection {
+	d := Detection{ModuleUnknown, 0, EngineUnknown, 0, nil}
+	sites := ctx.SyscallSites()
+	extensions := make(map[int]Syscall)
+	addRuns(extensions, quake3eSyscalls)
+	called := make([]int, 0, len(sites))
+	for num := range sites {
+		called = append(called, num)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(called)))
+	nums := make([]int, 0, len(called))
+	for _, num := range called {
+		if _, exists := extensions[num]; !exists {
+			nums = append(nums, num)
+		}
+	}
+
+	tables := make(map[Module]map[int]Syscall)
+	for _, m := range detectModules {
+		tables[m] = BuiltinSyscalls(m, EngineQ3)
+	}
+	fits := make(map[Module]int)
+	ruled := make(map[Module]string)
+	for _, num := range nums {
+		argc := commonArgc(sites[num])
+		fitting := make([]Module, 0, len(detectModules))
+		for _, m := range detectModules {
+			sc, exists := tables[m][num]
+			switch {
+			case !exists:
+				if _, out := ruled[m]; !out {
+					ruled[m] = fmt.Sprintf("calls syscall %d", num)
+				}
+			case sc.Argc < 0 || sc.Argc == argc:
+				fitting = append(fitting, m)
+			}
+		}
+		if len(fitting) < len(detectModules) {
+			for _, m := range fitting {
+				fits[m]++
+			}
+		}
+	}
+
+	high := int32(-1)
+	for cmd := range ctx.Dispatch() {
+		if cmd > high {
+			high = cmd
+		}
+	}
+
+	scores := make(map[Module]int)
+	for _, m := range detectModules {
+		last := int32(len(moduleExports[m]) - 1)
+		if _, out := ruled[m]; !out && high > last {
+			ruled[m] = fmt.Sprintf("vmMain handles command %d", high)
+		}
+		if reason, out := ruled[m]; out {
+			d.Clues = append(d.Clues, fmt.Sprintf("%s: ruled out, %s", m, reason))
+			continue
+		}
+		markers := 0
+		for _, marker := range moduleMarkers[m] {
+			if ctx.hasString(marker) {
+				markers++
+			}
+		}
+		scores[m] = fits[m] + markers
+		clue := fmt.Sprintf("%s: %d telling syscalls fit, %d telling strings", m, fits[m], markers)
+		if high == last {
+			scores[m]++
+			clue += fmt.Sprintf(", vmMain handles commands up to %d", high)
+		}
+		d.Clues = append(d.Clues, clue)
+	}
+	best, second := 0, 0
+	for _, m := range detectModules {
+		switch s := scores[m]; {
+		case s > best:
+			d.Module, best, second = m, s, best
+		case s > second:
+			second = s
+		}
+	}
+	d.ModuleConfidence = confidence(best, second)
+	if d.ModuleConfidence == 0 {
+		d.Module = ModuleUnknown
+	}
+
+	q3e := 0
+	for _, num := range called {
+		if sc, exists := extensions[num]; exists {
+			q3e += 2
+			d.Clues = append(d.Clues, fmt.Sprintf("quake3e: calls %s", sc.Name))
+		}
+	}
+	addrs := make([]int, 0, len(ctx.Strings))
+	for addr := range ctx.Strings {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		if s := ctx.Strings[addr]; strings.HasSuffix(s, quake3eMarker) {
+			q3e++
+			d.Clues = append(d.Clues, fmt.Sprintf("quake3e: asks for %s", s))
+		}
+	}
+	if q3e > 0 {
+		d.Engine, d.EngineConfidence = EngineQuake3e, confidence(q3e, 0)
+		return d
+	}
+	q3 := 0
+	m := ctx.Module
+	if m == ModuleUnknown {
+		m = d.Module
+	}
+	if _, out := ruled[m]; m != ModuleUnknown && !out && len(nums) > 0 {
+		q3++
+		d.Clues = append(d.Clues, fmt.Sprintf("q3: only calls the syscalls of %s", m))
+	}
+	if ctx.QvmFile.Header.Magic == qvm.VM_MAGIC_VER1 {
+		q3++
+		d.Clues = append(d.Clues, "q3: VM_MAGIC_VER1 header")
+	}
+	if q3 > 0 {
+		d.Engine, d.EngineConfidence = EngineQ3, confidence(q3, 0)
+	}
+	return d
+}
+
+//confidence turns the scores of the best and the second best guess into
+//how sure the best one is. It grows with the lead and with the evidence.
+func confidence(best, second int) float64 {
+	return float64(best-second) / float64(best+1)
+}
+
+//hasString reports whether a string of the QVM contains s.
+func (ctx *Context) hasString(s string) bool {
+	for _, str := range ctx.Strings {
+		if strings.Contains(str, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"sort"
+)
+
+//DomTree holds the immediate (post-)dominator of every block of a CFG.
+//Idom is indexed by BasicBlock.Index and is nil for the root, for blocks
+//that cannot be reached, and in a post-dominator tree for blocks whose only
+//post-dominator is the procedure exit.
+type DomTree struct {
+	CFG  *CFG
+	Idom []*BasicBlock
+	Post bool
+}
+
+//Loop is a natural loop. Body contains the header and is ordered by block
+//index. Exits are the blocks outside the loop that are entered from
+//inside it.
+type Loop struct {
+	Header    *BasicBlock
+	Body      []*BasicBlock
+	BackEdges []*BasicBlock
+	Exits     []*BasicBlock
+	Parent    *Loop
+	Depth     int
+}
+
+//Contains reports whether b is part of the loop body.
+func (l *Loop) Contains(b *BasicBlock) bool {
+	return containsBlock(l.Body, b)
+}
+
+//Dominators computes the dominator tree of proc.
+func (ctx *Context) Dominators(proc *Procedure) *DomTree {
+	cfg := ctx.CFG(proc)
+	n := len(cfg.Blocks)
+	succs := func(i int) []int { return blockIndices(cfg.Blocks[i].Succs) }
+	preds := func(i int) []int { return blockIndices(cfg.Blocks[i].Preds) }
+	return &DomTree{cfg, idomToBlocks(cfg, computeIdom(n, 0, succs, preds)), false}
+}
+
+//PostDominators computes the post-dominator tree of proc. Every block
+//without successors is treated as an exit.
+func (ctx *Context) PostDominators(proc *Procedure) *DomTree {
+	cfg := ctx.CFG(proc)
+	n := len(cfg.Blocks)
+	//Node n is a virtual exit every real exit flows into.
+	exits := make([]int, 0)
+	for _, b := range cfg.Blocks {
+		if len(b.Succs) == 0 {
+			exits = append(exits, b.Index)
+		}
+	}
+	succs := func(i int) []int {
+		if i == n {
+			return exits
+		}
+		return blockIndices(cfg.Blocks[i].Preds)
+	}
+	preds := func(i int) []int {
+		if i == n {
+			return nil
+		}
+		if len(cfg.Blocks[i].Succs) == 0 {
+			return []int{n}
+		}
+		return blockIndices(cfg.Blocks[i].Succs)
+	}
+	return &DomTree{cfg, idomToBlocks(cfg, computeIdom(n+1, n, succs, preds)[:n]), true}
+}
+
+//Dominates reports whether a (post-)dominates b. Every block dominates
+//itself.
+func (d *DomTree) Dominates(a, b *BasicBlock) bool {
+	for b != nil {
+		if a == b {
+			return true
+		}
+		b = d.Idom[b.Index]
+	}
+	return false
+}
+
+func blockIndices(blocks []*BasicBlock) []int {
+	indices := make([]int, len(blocks))
+	for i, b := range blocks {
+		indices[i] = b.Index
+	}
+	return indices
+}
+
+func idomToBlocks(cfg *CFG, idom []int) []*BasicBlock {
+	blocks := make([]*BasicBlock, len(idom))
+	for i, d := range idom {
+		if d >= 0 && d < len(cfg.Blocks) && d != i {
+			blocks[i] = cfg.Blocks[d]
+		}
+	}
+	return blocks
+}
+
+//computeIdom is the iterative algorithm of Cooper, Harvey and Kennedy over
+//a graph of n nodes. Unreachable nodes get -1, the root gets itself.
+func computeIdom(n, root int, succs, preds func(int) []int) []int {
+	//Reverse postorder from the root.
+	order := make([]int, n)
+	for i := range order {
+		order[i] = -1
+	}
+	rpo := make([]int, 0, n)
+	visited := make([]bool, n)
+	var walk func(int)
+	walk = func(i int) {
+		visited[i] = true
+		for _, s := range succs(i) {
+			if !visited[s] {
+				walk(s)
+			}
+		}
+		rpo = append(rpo, i)
+	}
+	walk(root)
+	for i, j := 0, len(rpo)-1; i < j; i, j = i+1, j-1 {
+		rpo[i], rpo[j] = rpo[j], rpo[i]
+	}
+	for k, i := range rpo {
+		order[i] = k
+	}
+
+	idom := make([]int, n)
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[root] = root
+	intersect := func(a, b int) int {
+		for a != b {
+			for order[a] > order[b] {
+				a = idom[a]
+			}
+			for order[b] > order[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, i := range rpo[1:] {
+			newIdom := -1
+			for _, p := range preds(i) {
+				if order[p] < 0 || idom[p] < 0 {
+					continue
+				}
+				if newIdom < 0 {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if newIdom != idom[i] {
+				idom[i] = newIdom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+//Loops finds the natural loops of proc. Back edges sharing a header form
+//one loop. Loops are ordered by header, outer loops first, and each knows
+//its enclosing loop and its nesting depth starting at 1.
+func (ctx *Context) Loops(proc *Procedure) []*Loop {
+	dom := ctx.Dominators(proc)
+	cfg := dom.CFG
+	byHeader := make(map[*BasicBlock]*Loop)
+	loops := make([]*Loop, 0)
+	for _, b := range cfg.Blocks {
+		for _, succ := range b.Succs {
+			if !dom.Dominates(succ, b) {
+				continue
+			}
+			loop, exists := byHeader[succ]
+			if !exists {
+				loop = &Loop{succ, []*BasicBlock{succ}, nil, nil, nil, 0}
+				byHeader[succ] = loop
+				loops = append(loops, loop)
+			}
+			loop.BackEdges = append(loop.BackEdges, b)
+			//Everything that reaches the back edge without passing
+			//through the header belongs to the loop.
+			stack := []*BasicBlock{b}
+			for len(stack) > 0 {
+				cur := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if loop.Contains(cur) {
+					continue
+				}
+				if cur != cfg.Blocks[0] && dom.Idom[cur.Index] == nil {
+					continue
+				}
+				loop.Body = append(loop.Body, cur)
+				stack = append(stack, cur.Preds...)
+			}
+		}
+	}
+
+	for _, loop := range loops {
+		sort.Sort(blocksByIndex(loop.Body))
+		for _, b := range loop.Body {
+			for _, succ := range b.Succs {
+				if !loop.Contains(succ) && !containsBlock(loop.Exits, succ) {
+					loop.Exits = append(loop.Exits, succ)
+				}
+			}
+		}
+		sort.Sort(blocksByIndex(loop.Exits))
+	}
+
+	//The parent is the smallest other loop containing the header.
+	for _, loop := range loops {
+		for _, other := range loops {
+			if other == loop || !other.Contains(loop.Header) {
+				continue
+			}
+			if loop.Parent == nil || len(other.Body) < len(loop.Parent.Body) {
+				loop.Parent = other
+			}
+		}
+	}
+	for _, loop := range loops {
+		for l := loop; l != nil; l = l.Parent {
+			loop.Depth++
+		}
+	}
+	sort.Sort(loopsByHeader(loops))
+	return loops
+}
+
+func containsBlock(blocks []*BasicBlock, b *BasicBlock) bool {
+	for _, blk := range blocks {
+		if blk == b {
+			return true
+		}
+	}
+	return false
+}
+
+type blocksByIndex []*BasicBlock
+
+func (b blocksByIndex) Len() int           { return len(b) }
+func (b blocksByIndex) Less(i, j int) bool { return b[i].Index < b[j].Index }
+func (b blocksByIndex) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+type loopsByHeader []*Loop
+
+func (l loopsByHeader) Len() int { return len(l) }
+func (l loopsByHeader) Less(i, j int) bool {
+	if l[i].Header.Index != l[j].Header.Index {
+		return l[i].Header.Index < l[j].Header.Index
+	}
+	return l[i].Depth < l[j].Depth
+}
+func (l loopsByHeader) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,86 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+//EnumRefs names the enumerator each CONST instruction of proc stands for.
+//A constant is an enum if it was attached to one in EnumConsts, is passed
+//as an argument the callee takes as an enum, is compared with or stored to
+//a variable of enum type, or is returned by a procedure whose prototype
+//returns one.
+func (ctx *Context) EnumRefs(proc *Procedure) map[int]string {
+	types := make(map[int]*CType)
+	widths := map[int]int{OP_STORE1: 1, OP_STORE2: 2, OP_STORE4: 4}
+	f := ctx.Lift(proc)
+	for _, sb := range f.Blocks {
+		for _, v := range sb.Values {
+			switch {
+			case IsBranch(v.Op):
+				for k, arg := range v.Args {
+					if arg.Op == OP_CONST {
+						types[arg.Insn] = ctx.valueCType(proc, v.Args[1-k], 0)
+					}
+				}
+			case widths[v.Op] != 0 && v.Args[1].Op == OP_CONST:
+				types[v.Args[1].Insn] = ctx.objectCType(proc, v.Args[0], widths[v.Op], 0)
+			case v.Op == OP_CALL && v.Args[0].Op == OP_CONST:
+				for k, arg := range v.Args[1:] {
+					if arg.Op == OP_CONST {
+						types[arg.Insn] = ctx.ArgCType(int(v.Args[0].Aux), k)
+					}
+				}
+			case v.Op == OP_LEAVE && len(v.Args) > 0 && v.Args[0].Op == OP_CONST:
+				if fn, exists := ctx.ProcTypes[proc.StartInstruction]; exists {
+					types[v.Args[0].Insn] = fn.Elem
+				}
+			}
+		}
+	}
+	for insn, t := range ctx.EnumConsts {
+		if insn >= proc.StartInstruction && insn < proc.StartInstruction+proc.InstructionCount {
+			types[insn] = t
+		}
+	}
+
+	refs := make(map[int]string)
+	for insn, t := range types {
+		if t == nil {
+			continue
+		}
+		if name, ok := t.EnumName(int(ctx.Insns[insn].IntArg())); ok {
+			refs[insn] = name
+		}
+	}
+	return refs
+}
+
+//ArgCType returns the C type of argument n of calls to target, a procedure
+//start or syscall number: the enum attached to it in EnumArgs, or else the
+//type the prototype of the procedure or syscall gives it. It returns nil if
+//neither does.
+func (ctx *Context) ArgCType(target, n int) *CType {
+	if t := ctx.EnumArgs[target][n]; t != nil {
+		return t
+	}
+	fn, exists := ctx.ProcTypes[target]
+	if sc, known := ctx.Syscalls[target]; target < 0 && known {
+		fn, exists = sc.Type, sc.Type != nil
+	}
+	if exists && n < len(fn.Params) {
+		return fn.Params[n].Type
+	}
+	return nil
+}
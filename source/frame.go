@@ -0,0 +1,142 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"sort"
+)
+
+//Frame is the layout of a procedure's stack frame. The first 8 bytes are
+//reserved by the VM and the outgoing arguments ARG writes follow them.
+//Slots are the locals above those, ordered by offset.
+type Frame struct {
+	ArgArea int //bytes of outgoing arguments
+	Slots   []*FrameSlot
+}
+
+//FrameSlot is a local variable. An address taken slot may be indexed, so
+//it spans to the next slot.
+type FrameSlot struct {
+	Offset, Size int
+	Type         Type
+	AddrTaken    bool
+}
+
+//Frame recovers the frame layout of proc from the widths of the loads and
+//stores to each LOCAL address, the sizes BLOCK_COPY moves and which
+//addresses are used for anything else.
+func (ctx *Context) Frame(proc *Procedure) *Frame {
+	if ctx.frames == nil {
+		ctx.frames = make(map[int]*Frame)
+	}
+	if frame, exists := ctx.frames[proc.StartInstruction]; exists {
+		return frame
+	}
+
+	frame := &Frame{0, make([]*FrameSlot, 0)}
+	for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+		if insn := ctx.Insns[i]; insn.Valid && insn.Op == OP_ARG && int(insn.IntArg())+4-8 > frame.ArgArea {
+			frame.ArgArea = int(insn.IntArg()) + 4 - 8
+		}
+	}
+
+	slots := make(map[int]*FrameSlot)
+	widths := map[int]int{OP_LOAD1: 1, OP_LOAD2: 2, OP_LOAD4: 4, OP_STORE1: 1, OP_STORE2: 2, OP_STORE4: 4}
+	f := ctx.Lift(proc)
+	for _, sb := range f.Blocks {
+		for _, v := range sb.Values {
+			for n, arg := range v.Args {
+				off := int(arg.Aux)
+				if arg.Op != OP_LOCAL || off < 8+frame.ArgArea || off >= proc.FrameSize {
+					continue
+				}
+				slot, exists := slots[off]
+				if !exists {
+					slot = &FrameSlot{off, 0, ctx.Types.Local(proc, off), false}
+					slots[off] = slot
+				}
+				size := 0
+				switch {
+				case widths[v.Op] != 0 && n == 0:
+					size = widths[v.Op]
+				case v.Op == OP_BLOCK_COPY:
+					size = int(v.Aux)
+					slot.AddrTaken = true
+				default:
+					slot.AddrTaken = true
+				}
+				if size > slot.Size {
+					slot.Size = size
+				}
+			}
+		}
+	}
+
+	offsets := make([]int, 0, len(slots))
+	for off := range slots {
+		offsets = append(offsets, off)
+	}
+	sort.Ints(offsets)
+	for i, off := range offsets {
+		slot := slots[off]
+		end := proc.FrameSize
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		if slot.AddrTaken || slot.Size > end-off {
+			slot.Size = end - off
+		}
+		if slot.Size == 0 {
+			slot.Size = 4
+		}
+		frame.Slots = append(frame.Slots, slot)
+	}
+	ctx.frames[proc.StartInstruction] = frame
+	return frame
+}
+
+//Slot returns the slot at offset off, or nil.
+func (frame *Frame) Slot(off int) *FrameSlot {
+	for _, slot := range frame.Slots {
+		if slot.Offset == off {
+			return slot
+		}
+	}
+	return nil
+}
+
+//LocalDecl declares the frame slot at offset off of proc in C with the type
+//applied to it, or else the inferred one. Slots bigger than 4 bytes are
+//arrays of their type, or of char if the type is not known or doesn't
+//divide the size.
+func (ctx *Context) LocalDecl(proc *Procedure, off int) string {
+	name := ctx.LocalName(proc, off)
+	if ct := ctx.LocalCType(proc, off); ct != nil {
+		return ct.Decl(name)
+	}
+	t := ctx.Types.Local(proc, off)
+	slot := ctx.Frame(proc).Slot(off)
+	if slot == nil || slot.Size <= 4 {
+		return cDecl(t.String(), name)
+	}
+	width := baseSizes[t]
+	if width == 0 || slot.Size%width != 0 {
+		t, width = TypeChar, 1
+	}
+	return cDecl(t.String(), fmt.Sprintf("%s[%d]", name, slot.Size/width))
+}
@@ -0,0 +1,133 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"sort"
+)
+
+//Global is a variable in the data or bss section. It spans from its
+//address to the next global or the end of its section.
+type Global struct {
+	Name string
+	Addr uint32
+	Size int
+	Type Type
+}
+
+//ParseGlobals makes a global at every data and bss address that is
+//referenced, with a default g_XXXXXXXX name. The jump tables of switch
+//statements are left out, and end the global before them.
+func (ctx *Context) ParseGlobals() error {
+	hdr := ctx.QvmFile.Header
+	bssStart := hdr.DataLength + hdr.LitLength
+	bssEnd := bssStart + hdr.BssLength
+	tables := ctx.switchTables()
+	addrs := make([]int, 0, len(ctx.DataXRefs))
+	for addr := range ctx.DataXRefs {
+		if tables.contain(addr) {
+			continue
+		}
+		if addr < hdr.DataLength || addr >= bssStart && addr < bssEnd {
+			addrs = append(addrs, int(addr))
+		}
+	}
+	sort.Ints(addrs)
+
+	ctx.Globals = make(map[uint32]*Global)
+	for i, a := range addrs {
+		addr := uint32(a)
+		end := hdr.DataLength
+		if addr >= bssStart {
+			end = bssEnd
+		}
+		if i+1 < len(addrs) && uint32(addrs[i+1]) < end {
+			end = uint32(addrs[i+1])
+		}
+		for _, table := range tables {
+			if table.start > addr && table.start < end {
+				end = table.start
+			}
+		}
+		size := int(end - addr)
+		t := ctx.Types.Global(addr)
+		if t == TypeUnknown {
+			switch {
+			case size == 1:
+				t = TypeChar
+			case size == 2:
+				t = TypeShort
+			default:
+				t = TypeInt
+			}
+		}
+		ctx.Globals[addr] = &Global{fmt.Sprintf("g_%08x", addr), addr, size, t}
+	}
+	return nil
+}
+
+//switchTable is the data a switch statement's jump table takes up. base is
+//the address the code adds the scaled value to.
+type switchTable struct {
+	base, start, end uint32
+}
+
+type switchTables []switchTable
+
+//switchTables returns the jump tables of the switch statements of every
+//procedure.
+func (ctx *Context) switchTables() switchTables {
+	tables := make(switchTables, 0)
+	for _, proc := range ctx.Procs {
+		for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+			if !ctx.Insns[i].Valid || ctx.Insns[i].Op != OP_JUMP {
+				continue
+			}
+			if sw, ok := ctx.Switch(proc, i); ok {
+				tables = append(tables, switchTable{sw.Base, sw.Table, sw.Table + 4*uint32(len(sw.Targets))})
+			}
+		}
+	}
+	return tables
+}
+
+//contain reports whether addr is the base of a table or inside one.
+func (tables switchTables) contain(addr uint32) bool {
+	for _, table := range tables {
+		if addr == table.base || addr >= table.start && addr < table.end {
+			return true
+		}
+	}
+	return false
+}
+
+//SortedGlobals returns the globals ordered by address.
+func (ctx *Context) SortedGlobals() []*Global {
+	globals := make([]*Global, 0, len(ctx.Globals))
+	for _, g := range ctx.Globals {
+		globals = append(globals, g)
+	}
+	sort.Sort(globalsByAddr(globals))
+	return globals
+}
+
+type globalsByAddr []*Global
+
+func (g globalsByAddr) Len() int           { return len(g) }
+func (g globalsByAddr) Less(i, j int) bool { return g[i].Addr < g[j].Addr }
+func (g globalsByAddr) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
@@ -0,0 +1,178 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+type callEdge struct {
+	caller, callee *Procedure
+}
+
+//ParseIndirectCalls resolves calls through function pointers kept in the
+//data section. Every aligned data word equal to a procedure's start is a
+//function pointer. The target of each CALL that isn't a constant is traced
+//back through phis and locals to the loads it came from; a load from a
+//fixed address can call the pointer stored there, and a load from an
+//indexed address can call any pointer in the table, stepping by the index
+//scale from the constant base until a word is neither a pointer nor NULL.
+//The possible targets are kept by CALL instruction in IndirectCalls and
+//added to Callers and Callees, where IsIndirect tells them apart.
+func (ctx *Context) ParseIndirectCalls() error {
+	ctx.IndirectCalls = make(map[int][]*Procedure)
+	ctx.indirectEdges = make(map[callEdge]bool)
+	pointers := make(map[uint32]*Procedure)
+	for addr := uint32(0); addr+4 <= ctx.QvmFile.Header.DataLength; addr += 4 {
+		word, ok := ctx.QvmFile.Word(addr)
+		if !ok || word == 0 {
+			continue
+		}
+		if proc, exists := ctx.Procs[int(word)]; exists {
+			pointers[addr] = proc
+		}
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+
+	for _, proc := range ctx.SortedProcs() {
+		f := ctx.Lift(proc)
+		stores := make(map[int32][]*Value)
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Values {
+				if v.Op == OP_STORE4 && v.Args[0].Op == OP_LOCAL {
+					stores[v.Args[0].Aux] = append(stores[v.Args[0].Aux], v.Args[1])
+				}
+			}
+		}
+
+		var targets []*Procedure
+		seen := make(map[*Value]bool)
+		addTarget := func(tgt *Procedure) {
+			for _, t := range targets {
+				if t == tgt {
+					return
+				}
+			}
+			targets = append(targets, tgt)
+		}
+		var trace func(v *Value)
+		trace = func(v *Value) {
+			if seen[v] {
+				return
+			}
+			seen[v] = true
+			switch {
+			case v.Op == OP_PHI:
+				for _, arg := range v.Args {
+					trace(arg)
+				}
+			case v.Op == OP_LOAD4 && v.Args[0].Op == OP_LOCAL:
+				for _, stored := range stores[v.Args[0].Aux] {
+					trace(stored)
+				}
+			case v.Op == OP_LOAD4:
+				base, stride, ok := tableAddress(v.Args[0])
+				if !ok {
+					break
+				}
+				for addr := base; addr < ctx.QvmFile.Header.DataLength; addr += stride {
+					if tgt, exists := pointers[addr]; exists {
+						addTarget(tgt)
+					} else if word, ok := ctx.QvmFile.Word(addr); !ok || word != 0 {
+						break
+					}
+					if stride == 0 {
+						break
+					}
+				}
+			}
+		}
+
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Values {
+				if v.Op != OP_CALL || v.Args[0].Op == OP_CONST {
+					continue
+				}
+				targets, seen = nil, make(map[*Value]bool)
+				trace(v.Args[0])
+				if len(targets) == 0 {
+					continue
+				}
+				ctx.IndirectCalls[v.Insn] = targets
+				for _, tgt := range targets {
+					ctx.addIndirectEdge(proc, tgt)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//tableAddress splits an address into the constant base of a table and the
+//scale of its index. The stride is 0 for a fixed address.
+func tableAddress(addr *Value) (base, stride uint32, ok bool) {
+	switch {
+	case addr.Op == OP_CONST:
+		return uint32(addr.Aux), 0, true
+	case addr.Op == OP_ADD:
+		l, r := addr.Args[0], addr.Args[1]
+		if l.Op == OP_CONST {
+			l, r = r, l
+		}
+		if r.Op != OP_CONST {
+			return 0, 0, false
+		}
+		if base, stride, ok := tableAddress(l); ok {
+			return base + uint32(r.Aux), stride, true
+		}
+		stride, ok := indexScale(l)
+		return uint32(r.Aux), stride, ok
+	}
+	return 0, 0, false
+}
+
+//indexScale is the scale an index expression multiplies by. Indexes into
+//tables of pointers are always scaled, so anything else, such as a pointer
+//the constant is an offset from, isn't an index.
+func indexScale(index *Value) (uint32, bool) {
+	switch {
+	case index.Op == OP_LSH && index.Args[1].Op == OP_CONST && index.Args[1].Aux >= 2 && index.Args[1].Aux < 16:
+		return 1 << uint(index.Args[1].Aux), true
+	case index.Op == OP_MULI || index.Op == OP_MULU:
+		for _, arg := range index.Args {
+			if arg.Op == OP_CONST && arg.Aux >= 4 && arg.Aux%4 == 0 && arg.Aux < 0x10000 {
+				return uint32(arg.Aux), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (ctx *Context) addIndirectEdge(caller, callee *Procedure) {
+	for _, c := range callee.Callers {
+		if c == caller {
+			return
+		}
+	}
+	callee.Callers = append(callee.Callers, caller)
+	caller.Callees = append(caller.Callees, callee)
+	ctx.indirectEdges[callEdge{caller, callee}] = true
+}
+
+//IsIndirect reports whether caller only calls callee through a function
+//pointer.
+func (ctx *Context) IsIndirect(caller, callee *Procedure) bool {
+	return ctx.indirectEdges[callEdge{caller, callee}]
+}
@@ -0,0 +1,359 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Module is the game module a QVM implements.
+type Module int
+
+const (
+	ModuleUnknown Module = iota
+	ModuleCgame
+	ModuleQagame
+	ModuleUI
+)
+
+var moduleNames = []string{"unknown", "cgame", "qagame", "ui"}
+
+func (m Module) String() string {
+	if m < 0 || int(m) >= len(moduleNames) {
+		return moduleNames[ModuleUnknown]
+	}
+	return moduleNames[m]
+}
+
+//ParseModule returns the module called name, accepting game for qagame.
+func ParseModule(name string) (Module, bool) {
+	name = strings.ToLower(name)
+	if name == "game" {
+		return ModuleQagame, true
+	}
+	for m, n := range moduleNames {
+		if n == name {
+			return Module(m), true
+		}
+	}
+	return ModuleUnknown, false
+}
+
+//Engine is the engine family a QVM was built for. Engines of the same
+//family agree on the syscall numbers.
+type Engine int
+
+const (
+	EngineUnknown Engine = iota
+	EngineQ3
+	EngineQuake3e
+)
+
+var engineNames = []string{"unknown", "q3", "quake3e"}
+
+func (e Engine) String() string {
+	if e < 0 || int(e) >= len(engineNames) {
+		return engineNames[EngineUnknown]
+	}
+	return engineNames[e]
+}
+
+//ParseEngine returns the engine called name.
+func ParseEngine(name string) (Engine, bool) {
+	name = strings.ToLower(name)
+	for e, n := range engineNames {
+		if n == name {
+			return Engine(e), true
+		}
+	}
+	return EngineUnknown, false
+}
+
+//moduleExport is a command the engine sends through vmMain and the function
+//handling it.
+type moduleExport struct {
+	Name, Handler string
+}
+
+//moduleExports are the vmMain commands of each module, indexed by number.
+//UI_GETAPIVERSION and UI_HASUNIQUECDKEY are answered by vmMain itself. The
+//ui handlers are named as in baseq3's q3_ui; missionpack's ui prefixes
+//them with an underscore.
+var moduleExports = map[Module][]moduleExport{
+	ModuleCgame: {
+		{"CG_INIT", "CG_Init"},
+		{"CG_SHUTDOWN", "CG_Shutdown"},
+		{"CG_CONSOLE_COMMAND", "CG_ConsoleCommand"},
+		{"CG_DRAW_ACTIVE_FRAME", "CG_DrawActiveFrame"},
+		{"CG_CROSSHAIR_PLAYER", "CG_CrosshairPlayer"},
+		{"CG_LAST_ATTACKER", "CG_LastAttacker"},
+		{"CG_KEY_EVENT", "CG_KeyEvent"},
+		{"CG_MOUSE_EVENT", "CG_MouseEvent"},
+		{"CG_EVENT_HANDLING", "CG_EventHandling"},
+	},
+	ModuleQagame: {
+		{"GAME_INIT", "G_InitGame"},
+		{"GAME_SHUTDOWN", "G_ShutdownGame"},
+		{"GAME_CLIENT_CONNECT", "ClientConnect"},
+		{"GAME_CLIENT_BEGIN", "ClientBegin"},
+		{"GAME_CLIENT_USERINFO_CHANGED", "ClientUserinfoChanged"},
+		{"GAME_CLIENT_DISCONNECT", "ClientDisconnect"},
+		{"GAME_CLIENT_COMMAND", "ClientCommand"},
+		{"GAME_CLIENT_THINK", "ClientThink"},
+		{"GAME_RUN_FRAME", "G_RunFrame"},
+		{"GAME_CONSOLE_COMMAND", "ConsoleCommand"},
+		{"BOTAI_START_FRAME", "BotAIStartFrame"},
+	},
+	ModuleUI: {
+		{"UI_GETAPIVERSION", ""},
+		{"UI_INIT", "UI_Init"},
+		{"UI_SHUTDOWN", "UI_Shutdown"},
+		{"UI_KEY_EVENT", "UI_KeyEvent"},
+		{"UI_MOUSE_EVENT", "UI_MouseEvent"},
+		{"UI_REFRESH", "UI_Refresh"},
+		{"UI_IS_FULLSCREEN", "UI_IsFullscreen"},
+		{"UI_SET_ACTIVE_MENU", "UI_SetActiveMenu"},
+		{"UI_CONSOLE_COMMAND", "UI_ConsoleCommand"},
+		{"UI_DRAW_CONNECT_SCREEN", "UI_DrawConnectScreen"},
+		{"UI_HASUNIQUECDKEY", ""},
+	},
+}
+
+//exportEnums are the names the engine headers give the command enums.
+var exportEnums = map[Module]string{
+	ModuleCgame:  "cgameExport_t",
+	ModuleQagame: "gameExport_t",
+	ModuleUI:     "uiExport_t",
+}
+
+//vmMainArgs is the number of arguments vmMain takes after the command.
+const vmMainArgs = 12
+
+//ExportEnum returns the enum of the vmMain commands of m, declaring it in
+//the type library unless a header already did. It is nil for an unknown
+//module.
+func (ctx *Context) ExportEnum(m Module) *CType {
+	name, exists := exportEnums[m]
+	if !exists {
+		return nil
+	}
+	if t, exists := ctx.TypeLib.Lookup(name); exists && t.Resolve().Kind == CEnum {
+		return t
+	}
+	members := make([]string, len(moduleExports[m]))
+	for n, export := range moduleExports[m] {
+		members[n] = export.Name
+	}
+	t, err := ctx.TypeLib.DefineEnum(name, members)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+//Dispatch recovers the handler vmMain calls for each command. The command
+//is argument 0, or a local it is copied to, and vmMain branches on it with
+//a switch table or a chain of comparisons. A command's handler is the first
+//procedure called on the straight path from where it lands.
+func (ctx *Context) Dispatch() map[int32]*Procedure {
+	dispatch := make(map[int32]*Procedure)
+	proc, exists := ctx.Procs[0]
+	if !exists {
+		return dispatch
+	}
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+
+	commands := ctx.commandLocals(proc)
+	isCommand := func(from, to int) bool {
+		return to == from+1 && ctx.Insns[from].Op == OP_LOCAL && commands[ctx.Insns[from].IntArg()] && ctx.Insns[to].Op == OP_LOAD4
+	}
+
+	targets := make(map[int32]int)
+	for i := start + 3; i < end; i++ {
+		insn := ctx.Insns[i]
+		switch {
+		case !insn.Valid:
+		case (insn.Op == OP_EQ || insn.Op == OP_NE) && ctx.Insns[i-1].Op == OP_CONST && isCommand(i-3, i-2):
+			tgt := int(insn.IntArg())
+			if insn.Op == OP_NE {
+				tgt = i + 1
+			}
+			if _, exists := targets[ctx.Insns[i-1].IntArg()]; !exists {
+				targets[ctx.Insns[i-1].IntArg()] = tgt
+			}
+		case insn.Op == OP_JUMP:
+			sw, ok := ctx.Switch(proc, i)
+			if !ok || !isCommand(sw.ValueStart, sw.ValueEnd) {
+				continue
+			}
+			for k, tgt := range sw.Targets {
+				if _, exists := targets[sw.Low+int32(k)]; !exists && tgt != sw.Default {
+					targets[sw.Low+int32(k)] = tgt
+				}
+			}
+		}
+	}
+	for cmd, tgt := range targets {
+		if handler := ctx.firstCall(proc, tgt); handler != nil {
+			dispatch[cmd] = handler
+		}
+	}
+	return dispatch
+}
+
+//commandLocals returns the frame offsets of the vmMain command: argument 0
+//and the locals it is copied to.
+func (ctx *Context) commandLocals(proc *Procedure) map[int32]bool {
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+	commands := map[int32]bool{int32(proc.FrameSize + 8): true}
+	for i := start; i+3 < end; i++ {
+		if ctx.Insns[i].Op == OP_LOCAL && ctx.Insns[i+1].Op == OP_LOCAL && ctx.Insns[i+2].Op == OP_LOAD4 && ctx.Insns[i+3].Op == OP_STORE4 && commands[ctx.Insns[i+1].IntArg()] {
+			commands[ctx.Insns[i].IntArg()] = true
+		}
+	}
+	return commands
+}
+
+//firstCall returns the procedure called first on the straight path from
+//instruction at, following constant JUMPs, or nil if the path branches or
+//returns before.
+func (ctx *Context) firstCall(proc *Procedure, at int) *Procedure {
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+	for steps := 0; at > start && at < end && steps < proc.InstructionCount; steps++ {
+		insn := ctx.Insns[at]
+		switch {
+		case !insn.Valid, insn.Op == OP_LEAVE, IsBranch(insn.Op):
+			return nil
+		case insn.Op == OP_CALL:
+			if ctx.Insns[at-1].Op == OP_CONST {
+				if callee, exists := ctx.Procs[int(ctx.Insns[at-1].IntArg())]; exists {
+					return callee
+				}
+			}
+		case insn.Op == OP_JUMP:
+			if ctx.Insns[at-1].Op != OP_CONST {
+				return nil
+			}
+			at = int(ctx.Insns[at-1].IntArg())
+			continue
+		}
+		at++
+	}
+	return nil
+}
+
+//NameEntry declares the prototype of vmMain, with the command enum of m
+//unless the type library has one, and names the handlers of the commands
+//that still have their default names, or those of another module's
+//handlers, after the engine's functions. A prototype or command local typed
+//with the command enum of another module is retyped. It returns the new names by procedure start.
+func (ctx *Context) NameEntry(m Module) map[int]string {
+	enum := ctx.ExportEnum(m)
+	var want *CType
+	if enum != nil {
+		want = enum.Resolve()
+	}
+	fn, exists := ctx.TypeLib.Funcs["vmMain"]
+	if !exists || want != nil && commandEnum(fn) != want {
+		command := "int"
+		if enum != nil {
+			command = enum.Name
+		}
+		params := []string{command + " command"}
+		for n := 0; n < vmMainArgs; n++ {
+			params = append(params, fmt.Sprintf("int arg%d", n))
+		}
+		ctx.TypeLib.Parse(fmt.Sprintf("int vmMain(%s);", strings.Join(params, ", ")))
+		fn = ctx.TypeLib.Funcs["vmMain"]
+	}
+	if t, typed := ctx.ProcTypes[0]; fn != nil && (!typed || want != nil && commandEnum(t) != want) {
+		ctx.ApplyPrototype(ctx.Procs[0], fn)
+	}
+	//The copies of the command get its type too.
+	if enum != nil {
+		if ctx.LocalTypes[0] == nil {
+			ctx.LocalTypes[0] = make(map[int]*CType)
+		}
+		for off := range ctx.commandLocals(ctx.Procs[0]) {
+			if t, typed := ctx.LocalTypes[0][int(off)]; !typed || t.Resolve() != want && isExportEnum(t) {
+				ctx.LocalTypes[0][int(off)] = enum
+			}
+		}
+	}
+
+	renames := make(map[int]string)
+	exports := moduleExports[m]
+	for cmd, proc := range ctx.Dispatch() {
+		if cmd < 0 || int(cmd) >= len(exports) || exports[cmd].Handler == "" {
+			continue
+		}
+		named := proc.Name != fmt.Sprintf("sub_%08x", proc.StartInstruction) && !isExportHandler(proc.Name)
+		if named || ctx.ProcNamed(exports[cmd].Handler) != nil {
+			continue
+		}
+		proc.Name = exports[cmd].Handler
+		renames[proc.StartInstruction] = proc.Name
+	}
+	return renames
+}
+
+//commandEnum returns the enum the vmMain prototype fn takes the command
+//as, or nil.
+func commandEnum(fn *CType) *CType {
+	if fn.Kind != CFunc || len(fn.Params) == 0 || fn.Params[0].Type.Resolve().Kind != CEnum {
+		return nil
+	}
+	return fn.Params[0].Type.Resolve()
+}
+
+//isExportEnum reports whether t is the command enum of a module.
+func isExportEnum(t *CType) bool {
+	t = t.Resolve()
+	if t == nil || t.Kind != CEnum {
+		return false
+	}
+	for _, name := range exportEnums {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//isExportHandler reports whether name is the handler of a vmMain command
+//of any module.
+func isExportHandler(name string) bool {
+	for _, exports := range moduleExports {
+		for _, export := range exports {
+			if export.Handler != "" && export.Handler == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//ProcNamed returns the procedure called name, or nil.
+func (ctx *Context) ProcNamed(name string) *Procedure {
+	for _, proc := range ctx.Procs {
+		if proc.Name == name {
+			return proc
+		}
+	}
+	return nil
+}
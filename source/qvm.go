@@ -43,12 +43,14 @@ type Header struct {
 }
 
 //Pretty simple, File has a header and the three sections normally embedded
-//in a QVM file.
+//in a QVM file. VM_MAGIC_VER2 files also carry a JumpTable listing the
+//instruction numbers computed jumps may land on.
 type File struct {
-	Header Header
-	Code   []byte
-	Data   []byte
-	Lit    []byte
+	Header    Header
+	Code      []byte
+	Data      []byte
+	Lit       []byte
+	JumpTable []byte
 }
 
 //Also simple. Takes an io.Reader and creates a File from it.
@@ -57,7 +59,7 @@ type File struct {
 func NewFile(r io.ReaderAt) (*File, error) {
 
 	//Read the header...
-	f := &File{Header{}, nil, nil, nil}
+	f := &File{Header{}, nil, nil, nil, nil}
 	hdr := make([]byte, 36)
 	if _, err := r.ReadAt(hdr, 0); err != nil {
 		return nil, err
@@ -110,5 +112,68 @@ func NewFile(r io.ReaderAt) (*File, error) {
 		return nil, err
 	}
 
+	//Archives saved before the jump table was kept end at lit, so a
+	//missing or short table is taken as empty.
+	if f.Header.Magic == VM_MAGIC_VER2 {
+		f.JumpTable = make([]byte, f.Header.JumpTableLength)
+		if _, err := r.ReadAt(f.JumpTable, int64(f.Header.DataOffset+f.Header.DataLength+f.Header.LitLength)); err == io.EOF {
+			f.JumpTable = f.JumpTable[:0]
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
 	return f, nil
 }
+
+//DataMask returns the mask the engine applies to every data access. The
+//engine rounds the combined data, lit and bss length up to a power of two
+//and allocates that much memory for the image.
+func (f *File) DataMask() uint32 {
+	length := f.Header.DataLength + f.Header.LitLength + f.Header.BssLength
+	size := uint32(1)
+	for size < length {
+		size <<= 1
+	}
+	return size - 1
+}
+
+//JumpTableTargets decodes the VM_MAGIC_VER2 jump table into instruction
+//numbers.
+func (f *File) JumpTableTargets() []int {
+	targets := make([]int, 0, len(f.JumpTable)/4)
+	for i := 0; i+4 <= len(f.JumpTable); i += 4 {
+		targets = append(targets, int(binary.LittleEndian.Uint32(f.JumpTable[i:])))
+	}
+	return targets
+}
+
+//Word reads the little endian 32 bit word at addr of the initialized part
+//of the image, data followed by lit. The second result is false if the
+//word isn't entirely inside it.
+func (f *File) Word(addr uint32) (uint32, bool) {
+	if addr < uint32(len(f.Data)) {
+		if uint64(addr)+4 > uint64(len(f.Data)) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(f.Data[addr:]), true
+	}
+	addr -= uint32(len(f.Data))
+	if uint64(addr)+4 > uint64(len(f.Lit)) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(f.Lit[addr:]), true
+}
+
+//Byte reads the byte at addr of the initialized part of the image. The
+//second result is false if addr isn't inside it.
+func (f *File) Byte(addr uint32) (byte, bool) {
+	if addr < uint32(len(f.Data)) {
+		return f.Data[addr], true
+	}
+	addr -= uint32(len(f.Data))
+	if addr >= uint32(len(f.Lit)) {
+		return 0, false
+	}
+	return f.Lit[addr], true
+}
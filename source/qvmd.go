@@ -21,15 +21,71 @@ import (
 	"encoding/binary"
 	"fmt"
 	"qvm"
+	"sort"
 	"strings"
 )
 
 const (
-	OP_ENTER = 3
-	OP_CALL  = 5
-	OP_CONST = 8
-	OP_LOCAL = 9
-	OP_JUMP  = 10
+	OP_UNDEF = iota
+	OP_IGNORE
+	OP_BREAK
+	OP_ENTER
+	OP_LEAVE
+	OP_CALL
+	OP_PUSH
+	OP_POP
+	OP_CONST
+	OP_LOCAL
+	OP_JUMP
+	OP_EQ
+	OP_NE
+	OP_LTI
+	OP_LEI
+	OP_GTI
+	OP_GEI
+	OP_LTU
+	OP_LEU
+	OP_GTU
+	OP_GEU
+	OP_EQF
+	OP_NEF
+	OP_LTF
+	OP_LEF
+	OP_GTF
+	OP_GEF
+	OP_LOAD1
+	OP_LOAD2
+	OP_LOAD4
+	OP_STORE1
+	OP_STORE2
+	OP_STORE4
+	OP_ARG
+	OP_BLOCK_COPY
+	OP_SEX8
+	OP_SEX16
+	OP_NEGI
+	OP_ADD
+	OP_SUB
+	OP_DIVI
+	OP_DIVU
+	OP_MODI
+	OP_MODU
+	OP_MULI
+	OP_MULU
+	OP_BAND
+	OP_BOR
+	OP_BXOR
+	OP_BCOM
+	OP_LSH
+	OP_RSHI
+	OP_RSHU
+	OP_NEGF
+	OP_ADDF
+	OP_SUBF
+	OP_DIVF
+	OP_MULF
+	OP_CVIF
+	OP_CVFI
 )
 
 var MnemonicTable = []string{
@@ -57,11 +113,29 @@ var ArgTable = []int{
 	0, 0, 0, 0, 0, 0}
 
 type Context struct {
-	QvmFile  *qvm.File
-	Insns    []Instruction
-	Procs    map[int]*Procedure
-	Strings  map[int]string
-	Syscalls map[int]Syscall
+	QvmFile       *qvm.File
+	Insns         []Instruction
+	Procs         map[int]*Procedure
+	Strings       map[int]string
+	Syscalls      map[int]Syscall
+	Types         *TypeInfo
+	DataXRefs     map[uint32][]DataXRef //by referenced address
+	Globals       map[uint32]*Global
+	IndirectCalls map[int][]*Procedure   //possible targets by CALL instruction
+	LocalNames    map[int]map[int]string //renamed frame slots by procedure start, then offset
+	TypeLib       *TypeLib
+	GlobalTypes   map[uint32]*CType
+	LocalTypes    map[int]map[int]*CType //by procedure start, then frame offset
+	ProcTypes     map[int]*CType         //prototypes by procedure start
+	EnumConsts    map[int]*CType         //enums attached to CONST instructions
+	EnumArgs      map[int]map[int]*CType //enums of arguments by call target, then argument
+	Module        Module
+	Engine        Engine
+	indirectEdges map[callEdge]bool
+	recovered     map[typeVar]bool //variables RecoverStructs typed
+	cfgs          map[int]*CFG
+	frames        map[int]*Frame
+	ssas          map[int]*SSAFunc
 }
 
 type Instruction struct {
@@ -75,16 +149,26 @@ type Procedure struct {
 	StartInstruction, StartOffset, InstructionCount, FrameSize int
 	Callers                                                    []*Procedure
 	Callees                                                    []*Procedure
+	Params                                                     int
+	Varargs, Returns                                           bool
 }
 
 type Syscall struct {
 	Name string
-	Argc int
+	Argc int    //-1 if unknown
+	Type *CType //prototype of the wrapper, nil if unknown
 }
 
 func NewContext(qvmFile *qvm.File, parseNow bool) (*Context, error) {
 	ctx := new(Context)
 	ctx.QvmFile = qvmFile
+	ctx.TypeLib = NewTypeLib()
+	ctx.GlobalTypes = make(map[uint32]*CType)
+	ctx.LocalTypes = make(map[int]map[int]*CType)
+	ctx.ProcTypes = make(map[int]*CType)
+	ctx.EnumConsts = make(map[int]*CType)
+	ctx.EnumArgs = make(map[int]map[int]*CType)
+	ctx.recovered = make(map[typeVar]bool)
 	if !parseNow {
 		return ctx, nil
 	}
@@ -98,18 +182,38 @@ func NewContext(qvmFile *qvm.File, parseNow bool) (*Context, error) {
 	if err := ctx.ParseCodeXRefs(); err != nil {
 		return nil, err
 	}
+	if err := ctx.ParseIndirectCalls(); err != nil {
+		return nil, err
+	}
 	if err := ctx.ParseStrings(); err != nil {
 		return nil, err
 	}
+	if err := ctx.ParseSignatures(); err != nil {
+		return nil, err
+	}
+	if err := ctx.ParseTypes(); err != nil {
+		return nil, err
+	}
+	if err := ctx.ParseDataXRefs(); err != nil {
+		return nil, err
+	}
+	if err := ctx.ParseGlobals(); err != nil {
+		return nil, err
+	}
 
 	return ctx, nil
 }
 
 func (ctx *Context) ParseInstructions() error {
 	ctx.Insns = make([]Instruction, 0)
+	code := ctx.QvmFile.Code
 	for i, off := 0, 0; i < int(ctx.QvmFile.Header.InstructionCount); i++ {
-		op := ctx.QvmFile.Code[off]
-		if int(op) >= len(MnemonicTable) {
+		//Stop at the end of the code. The verifier reports the shortfall.
+		if off >= len(code) {
+			break
+		}
+		op := code[off]
+		if int(op) >= len(MnemonicTable) || off+ArgTable[op] >= len(code) {
 			ctx.Insns = append(ctx.Insns, Instruction{int(op), off, nil, false})
 			off++
 			continue
@@ -118,9 +222,9 @@ func (ctx *Context) ParseInstructions() error {
 		case 0:
 			ctx.Insns = append(ctx.Insns, Instruction{int(op), off, nil, true})
 		case 1:
-			ctx.Insns = append(ctx.Insns, Instruction{int(op), off, []byte{ctx.QvmFile.Code[off+1]}, true})
+			ctx.Insns = append(ctx.Insns, Instruction{int(op), off, []byte{code[off+1]}, true})
 		case 4:
-			ctx.Insns = append(ctx.Insns, Instruction{int(op), off, []byte{ctx.QvmFile.Code[off+1], ctx.QvmFile.Code[off+2], ctx.QvmFile.Code[off+3], ctx.QvmFile.Code[off+4]}, true})
+			ctx.Insns = append(ctx.Insns, Instruction{int(op), off, []byte{code[off+1], code[off+2], code[off+3], code[off+4]}, true})
 		}
 		off += 1 + ArgTable[op]
 	}
@@ -129,6 +233,12 @@ func (ctx *Context) ParseInstructions() error {
 
 func (ctx *Context) ParseProcedures() error {
 	ctx.Procs = make(map[int]*Procedure, 0)
+	if len(ctx.Insns) == 0 {
+		return fmt.Errorf("No instructions to split into procedures")
+	}
+	//Instruction 0 always starts a procedure, even if it isn't an ENTER,
+	//so that broken files can still be inspected.
+	ctx.Procs[0] = &Procedure{"sub_00000000", 0, 0, 0, 0, nil, nil, 0, false, false}
 	lastIndex := 0
 	for i, insn := range ctx.Insns {
 		if insn.Op == OP_ENTER {
@@ -138,18 +248,20 @@ func (ctx *Context) ParseProcedures() error {
 			if err != nil {
 				return fmt.Errorf("Error parsing ENTER instruction at %d(0x%x): %s", i, int(ctx.QvmFile.Header.CodeOffset)+insn.Offset, err)
 			}
-			ctx.Procs[i] = &Procedure{fmt.Sprintf("sub_%08x", i), i, insn.Offset, 0, int(frameSize), nil, nil}
+			ctx.Procs[i] = &Procedure{fmt.Sprintf("sub_%08x", i), i, insn.Offset, 0, int(frameSize), nil, nil, 0, false, false}
 			ctx.Procs[lastIndex].InstructionCount = i - ctx.Procs[lastIndex].StartInstruction
 			lastIndex = i
 		}
 	}
 	ctx.Procs[lastIndex].InstructionCount = len(ctx.Insns) - ctx.Procs[lastIndex].StartInstruction
+	//The engine enters every QVM at instruction 0.
+	ctx.Procs[0].Name = "vmMain"
 	return nil
 }
 
 func (ctx *Context) ParseCodeXRefs() error {
 	for _, proc := range ctx.Procs {
-		for i := proc.StartInstruction; i < proc.StartInstruction+proc.InstructionCount; i++ {
+		for i := proc.StartInstruction; i+1 < proc.StartInstruction+proc.InstructionCount; i++ {
 			if ctx.Insns[i].Op == OP_CONST && ctx.Insns[i+1].Op == OP_CALL {
 				tgtBuf := bytes.NewBuffer(ctx.Insns[i].Arg)
 				var target int32
@@ -210,3 +322,41 @@ func (insn Instruction) ArgLength() int {
 	}
 	return ArgTable[insn.Op]
 }
+
+//ProcAt returns the procedure containing instruction insn, or nil.
+func (ctx *Context) ProcAt(insn int) *Procedure {
+	for _, proc := range ctx.Procs {
+		if insn >= proc.StartInstruction && insn < proc.StartInstruction+proc.InstructionCount {
+			return proc
+		}
+	}
+	return nil
+}
+
+//IntArg returns the instruction's argument as a signed integer. Instructions
+//without an argument return 0.
+func (insn Instruction) IntArg() int32 {
+	switch len(insn.Arg) {
+	case 1:
+		return int32(insn.Arg[0])
+	case 4:
+		return int32(binary.LittleEndian.Uint32(insn.Arg))
+	}
+	return 0
+}
+
+//SortedProcs returns the procedures ordered by their start instruction.
+func (ctx *Context) SortedProcs() []*Procedure {
+	procs := make([]*Procedure, 0, len(ctx.Procs))
+	for _, proc := range ctx.Procs {
+		procs = append(procs, proc)
+	}
+	sort.Sort(procsByStart(procs))
+	return procs
+}
+
+type procsByStart []*Procedure
+
+func (p procsByStart) Len() int           { return len(p) }
+func (p procsByStart) Less(i, j int) bool { return p[i].StartInstruction < p[j].StartInstruction }
+func (p procsByStart) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
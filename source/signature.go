@@ -0,0 +1,136 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+//ParseSignatures infers the signature of every procedure. Params is the
+//larger of the arguments the procedure reads through LOCAL and the fewest
+//arguments any call site passes; call sites passing different counts make
+//it Varargs. It Returns a value if a caller uses the result of a call to
+//it, or if a LEAVE returns something other than what PUSH leaves for void
+//functions.
+func (ctx *Context) ParseSignatures() error {
+	callArgs := make(map[int][]int)
+	resultUsed := make(map[int]bool)
+	for _, proc := range ctx.SortedProcs() {
+		f := ctx.Lift(proc)
+		used := make(map[*Value]bool)
+		for _, sb := range f.Blocks {
+			for _, v := range append(append([]*Value(nil), sb.Phis...), sb.Values...) {
+				for _, arg := range v.Args {
+					used[arg] = true
+				}
+			}
+		}
+		proc.Params, proc.Varargs, proc.Returns = 0, false, false
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Values {
+				switch v.Op {
+				case OP_LOCAL:
+					if n, ok := argIndex(proc, int(v.Aux)); ok && n >= proc.Params {
+						proc.Params = n + 1
+					}
+				case OP_LEAVE:
+					if v.Args[0].Op != OP_PUSH {
+						proc.Returns = true
+					}
+				case OP_CALL:
+					tgt := v.Args[0]
+					if tgt.Op != OP_CONST || tgt.Aux < 0 {
+						break
+					}
+					if _, exists := ctx.Procs[int(tgt.Aux)]; !exists {
+						break
+					}
+					callArgs[int(tgt.Aux)] = append(callArgs[int(tgt.Aux)], len(v.Args)-1)
+					if used[v] {
+						resultUsed[int(tgt.Aux)] = true
+					}
+				}
+			}
+		}
+	}
+
+	for start, proc := range ctx.Procs {
+		if counts := callArgs[start]; len(counts) > 0 {
+			fewest := counts[0]
+			for _, argc := range counts {
+				if argc != fewest {
+					proc.Varargs = true
+				}
+				if argc < fewest {
+					fewest = argc
+				}
+			}
+			if fewest > proc.Params {
+				proc.Params = fewest
+			}
+		}
+		if resultUsed[start] {
+			proc.Returns = true
+		}
+	}
+	return nil
+}
+
+//Signature prints the C prototype of proc, with the inferred types if
+//ParseTypes ran.
+func (ctx *Context) Signature(proc *Procedure) string {
+	if fn, exists := ctx.ProcTypes[proc.StartInstruction]; exists {
+		params := make([]string, 0, len(fn.Params)+1)
+		for n := range fn.Params {
+			params = append(params, ctx.LocalDecl(proc, proc.FrameSize+8+4*n))
+		}
+		if fn.Variadic {
+			params = append(params, "...")
+		}
+		if len(params) == 0 {
+			params = append(params, "void")
+		}
+		return fn.Elem.Decl(fmt.Sprintf("%s(%s)", proc.Name, strings.Join(params, ", ")))
+	}
+	ret := "void"
+	if proc.Returns {
+		ret = TypeInt.String()
+		if ctx.Types != nil {
+			ret = ctx.Types.Returns[proc.StartInstruction].String()
+		}
+	}
+	params := make([]string, 0, proc.Params+1)
+	for n := 0; n < proc.Params; n++ {
+		params = append(params, ctx.LocalDecl(proc, proc.FrameSize+8+4*n))
+	}
+	if proc.Varargs {
+		params = append(params, "...")
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	return fmt.Sprintf("%s(%s)", cDecl(ret, proc.Name), strings.Join(params, ", "))
+}
+
+//cDecl declares name with the C type typ.
+func cDecl(typ, name string) string {
+	if strings.HasSuffix(typ, "*") {
+		return typ + name
+	}
+	return typ + " " + name
+}
@@ -0,0 +1,544 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//OP_PHI is the opcode of IR phi nodes, which have no QVM counterpart.
+const OP_PHI = OP_CVFI + 1
+
+//Value is a value of the SSA IR, defined exactly once. Op is the QVM opcode
+//it was lifted from, or OP_PHI. Aux holds the operand of CONST, LOCAL, ARG,
+//BLOCK_COPY and the branches, and the op stack slot a phi merges. For
+//CALL, Args[0] is the target and Args[1+n] is argument n, OP_UNDEF where
+//no ARG set it. Args of a phi are in the order of its block's Preds. Insn
+//is -1 for phis.
+//
+//Values read the op stack only through Args: memory, frame and globals
+//alike, is only accessed by explicit loads, stores and BLOCK_COPY, with
+//LOCAL giving frame addresses.
+type Value struct {
+	ID    int
+	Op    int
+	Aux   int32
+	Args  []*Value
+	Block *SSABlock
+	Insn  int
+}
+
+//SSABlock is the IR of one reachable BasicBlock. Phis merge the op stack
+//slots live on entry when there is more than one predecessor. A block
+//ending in a branch, JUMP or LEAVE has that as its last value.
+type SSABlock struct {
+	Index  int
+	Block  *BasicBlock
+	Phis   []*Value
+	Values []*Value
+	Succs  []*SSABlock
+	Preds  []*SSABlock
+	exit   []*Value
+}
+
+//SSAFunc is the IR of a procedure. Blocks are in CFG order, unreachable
+//blocks are left out. Lift hands out one SSAFunc per procedure to every
+//analysis, so it must not be changed.
+type SSAFunc struct {
+	Proc      *Procedure
+	Blocks    []*SSABlock
+	NumValues int
+	dom       *DomTree
+}
+
+//HasResult reports whether v produces a value other values can use.
+func (v *Value) HasResult() bool {
+	if v.Op == OP_PHI || v.Op == OP_UNDEF {
+		return true
+	}
+	_, pushes := StackEffect(v.Op)
+	return pushes > 0
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+//Lift returns proc in SSA form, converting it on first use.
+func (ctx *Context) Lift(proc *Procedure) *SSAFunc {
+	if ctx.ssas == nil {
+		ctx.ssas = make(map[int]*SSAFunc)
+	}
+	if f, exists := ctx.ssas[proc.StartInstruction]; exists {
+		return f
+	}
+	f := ctx.lift(proc)
+	ctx.ssas[proc.StartInstruction] = f
+	return f
+}
+
+//lift converts proc to SSA form.
+func (ctx *Context) lift(proc *Procedure) *SSAFunc {
+	cfg := ctx.CFG(proc)
+	si := ctx.AnalyzeStack(proc)
+	dom := ctx.Dominators(proc)
+	f := &SSAFunc{proc, nil, 0, dom}
+	newValue := func(b *SSABlock, op int, aux int32, insn int, args ...*Value) *Value {
+		v := &Value{f.NumValues, op, aux, args, b, insn}
+		f.NumValues++
+		return v
+	}
+
+	byBlock := make(map[*BasicBlock]*SSABlock)
+	for _, b := range cfg.Blocks {
+		if _, reachable := si.DepthAt(b.Start); !reachable {
+			continue
+		}
+		sb := &SSABlock{Index: len(f.Blocks), Block: b}
+		f.Blocks = append(f.Blocks, sb)
+		byBlock[b] = sb
+	}
+	for _, sb := range f.Blocks {
+		for _, succ := range sb.Block.Succs {
+			if ssucc, exists := byBlock[succ]; exists {
+				sb.Succs = append(sb.Succs, ssucc)
+				ssucc.Preds = append(ssucc.Preds, sb)
+			}
+		}
+	}
+
+	//A dominator comes before the blocks it dominates in reverse postorder,
+	//so a block with a single predecessor finds its entry stack ready.
+	for _, sb := range ssaReversePostorder(f) {
+		depth, _ := si.DepthAt(sb.Block.Start)
+		stack := make([]*Value, 0, depth)
+		switch {
+		case len(sb.Preds) == 1 && sb.Preds[0].exit != nil:
+			stack = append(stack, sb.Preds[0].exit...)
+		case depth > 0:
+			for k := 0; k < depth; k++ {
+				phi := newValue(sb, OP_PHI, int32(k), -1)
+				sb.Phis = append(sb.Phis, phi)
+				stack = append(stack, phi)
+			}
+		}
+		for len(stack) > depth {
+			stack = stack[1:]
+		}
+		for len(stack) < depth {
+			undef := newValue(sb, OP_UNDEF, 0, sb.Block.Start)
+			sb.Values = append(sb.Values, undef)
+			stack = append([]*Value{undef}, stack...)
+		}
+		ctx.liftBlock(sb, stack, newValue)
+	}
+
+	//Fill in the phis now that every exit stack is known.
+	for _, sb := range f.Blocks {
+		for _, phi := range sb.Phis {
+			for _, pred := range sb.Preds {
+				slot := int(phi.Aux)
+				if slot < len(pred.exit) {
+					phi.Args = append(phi.Args, pred.exit[slot])
+					continue
+				}
+				undef := newValue(pred, OP_UNDEF, 0, pred.Block.Last())
+				pred.insertBeforeEnd(undef)
+				phi.Args = append(phi.Args, undef)
+			}
+		}
+	}
+	f.removeTrivialPhis()
+
+	//Number the values in the order they are printed.
+	f.NumValues = 0
+	for _, sb := range f.Blocks {
+		for _, v := range append(append([]*Value(nil), sb.Phis...), sb.Values...) {
+			v.ID = f.NumValues
+			f.NumValues++
+		}
+	}
+	return f
+}
+
+//ssaReversePostorder orders the blocks of f from the entry, a block before
+//its successors except along back edges.
+func ssaReversePostorder(f *SSAFunc) []*SSABlock {
+	order := make([]*SSABlock, 0, len(f.Blocks))
+	visited := make(map[*SSABlock]bool)
+	var walk func(*SSABlock)
+	walk = func(sb *SSABlock) {
+		visited[sb] = true
+		for _, succ := range sb.Succs {
+			if !visited[succ] {
+				walk(succ)
+			}
+		}
+		order = append(order, sb)
+	}
+	if len(f.Blocks) > 0 {
+		walk(f.Blocks[0])
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+//insertBeforeEnd adds v to sb, keeping a branch, JUMP or LEAVE last.
+func (sb *SSABlock) insertBeforeEnd(v *Value) {
+	n := len(sb.Values)
+	if n > 0 && isTerminator(sb.Values[n-1].Op) {
+		sb.Values = append(sb.Values[:n-1], v, sb.Values[n-1])
+		return
+	}
+	sb.Values = append(sb.Values, v)
+}
+
+//ssaStackEffect is StackEffect, except that LEAVE takes the return value.
+func ssaStackEffect(op int) (pops, pushes int) {
+	if op == OP_LEAVE {
+		return 1, 0
+	}
+	return StackEffect(op)
+}
+
+func isTerminator(op int) bool {
+	return IsBranch(op) || op == OP_JUMP || op == OP_LEAVE
+}
+
+func (ctx *Context) liftBlock(sb *SSABlock, stack []*Value, newValue func(*SSABlock, int, int32, int, ...*Value) *Value) {
+	args := make(map[int32]*Value)
+	for i := sb.Block.Start; i < sb.Block.End; i++ {
+		insn := ctx.Insns[i]
+		if !insn.Valid || insn.Op == OP_ENTER || insn.Op == OP_IGNORE || insn.Op == OP_BREAK {
+			continue
+		}
+		pops, pushes := ssaStackEffect(insn.Op)
+		operands := make([]*Value, pops)
+		for k := pops - 1; k >= 0; k-- {
+			if len(stack) == 0 {
+				operands[k] = newValue(sb, OP_UNDEF, 0, i)
+				sb.Values = append(sb.Values, operands[k])
+				continue
+			}
+			operands[k] = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		}
+		if insn.Op == OP_POP {
+			continue
+		}
+
+		var aux int32
+		switch insn.Op {
+		case OP_CONST, OP_LOCAL, OP_ARG, OP_BLOCK_COPY:
+			aux = insn.IntArg()
+		default:
+			if IsBranch(insn.Op) {
+				aux = insn.IntArg()
+			}
+		}
+		v := newValue(sb, insn.Op, aux, i, operands...)
+
+		switch insn.Op {
+		case OP_ARG:
+			if old, exists := args[aux]; exists {
+				//Overwritten before any call could see it.
+				sb.removeValue(old)
+			}
+			args[aux] = v
+		case OP_CALL:
+			//The ARGs set since the last call become the argument list.
+			offsets := make([]int, 0, len(args))
+			for off := range args {
+				offsets = append(offsets, int(off))
+			}
+			sort.Ints(offsets)
+			for _, off := range offsets {
+				n := (off - 8) / 4
+				if off < 8 || (off-8)%4 != 0 || n >= maxArgs {
+					continue
+				}
+				for len(v.Args) < 1+n {
+					undef := newValue(sb, OP_UNDEF, 0, i)
+					sb.Values = append(sb.Values, undef)
+					v.Args = append(v.Args, undef)
+				}
+				v.Args = append(v.Args, args[int32(off)].Args[0])
+				delete(args, int32(off))
+			}
+			//ARGs that didn't fit a position stay in the block.
+			kept := make(map[*Value]bool)
+			for _, arg := range args {
+				kept[arg] = true
+			}
+			values := make([]*Value, 0, len(sb.Values))
+			for _, val := range sb.Values {
+				if val.Op != OP_ARG || kept[val] {
+					values = append(values, val)
+				}
+			}
+			sb.Values = values
+			args = make(map[int32]*Value)
+		}
+		sb.Values = append(sb.Values, v)
+		if pushes > 0 {
+			stack = append(stack, v)
+		}
+	}
+	sb.exit = stack
+}
+
+func (sb *SSABlock) removeValue(v *Value) {
+	for k, val := range sb.Values {
+		if val == v {
+			sb.Values = append(sb.Values[:k], sb.Values[k+1:]...)
+			return
+		}
+	}
+}
+
+//removeTrivialPhis replaces phis whose arguments are all the same value, or
+//the phi itself, by that value.
+func (f *SSAFunc) removeTrivialPhis() {
+	for changed := true; changed; {
+		changed = false
+		replace := make(map[*Value]*Value)
+		for _, sb := range f.Blocks {
+			phis := make([]*Value, 0, len(sb.Phis))
+			for _, phi := range sb.Phis {
+				var same *Value
+				trivial := true
+				for _, arg := range phi.Args {
+					if arg == phi || arg == same {
+						continue
+					}
+					if same != nil {
+						trivial = false
+						break
+					}
+					same = arg
+				}
+				if trivial && same != nil {
+					replace[phi] = same
+					changed = true
+					continue
+				}
+				phis = append(phis, phi)
+			}
+			sb.Phis = phis
+		}
+		if !changed {
+			break
+		}
+		resolve := func(v *Value) *Value {
+			for {
+				r, exists := replace[v]
+				if !exists {
+					return v
+				}
+				v = r
+			}
+		}
+		for _, sb := range f.Blocks {
+			for _, v := range append(append([]*Value(nil), sb.Phis...), sb.Values...) {
+				for k, arg := range v.Args {
+					v.Args[k] = resolve(arg)
+				}
+			}
+			for k, v := range sb.exit {
+				sb.exit[k] = resolve(v)
+			}
+		}
+	}
+}
+
+//String prints the IR of f, one block after the other.
+func (f *SSAFunc) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s:\n", f.Proc.Name)
+	names := func(blocks []*SSABlock) string {
+		if len(blocks) == 0 {
+			return "-"
+		}
+		s := make([]string, len(blocks))
+		for k, b := range blocks {
+			s[k] = fmt.Sprintf("b%d", b.Index)
+		}
+		return strings.Join(s, " ")
+	}
+	for _, sb := range f.Blocks {
+		fmt.Fprintf(buf, "b%d <0x%08x>: ; preds %s, succs %s\n", sb.Index, sb.Block.Start, names(sb.Preds), names(sb.Succs))
+		for _, v := range sb.Phis {
+			fmt.Fprintf(buf, "\t%s\n", v.LongString())
+		}
+		for _, v := range sb.Values {
+			fmt.Fprintf(buf, "\t%s\n", v.LongString())
+		}
+	}
+	return buf.String()
+}
+
+//LongString prints the definition of v.
+func (v *Value) LongString() string {
+	args := make([]string, len(v.Args))
+	for k, arg := range v.Args {
+		if arg == nil {
+			args[k] = "<nil>"
+		} else {
+			args[k] = arg.String()
+		}
+	}
+	var s string
+	switch {
+	case v.Op == OP_PHI:
+		for k := range args {
+			if v.Block != nil && k < len(v.Block.Preds) {
+				args[k] = fmt.Sprintf("%s [b%d]", args[k], v.Block.Preds[k].Index)
+			}
+		}
+		s = "PHI " + strings.Join(args, ", ")
+	case v.Op == OP_CALL && len(args) > 0:
+		s = fmt.Sprintf("CALL %s(%s)", args[0], strings.Join(args[1:], ", "))
+	case v.Op == OP_CONST, v.Op == OP_LOCAL, v.Op == OP_ARG, v.Op == OP_BLOCK_COPY:
+		s = strings.TrimSpace(fmt.Sprintf("%s 0x%x %s", MnemonicTable[v.Op], uint32(v.Aux), strings.Join(args, ", ")))
+	case IsBranch(v.Op):
+		s = fmt.Sprintf("%s %s -> 0x%08x", MnemonicTable[v.Op], strings.Join(args, ", "), v.Aux)
+	case v.Op < len(MnemonicTable):
+		s = strings.TrimSpace(MnemonicTable[v.Op] + " " + strings.Join(args, ", "))
+	default:
+		s = fmt.Sprintf("op%d %s", v.Op, strings.Join(args, ", "))
+	}
+	if v.HasResult() {
+		return fmt.Sprintf("%s = %s", v, s)
+	}
+	return s
+}
+
+//Validate checks that f is well formed: every value is defined once in the
+//block it claims, takes the number of arguments its opcode needs, and is
+//dominated by the definitions it uses; phis have one argument per
+//predecessor; only the last value of a block ends it; and Preds mirror
+//Succs.
+func (f *SSAFunc) Validate() []Issue {
+	issues := make([]Issue, 0)
+	add := func(v *Value, format string, args ...interface{}) {
+		insn := v.Insn
+		if insn < 0 && v.Block != nil {
+			insn = v.Block.Block.Start
+		}
+		issues = append(issues, Issue{insn, fmt.Sprintf("%s: %s", v, fmt.Sprintf(format, args...))})
+	}
+	addBlock := func(sb *SSABlock, format string, args ...interface{}) {
+		issues = append(issues, Issue{sb.Block.Start, fmt.Sprintf("b%d: %s", sb.Index, fmt.Sprintf(format, args...))})
+	}
+
+	type position struct {
+		block *SSABlock
+		index int
+	}
+	defs := make(map[*Value]position)
+	for _, sb := range f.Blocks {
+		for k, v := range append(append([]*Value(nil), sb.Phis...), sb.Values...) {
+			if _, exists := defs[v]; exists {
+				add(v, "Defined more than once")
+			}
+			defs[v] = position{sb, k}
+			if v.Block != sb {
+				add(v, "Defined in b%d but belongs to another block", sb.Index)
+			}
+			if v.ID < 0 || v.ID >= f.NumValues {
+				add(v, "ID out of range 0-%d", f.NumValues-1)
+			}
+			if (v.Op == OP_PHI) != (k < len(sb.Phis)) {
+				add(v, "Phis have to come first, and only phis")
+			}
+			if isTerminator(v.Op) && k != len(sb.Phis)+len(sb.Values)-1 {
+				add(v, "%s in the middle of b%d", MnemonicTable[v.Op], sb.Index)
+			}
+		}
+		for _, succ := range sb.Succs {
+			if !containsSSABlock(succ.Preds, sb) {
+				addBlock(sb, "Successor b%d doesn't list it as predecessor", succ.Index)
+			}
+		}
+		for _, pred := range sb.Preds {
+			if !containsSSABlock(pred.Succs, sb) {
+				addBlock(sb, "Predecessor b%d doesn't list it as successor", pred.Index)
+			}
+		}
+	}
+
+	for _, sb := range f.Blocks {
+		for k, v := range append(append([]*Value(nil), sb.Phis...), sb.Values...) {
+			pops, _ := ssaStackEffect(v.Op)
+			switch {
+			case v.Op == OP_PHI:
+				if len(v.Args) != len(sb.Preds) {
+					add(v, "Phi with %d arguments in a block with %d predecessors", len(v.Args), len(sb.Preds))
+				}
+			case v.Op == OP_CALL:
+				if len(v.Args) < 1 || len(v.Args) > 1+maxArgs {
+					add(v, "CALL with %d arguments", len(v.Args))
+				}
+			case len(v.Args) != pops:
+				add(v, "%d arguments, %s takes %d", len(v.Args), MnemonicTable[v.Op], pops)
+			}
+			for n, arg := range v.Args {
+				def, exists := defs[arg]
+				switch {
+				case arg == nil || !exists:
+					add(v, "Argument %d is not defined in the function", n)
+					continue
+				case !arg.HasResult():
+					add(v, "Argument %d is %s which has no result", n, arg)
+					continue
+				}
+				//The definition has to dominate the use, or for a phi the
+				//end of the matching predecessor.
+				use := position{sb, k}
+				if v.Op == OP_PHI {
+					if n >= len(sb.Preds) {
+						continue
+					}
+					use = position{sb.Preds[n], len(sb.Preds[n].Phis) + len(sb.Preds[n].Values)}
+				}
+				if def.block == use.block {
+					if def.index >= use.index {
+						add(v, "Uses %s before it is defined", arg)
+					}
+				} else if !f.dom.Dominates(def.block.Block, use.block.Block) {
+					add(v, "Uses %s from b%d which doesn't dominate b%d", arg, def.block.Index, use.block.Index)
+				}
+			}
+		}
+	}
+	sortIssues(issues)
+	return issues
+}
+
+func containsSSABlock(blocks []*SSABlock, b *SSABlock) bool {
+	for _, blk := range blocks {
+		if blk == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"sort"
+)
+
+//OpStackSize is the number of op stack entries the engine gives a
+//procedure.
+const OpStackSize = 256
+
+//Issue is a problem found by one of the verifiers, located at an
+//instruction. Problems with the file as a whole use an Insn of -1.
+type Issue struct {
+	Insn int
+	Msg  string
+}
+
+func (issue Issue) String() string {
+	if issue.Insn < 0 {
+		return fmt.Sprintf("file: %s", issue.Msg)
+	}
+	return fmt.Sprintf("0x%08x: %s", issue.Insn, issue.Msg)
+}
+
+//StackInfo is the result of the op stack analysis of one procedure.
+type StackInfo struct {
+	Proc     *Procedure
+	MaxDepth int
+	Issues   []Issue
+	depth    []int
+}
+
+//DepthAt returns the op stack depth before instruction insn executes. The
+//second result is false if insn is unreachable or outside the procedure.
+func (si *StackInfo) DepthAt(insn int) (int, bool) {
+	i := insn - si.Proc.StartInstruction
+	if i < 0 || i >= len(si.depth) || si.depth[i] < 0 {
+		return 0, false
+	}
+	return si.depth[i], true
+}
+
+//StackEffect returns how many op stack entries op pops and pushes.
+func StackEffect(op int) (pops, pushes int) {
+	switch {
+	case op == OP_CALL:
+		return 1, 1
+	case op == OP_PUSH, op == OP_CONST, op == OP_LOCAL:
+		return 0, 1
+	case op == OP_POP, op == OP_JUMP, op == OP_ARG:
+		return 1, 0
+	case IsBranch(op), op >= OP_STORE1 && op <= OP_STORE4, op == OP_BLOCK_COPY:
+		return 2, 0
+	case op >= OP_LOAD1 && op <= OP_LOAD4, op >= OP_SEX8 && op <= OP_NEGI:
+		return 1, 1
+	case op == OP_BCOM, op == OP_NEGF, op == OP_CVIF, op == OP_CVFI:
+		return 1, 1
+	case op >= OP_ADD && op <= OP_RSHU, op >= OP_ADDF && op <= OP_MULF:
+		return 2, 1
+	}
+	return 0, 0
+}
+
+//AnalyzeStack computes the op stack depth at every instruction of proc by
+//walking its CFG. It reports underflows, overflows of OpStackSize, blocks
+//reached with different depths, and LEAVEs that do not find exactly the
+//return value on the stack.
+func (ctx *Context) AnalyzeStack(proc *Procedure) *StackInfo {
+	cfg := ctx.CFG(proc)
+	si := &StackInfo{proc, 0, nil, make([]int, proc.InstructionCount)}
+	for i := range si.depth {
+		si.depth[i] = -1
+	}
+	entry := make([]int, len(cfg.Blocks))
+	for i := range entry {
+		entry[i] = -1
+	}
+	entry[0] = 0
+	reported := make(map[int]bool)
+	work := []*BasicBlock{cfg.Blocks[0]}
+	for len(work) > 0 {
+		b := work[len(work)-1]
+		work = work[:len(work)-1]
+		depth := entry[b.Index]
+		for i := b.Start; i < b.End; i++ {
+			si.depth[i-proc.StartInstruction] = depth
+			insn := ctx.Insns[i]
+			if !insn.Valid {
+				continue
+			}
+			if insn.Op == OP_LEAVE && depth != 1 {
+				si.Issues = append(si.Issues, Issue{i, fmt.Sprintf("LEAVE with op stack depth %d, expected 1", depth)})
+			}
+			pops, pushes := StackEffect(insn.Op)
+			if depth < pops {
+				si.Issues = append(si.Issues, Issue{i, fmt.Sprintf("%s pops %d with op stack depth %d", insn.Mnemonic(), pops, depth)})
+				depth = pops
+			}
+			depth += pushes - pops
+			if depth > si.MaxDepth {
+				si.MaxDepth = depth
+				if depth > OpStackSize {
+					si.Issues = append(si.Issues, Issue{i, fmt.Sprintf("Op stack overflow, depth %d", depth)})
+				}
+			}
+		}
+		for _, succ := range b.Succs {
+			switch {
+			case entry[succ.Index] < 0:
+				entry[succ.Index] = depth
+				work = append(work, succ)
+			case entry[succ.Index] != depth && !reported[succ.Index]:
+				reported[succ.Index] = true
+				si.Issues = append(si.Issues, Issue{succ.Start, fmt.Sprintf("Op stack depth %d from 0x%08x, %d from an earlier path", depth, b.Last(), entry[succ.Index])})
+			}
+		}
+	}
+	for _, jump := range cfg.UnresolvedJumps {
+		si.Issues = append(si.Issues, Issue{jump, "Unresolved JUMP, code after it is not checked"})
+	}
+	sortIssues(si.Issues)
+	return si
+}
+
+func sortIssues(issues []Issue) {
+	sort.Stable(issuesByInsn(issues))
+}
+
+type issuesByInsn []Issue
+
+func (is issuesByInsn) Len() int           { return len(is) }
+func (is issuesByInsn) Less(i, j int) bool { return is[i].Insn < is[j].Insn }
+func (is issuesByInsn) Swap(i, j int)      { is[i], is[j] = is[j], is[i] }
+
+//OperandSources returns, for every instruction of proc that pops values,
+//the instructions that pushed them, deepest operand first. Values pushed
+//in another block are -1. CALL counts as the source of its result.
+func (ctx *Context) OperandSources(proc *Procedure) map[int][]int {
+	sources := make(map[int][]int)
+	for _, b := range ctx.CFG(proc).Blocks {
+		stack := make([]int, 0)
+		for i := b.Start; i < b.End; i++ {
+			insn := ctx.Insns[i]
+			if !insn.Valid {
+				stack = stack[:0]
+				continue
+			}
+			pops, pushes := StackEffect(insn.Op)
+			if pops > 0 {
+				operands := make([]int, pops)
+				for k := pops - 1; k >= 0; k-- {
+					operands[k] = -1
+					if len(stack) > 0 {
+						operands[k] = stack[len(stack)-1]
+						stack = stack[:len(stack)-1]
+					}
+				}
+				sources[i] = operands
+			}
+			for k := 0; k < pushes; k++ {
+				stack = append(stack, i)
+			}
+		}
+	}
+	return sources
+}
@@ -0,0 +1,436 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"sort"
+)
+
+//structVars is a union-find over the variables that hold struct pointers.
+type structVars struct {
+	ids    map[typeVar]int
+	vars   []typeVar
+	parent []int
+}
+
+func (sv *structVars) node(tv typeVar) int {
+	if id, exists := sv.ids[tv]; exists {
+		return id
+	}
+	id := len(sv.vars)
+	sv.ids[tv] = id
+	sv.vars = append(sv.vars, tv)
+	sv.parent = append(sv.parent, id)
+	return id
+}
+
+func (sv *structVars) find(id int) int {
+	for sv.parent[id] != id {
+		sv.parent[id] = sv.parent[sv.parent[id]]
+		id = sv.parent[id]
+	}
+	return id
+}
+
+//union merges the sets of a and b, keeping the older node as the
+//representative so the order structs are found in is stable.
+func (sv *structVars) union(a, b int) bool {
+	a, b = sv.find(a), sv.find(b)
+	switch {
+	case a == b:
+		return false
+	case a < b:
+		sv.parent[b] = a
+	default:
+		sv.parent[a] = b
+	}
+	return true
+}
+
+//splitAddress splits an address into a base and a constant offset.
+func splitAddress(addr *Value) (*Value, int) {
+	if addr.Op == OP_ADD {
+		if addr.Args[1].Op == OP_CONST {
+			return addr.Args[0], int(addr.Args[1].Aux)
+		}
+		if addr.Args[0].Op == OP_CONST {
+			return addr.Args[1], int(addr.Args[0].Aux)
+		}
+	}
+	return addr, 0
+}
+
+//RecoverStructs finds pointers that are loaded or stored through at more
+//than one constant offset and makes a struct of each cluster of them. A
+//pointer is a variable: a local, argument or global it is loaded from, the
+//return value of a procedure, or a field of another such struct. Pointers
+//copied between variables, passed as arguments or returned are the same
+//struct. Each new struct_N gets a field_X at every offset accessed, as wide
+//as the accesses, and is applied to the locals, arguments and globals of
+//its cluster that have no type yet. Clusters with a typed variable were
+//already dealt with and are skipped. It returns the new structs.
+func (ctx *Context) RecoverStructs() []*CType {
+	hdr := ctx.QvmFile.Header
+	imageEnd := hdr.DataLength + hdr.LitLength + hdr.BssLength
+	sv := &structVars{make(map[typeVar]int), nil, nil}
+	accesses := make(map[int]map[int]int) //node -> offset -> width
+	widths := map[int]int{OP_LOAD1: 1, OP_LOAD2: 2, OP_LOAD4: 4, OP_STORE1: 1, OP_STORE2: 2, OP_STORE4: 4}
+
+	for _, proc := range ctx.SortedProcs() {
+		f := ctx.Lift(proc)
+		//pointer returns the node of the variable v was read from.
+		var pointer func(v *Value, depth int) (int, bool)
+		pointer = func(v *Value, depth int) (int, bool) {
+			switch {
+			case depth > 8:
+			case v.Op == OP_LOAD4 && v.Args[0].Op == OP_LOCAL:
+				return sv.node(typeVar{varLocal, proc.StartInstruction, v.Args[0].Aux}), true
+			case v.Op == OP_LOAD4 && v.Args[0].Op == OP_CONST:
+				if v.Args[0].Aux >= 0 && uint32(v.Args[0].Aux) < imageEnd {
+					return sv.node(typeVar{varGlobal, 0, v.Args[0].Aux}), true
+				}
+			case v.Op == OP_LOAD4:
+				base, off := splitAddress(v.Args[0])
+				if parent, ok := pointer(base, depth+1); ok {
+					return sv.node(typeVar{varField, parent, int32(off)}), true
+				}
+			case v.Op == OP_CALL && v.Args[0].Op == OP_CONST:
+				if callee, exists := ctx.Procs[int(v.Args[0].Aux)]; exists {
+					return sv.node(typeVar{varReturn, callee.StartInstruction, 0}), true
+				}
+			}
+			return 0, false
+		}
+		//variable returns the node of the variable at addr.
+		variable := func(addr *Value) (int, bool) {
+			switch {
+			case addr.Op == OP_LOCAL:
+				return sv.node(typeVar{varLocal, proc.StartInstruction, addr.Aux}), true
+			case addr.Op == OP_CONST && addr.Aux >= 0 && uint32(addr.Aux) < imageEnd:
+				return sv.node(typeVar{varGlobal, 0, addr.Aux}), true
+			}
+			base, off := splitAddress(addr)
+			if parent, ok := pointer(base, 0); ok {
+				return sv.node(typeVar{varField, parent, int32(off)}), true
+			}
+			return 0, false
+		}
+
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Values {
+				switch {
+				case widths[v.Op] != 0:
+					base, off := splitAddress(v.Args[0])
+					if n, ok := pointer(base, 0); ok && off >= 0 && off < 0x10000 {
+						if accesses[n] == nil {
+							accesses[n] = make(map[int]int)
+						}
+						if widths[v.Op] > accesses[n][off] {
+							accesses[n][off] = widths[v.Op]
+						}
+					}
+					if v.Op != OP_STORE4 {
+						break
+					}
+					if n, ok := pointer(v.Args[1], 0); ok {
+						if dst, ok := variable(v.Args[0]); ok {
+							sv.union(dst, n)
+						}
+					}
+				case v.Op == OP_CALL && v.Args[0].Op == OP_CONST:
+					callee, exists := ctx.Procs[int(v.Args[0].Aux)]
+					if !exists {
+						break
+					}
+					for k, arg := range v.Args[1:] {
+						if n, ok := pointer(arg, 0); ok {
+							sv.union(sv.node(typeVar{varLocal, callee.StartInstruction, int32(callee.FrameSize + 8 + 4*k)}), n)
+						}
+					}
+				case v.Op == OP_LEAVE:
+					if n, ok := pointer(v.Args[0], 0); ok {
+						sv.union(sv.node(typeVar{varReturn, proc.StartInstruction, 0}), n)
+					}
+				}
+			}
+		}
+	}
+
+	//The same field of pointers that are the same struct is the same
+	//variable too.
+	fields := make(map[typeVar]int)
+	for changed := true; changed; {
+		changed = false
+		fields = make(map[typeVar]int)
+		for id, tv := range sv.vars {
+			if tv.kind != varField {
+				continue
+			}
+			key := typeVar{varField, sv.find(tv.proc), tv.addr}
+			if other, exists := fields[key]; exists {
+				changed = sv.union(other, id) || changed
+			} else {
+				fields[key] = id
+			}
+		}
+	}
+
+	//A cluster is typed by the type of any of its variables, and a field
+	//of a typed struct by the type of the field.
+	typed := make(map[int]*CType)
+	for id, tv := range sv.vars {
+		if t := ctx.varCType(tv); t != nil {
+			typed[sv.find(id)] = t
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for key, id := range fields {
+			pt := typed[key.proc]
+			if typed[sv.find(id)] != nil || !pt.IsStructPointer() {
+				continue
+			}
+			if _, ft, ok := pt.Resolve().Elem.FieldPath(int(key.addr), 4); ok {
+				typed[sv.find(id)] = ft
+				changed = true
+			}
+		}
+	}
+
+	//Gather the offsets of each untyped cluster.
+	clusterAccesses := make(map[int]map[int]int)
+	for id := range sv.vars {
+		rep := sv.find(id)
+		for off, width := range accesses[id] {
+			if clusterAccesses[rep] == nil {
+				clusterAccesses[rep] = make(map[int]int)
+			}
+			if width > clusterAccesses[rep][off] {
+				clusterAccesses[rep][off] = width
+			}
+		}
+	}
+	reps := make([]int, 0)
+	for rep, offs := range clusterAccesses {
+		if len(offs) >= 2 && typed[rep] == nil {
+			reps = append(reps, rep)
+		}
+	}
+	sort.Ints(reps)
+
+	structs := make(map[int]*CType)
+	next := 1
+	for _, rep := range reps {
+		name := ""
+		for name == "" || ctx.TypeLib.Structs[name] != nil {
+			name = fmt.Sprintf("struct_%d", next)
+			next++
+		}
+		t := &CType{Kind: CStruct, Name: name}
+		ctx.TypeLib.Structs[name] = t
+		structs[rep] = t
+	}
+	for _, rep := range reps {
+		t := structs[rep]
+		offsets := make([]int, 0, len(clusterAccesses[rep]))
+		for off := range clusterAccesses[rep] {
+			offsets = append(offsets, off)
+		}
+		sort.Ints(offsets)
+		end := 0
+		for _, off := range offsets {
+			width := clusterAccesses[rep][off]
+			if off < end || off%width != 0 {
+				continue
+			}
+			ft := BaseCType(map[int]Type{1: TypeChar, 2: TypeShort, 4: TypeInt}[width])
+			if id, exists := fields[typeVar{varField, rep, int32(off)}]; exists && width == 4 {
+				//The field is loaded and used as a pointer.
+				ft = BaseCType(TypePointer)
+				if target, exists := structs[sv.find(id)]; exists {
+					ft = PointerTo(target)
+				}
+			}
+			t.Fields = append(t.Fields, &CField{fmt.Sprintf("field_%x", off), off, ft, 0})
+			end = off + width
+		}
+		t.size = (end + 3) &^ 3
+	}
+
+	for id, tv := range sv.vars {
+		t, exists := structs[sv.find(id)]
+		if !exists {
+			continue
+		}
+		switch tv.kind {
+		case varLocal:
+			if ctx.LocalTypes[tv.proc] == nil {
+				ctx.LocalTypes[tv.proc] = make(map[int]*CType)
+			}
+			ctx.LocalTypes[tv.proc][int(tv.addr)] = PointerTo(t)
+			ctx.recovered[tv] = true
+		case varGlobal:
+			ctx.GlobalTypes[uint32(tv.addr)] = PointerTo(t)
+			ctx.recovered[tv] = true
+		}
+	}
+
+	found := make([]*CType, 0, len(reps))
+	for _, rep := range reps {
+		found = append(found, structs[rep])
+	}
+	return found
+}
+
+//varCType returns the C type applied to tv, or nil.
+func (ctx *Context) varCType(tv typeVar) *CType {
+	switch tv.kind {
+	case varLocal:
+		return ctx.LocalTypes[tv.proc][int(tv.addr)]
+	case varGlobal:
+		return ctx.GlobalTypes[uint32(tv.addr)]
+	}
+	return nil
+}
+
+//LocalCType returns the C type applied to the frame slot at off of proc,
+//or nil.
+func (ctx *Context) LocalCType(proc *Procedure, off int) *CType {
+	return ctx.LocalTypes[proc.StartInstruction][off]
+}
+
+//GlobalCType returns the C type applied to the global containing addr and
+//the offset of addr in it, or nil.
+func (ctx *Context) GlobalCType(addr uint32) (*Global, *CType, int) {
+	for gaddr, t := range ctx.GlobalTypes {
+		if addr >= gaddr && addr-gaddr < uint32(t.Size()) {
+			if g, exists := ctx.Globals[gaddr]; exists {
+				return g, t, int(addr - gaddr)
+			}
+		}
+	}
+	return nil, nil, 0
+}
+
+//ApplyPrototype gives proc the return and parameter types of the function
+//type fn, and the names of its parameters to the arguments not renamed.
+func (ctx *Context) ApplyPrototype(proc *Procedure, fn *CType) {
+	ctx.ProcTypes[proc.StartInstruction] = fn
+	if ctx.LocalTypes[proc.StartInstruction] == nil {
+		ctx.LocalTypes[proc.StartInstruction] = make(map[int]*CType)
+	}
+	if ctx.LocalNames == nil {
+		ctx.LocalNames = make(map[int]map[int]string)
+	}
+	if ctx.LocalNames[proc.StartInstruction] == nil {
+		ctx.LocalNames[proc.StartInstruction] = make(map[int]string)
+	}
+	for n, p := range fn.Params {
+		off := proc.FrameSize + 8 + 4*n
+		ctx.LocalTypes[proc.StartInstruction][off] = p.Type
+		delete(ctx.recovered, typeVar{varLocal, proc.StartInstruction, int32(off)})
+		if _, renamed := ctx.LocalNames[proc.StartInstruction][off]; !renamed && p.Name != "" {
+			ctx.LocalNames[proc.StartInstruction][off] = p.Name
+		}
+	}
+}
+
+//ApplyTypeLib applies the prototypes and variable declarations of the
+//type library to the procedures and globals of the same name that have no
+//type yet, or only one RecoverStructs guessed.
+func (ctx *Context) ApplyTypeLib() {
+	for _, proc := range ctx.Procs {
+		fn, exists := ctx.TypeLib.Funcs[proc.Name]
+		if _, typed := ctx.ProcTypes[proc.StartInstruction]; exists && !typed {
+			ctx.ApplyPrototype(proc, fn)
+		}
+	}
+	for _, g := range ctx.Globals {
+		t, exists := ctx.TypeLib.Vars[g.Name]
+		tv := typeVar{varGlobal, 0, int32(g.Addr)}
+		if _, typed := ctx.GlobalTypes[g.Addr]; exists && (!typed || ctx.recovered[tv]) {
+			ctx.GlobalTypes[g.Addr] = t
+			delete(ctx.recovered, tv)
+		}
+	}
+}
+
+//objectCType returns the C type of the object width bytes wide at addr in
+//proc going by the types applied to variables, or nil.
+func (ctx *Context) objectCType(proc *Procedure, addr *Value, width, depth int) *CType {
+	if depth > 8 {
+		return nil
+	}
+	base, off := splitAddress(addr)
+	var t *CType
+	switch {
+	case addr.Op == OP_CONST:
+		_, t, off = ctx.GlobalCType(uint32(addr.Aux))
+	case base.Op == OP_LOCAL:
+		t = ctx.LocalCType(proc, int(base.Aux))
+	default:
+		if pt := ctx.valueCType(proc, base, depth+1).Resolve(); pt != nil && pt.Kind == CPointer {
+			t = pt.Elem
+		}
+	}
+	if t == nil {
+		return nil
+	}
+	_, ft, _ := t.FieldPath(off, width)
+	return ft
+}
+
+//valueCType returns the C type of the value v of proc loads, or nil.
+func (ctx *Context) valueCType(proc *Procedure, v *Value, depth int) *CType {
+	widths := map[int]int{OP_LOAD1: 1, OP_LOAD2: 2, OP_LOAD4: 4}
+	for v.Op == OP_SEX8 || v.Op == OP_SEX16 {
+		v = v.Args[0]
+	}
+	if widths[v.Op] == 0 {
+		return nil
+	}
+	return ctx.objectCType(proc, v.Args[0], widths[v.Op], depth)
+}
+
+//FieldRefs names the struct field each CONST offset of proc selects when
+//added to a pointer to a struct, e.g. "gentity_s.health".
+func (ctx *Context) FieldRefs(proc *Procedure) map[int]string {
+	refs := make(map[int]string)
+	f := ctx.Lift(proc)
+	for _, sb := range f.Blocks {
+		for _, v := range sb.Values {
+			if v.Op != OP_ADD {
+				continue
+			}
+			for k, arg := range v.Args {
+				if arg.Op != OP_CONST {
+					continue
+				}
+				pt := ctx.valueCType(proc, v.Args[1-k], 0)
+				if !pt.IsStructPointer() {
+					continue
+				}
+				elem := pt.Resolve().Elem
+				if path, _, ok := elem.FieldPath(int(arg.Aux), 0); ok && path != "" {
+					refs[arg.Insn] = elem.Name + path
+				}
+			}
+		}
+	}
+	return refs
+}
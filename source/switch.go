@@ -0,0 +1,237 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"sort"
+)
+
+//maxSwitchCases bounds the tables read when no bounds check gives their
+//length.
+const maxSwitchCases = 1024
+
+//Switch is a switch statement LCC compiled to a jump table. The value is
+//checked against the case range, then the JUMP loads its target from a
+//table of instruction numbers in the data section.
+type Switch struct {
+	Jump    int    //the JUMP instruction
+	Base    uint32 //address the scaled value is added to
+	Table   uint32 //address of the entry for Low
+	Low     int32
+	Targets []int //Targets[k] is where Low+k goes
+	Default int   //where the bounds checks go, -1 without them
+	Checks  []int //the bounds check branches
+	//The instructions loading the value switched on.
+	ValueStart, ValueEnd int
+}
+
+//Cases maps every target of s to the values going there.
+func (s *Switch) Cases() map[int][]int32 {
+	cases := make(map[int][]int32)
+	for k, tgt := range s.Targets {
+		cases[tgt] = append(cases[tgt], s.Low+int32(k))
+	}
+	return cases
+}
+
+//Switch decodes the jump table of the computed JUMP at insn. LCC loads the
+//target from table + ((value - low) << 2) after branching away when value
+//is below low or above high:
+//
+//	value; CONST low; LTI default
+//	value; CONST high; GTI default
+//	value; CONST low; SUB; CONST 2; LSH; CONST table; ADD; LOAD4; JUMP
+//
+//value is a variable load, repeated for every use. Without the SUB the
+//table is indexed from 0, and without the checks it runs for as long as its
+//entries are instructions of proc.
+func (ctx *Context) Switch(proc *Procedure, insn int) (*Switch, bool) {
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+	if insn-3 < start || ctx.Insns[insn].Op != OP_JUMP || ctx.Insns[insn-1].Op != OP_LOAD4 || ctx.Insns[insn-2].Op != OP_ADD {
+		return nil, false
+	}
+
+	//The address is the table base plus the scaled index, either way round.
+	rStart, ok := ctx.exprStart(start, insn-3)
+	if !ok {
+		return nil, false
+	}
+	lStart, ok := ctx.exprStart(start, rStart-1)
+	if !ok {
+		return nil, false
+	}
+	baseAt, scaleEnd := insn-3, rStart-1
+	if ctx.Insns[baseAt].Op != OP_CONST {
+		baseAt, scaleEnd = lStart, insn-3
+		if lStart != rStart-1 || ctx.Insns[baseAt].Op != OP_CONST {
+			return nil, false
+		}
+	}
+	scale := ctx.Insns[scaleEnd]
+	switch {
+	case scale.Op == OP_LSH && ctx.Insns[scaleEnd-1].Op == OP_CONST && ctx.Insns[scaleEnd-1].IntArg() == 2:
+	case (scale.Op == OP_MULI || scale.Op == OP_MULU) && ctx.Insns[scaleEnd-1].Op == OP_CONST && ctx.Insns[scaleEnd-1].IntArg() == 4:
+	default:
+		return nil, false
+	}
+	base := uint32(ctx.Insns[baseAt].IntArg())
+	sw := &Switch{insn, base, base, 0, nil, -1, nil, 0, 0}
+
+	valEnd := scaleEnd - 2
+	sub := ctx.Insns[valEnd].Op == OP_SUB && ctx.Insns[valEnd-1].Op == OP_CONST
+	if sub {
+		sw.Low = ctx.Insns[valEnd-1].IntArg()
+		valEnd -= 2
+	}
+	valStart, ok := ctx.exprStart(start, valEnd)
+	if !ok || !ctx.pureExpr(valStart, valEnd) {
+		return nil, false
+	}
+	sw.ValueStart, sw.ValueEnd = valStart, valEnd
+
+	//The bounds checks come right before the lookup, each comparing the
+	//value with a constant.
+	low, high, hasLow, hasHigh := int32(0), int32(0), false, false
+	pos := lStart - 1
+	for len(sw.Checks) < 2 && pos-2 > start && isBoundsCheck(ctx.Insns[pos].Op) && ctx.Insns[pos-1].Op == OP_CONST {
+		cStart, ok := ctx.exprStart(start, pos-2)
+		if !ok || !ctx.sameExpr(cStart, pos-2, valStart, valEnd) {
+			break
+		}
+		tgt := int(ctx.Insns[pos].IntArg())
+		if sw.Default >= 0 && tgt != sw.Default {
+			break
+		}
+		c := ctx.Insns[pos-1].IntArg()
+		switch ctx.Insns[pos].Op {
+		case OP_LTI, OP_LTU:
+			low, hasLow = c, true
+		case OP_LEI, OP_LEU:
+			low, hasLow = c+1, true
+		case OP_GTI, OP_GTU:
+			high, hasHigh = c, true
+		case OP_GEI, OP_GEU:
+			high, hasHigh = c-1, true
+		}
+		sw.Default = tgt
+		sw.Checks = append(sw.Checks, pos)
+		pos = cStart - 1
+	}
+	switch {
+	case hasLow && sub && low != sw.Low:
+		return nil, false
+	case hasLow && !sub:
+		sw.Low = low
+		sw.Table += 4 * uint32(low)
+	}
+
+	count := maxSwitchCases
+	if hasHigh {
+		count = int(high-sw.Low) + 1
+		if count <= 0 || count > maxSwitchCases {
+			return nil, false
+		}
+	}
+	for k := 0; k < count; k++ {
+		word, ok := ctx.QvmFile.Word(sw.Table + 4*uint32(k))
+		tgt := int(word)
+		if !ok || tgt < start || tgt >= end || !ctx.Insns[tgt].Valid {
+			if hasHigh {
+				return nil, false
+			}
+			break
+		}
+		sw.Targets = append(sw.Targets, tgt)
+	}
+	if len(sw.Targets) == 0 {
+		return nil, false
+	}
+	return sw, true
+}
+
+//UniqueTargets returns the distinct targets of s in instruction order.
+func (s *Switch) UniqueTargets() []int {
+	seen := make(map[int]bool)
+	targets := make([]int, 0, len(s.Targets))
+	for _, tgt := range s.Targets {
+		if !seen[tgt] {
+			seen[tgt] = true
+			targets = append(targets, tgt)
+		}
+	}
+	sort.Ints(targets)
+	return targets
+}
+
+//isBoundsCheck reports whether op is one of the integer ordered
+//comparisons.
+func isBoundsCheck(op int) bool {
+	switch op {
+	case OP_LTI, OP_LEI, OP_GTI, OP_GEI, OP_LTU, OP_LEU, OP_GTU, OP_GEU:
+		return true
+	}
+	return false
+}
+
+//exprStart returns the first instruction of the expression whose value the
+//instruction at end pushes, searching no further back than lo.
+func (ctx *Context) exprStart(lo, end int) (int, bool) {
+	need := 1
+	for i := end; i >= lo; i-- {
+		if !ctx.Insns[i].Valid {
+			return 0, false
+		}
+		pops, pushes := StackEffect(ctx.Insns[i].Op)
+		need += pops - pushes
+		if need == 0 {
+			return i, true
+		}
+		if need < 0 {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+//pureExpr reports whether the instructions [from, to] only read variables,
+//so evaluating them twice gives the same value.
+func (ctx *Context) pureExpr(from, to int) bool {
+	for i := from; i <= to; i++ {
+		switch op := ctx.Insns[i].Op; {
+		case op == OP_CONST, op == OP_LOCAL, op >= OP_LOAD1 && op <= OP_LOAD4:
+		case op == OP_SEX8, op == OP_SEX16:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+//sameExpr reports whether the instructions [a, aEnd] and [b, bEnd] are the
+//same.
+func (ctx *Context) sameExpr(a, aEnd, b, bEnd int) bool {
+	if aEnd-a != bEnd-b {
+		return false
+	}
+	for k := 0; a+k <= aEnd; k++ {
+		x, y := ctx.Insns[a+k], ctx.Insns[b+k]
+		if x.Op != y.Op || string(x.Arg) != string(y.Arg) {
+			return false
+		}
+	}
+	return true
+}
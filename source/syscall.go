@@ -0,0 +1,240 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+//SyscallSite is a CALL of a syscall and the number of arguments the ARGs
+//before it pass.
+type SyscallSite struct {
+	Insn int
+	Argc int
+}
+
+//SyscallSites returns the call sites of every syscall the QVM calls with
+//a CONST target, by syscall number.
+func (ctx *Context) SyscallSites() map[int][]SyscallSite {
+	sites := make(map[int][]SyscallSite)
+	for _, proc := range ctx.SortedProcs() {
+		for _, sb := range ctx.Lift(proc).Blocks {
+			for _, v := range sb.Values {
+				if v.Op != OP_CALL || v.Args[0].Op != OP_CONST || v.Args[0].Aux >= 0 {
+					continue
+				}
+				num := int(v.Args[0].Aux)
+				sites[num] = append(sites[num], SyscallSite{v.Insn, len(v.Args) - 1})
+			}
+		}
+	}
+	return sites
+}
+
+//InferSyscallArgc works out the argument count of every syscall the QVM
+//calls. A count already known in ctx.Syscalls is kept, the others are the
+//count most call sites pass, ties going to the larger one, and are filled
+//into ctx.Syscalls. It returns the counts by syscall number and the call
+//sites that pass a different number of arguments.
+func (ctx *Context) InferSyscallArgc() (map[int]int, []Issue) {
+	counts := make(map[int]int)
+	issues := make([]Issue, 0)
+	for num, sites := range ctx.SyscallSites() {
+		sc, known := ctx.Syscalls[num]
+		argc := -1
+		if known {
+			argc = sc.Argc
+		}
+		if argc < 0 {
+			argc = commonArgc(sites)
+			if known {
+				sc.Argc = argc
+				ctx.Syscalls[num] = sc
+			}
+		}
+		counts[num] = argc
+
+		name := fmt.Sprintf("Syscall %d", num)
+		if known {
+			name = sc.Name
+		}
+		for _, site := range sites {
+			if site.Argc != argc {
+				issues = append(issues, Issue{site.Insn, fmt.Sprintf("%s called with %d arguments, takes %d", name, site.Argc, argc)})
+			}
+		}
+	}
+	sortIssues(issues)
+	return counts, issues
+}
+
+//commonArgc returns the argument count most of sites pass, ties going to
+//the larger one.
+func commonArgc(sites []SyscallSite) int {
+	argc := -1
+	votes := make(map[int]int)
+	for _, site := range sites {
+		votes[site.Argc]++
+		if n := votes[site.Argc]; argc < 0 || n > votes[argc] || (n == votes[argc] && site.Argc > argc) {
+			argc = site.Argc
+		}
+	}
+	return argc
+}
+
+//importEnumSuffix ends the names of the enums numbering the syscalls,
+//cgameImport_t, gameImport_t and uiImport_t.
+const importEnumSuffix = "Import_t"
+
+//ImportSyscalls reads the syscalls the C source src defines. The engine
+//headers number them with the enumerators of the import enums, counting
+//up from 0, and the modules wrap each in a function passing its
+//enumerator to syscall:
+//
+//	void trap_Print( const char *fmt ) {
+//		syscall( CG_PRINT, fmt );
+//	}
+//
+//A syscall is named after its wrapper, or its enumerator without one. The
+//prototype of the wrapper gives its type and argument count, or only the
+//count if lib can't parse it. The declarations of src are added to lib and
+//the ones it can't parse are returned as errors.
+func (lib *TypeLib) ImportSyscalls(src string) (map[int]Syscall, []error) {
+	errs := lib.Parse(src)
+	p, err := lib.newParser(src)
+	if err != nil {
+		return nil, errs
+	}
+	syscalls := make(map[int]Syscall)
+	inSrc := make(map[string]bool)
+	for _, tok := range p.tokens {
+		inSrc[tok] = true
+	}
+	for _, t := range lib.Sorted() {
+		if t.Kind != CEnum || !strings.HasSuffix(t.Name, importEnumSuffix) || len(t.Values) == 0 || !inSrc[t.Values[0].Name] {
+			continue
+		}
+		for _, ev := range t.Values {
+			syscalls[-1-ev.Value] = Syscall{ev.Name, -1, nil}
+		}
+	}
+
+	start, body, depth := 0, 0, 0
+	for i, tok := range p.tokens {
+		switch {
+		case tok == "{":
+			if depth == 0 {
+				body = i
+			}
+			depth++
+		case tok == "}" && depth > 0:
+			depth--
+			if depth > 0 {
+				break
+			}
+			if num, sc, ok := lib.syscallWrapper(p.tokens[start:body], p.tokens[body+1:i]); ok {
+				syscalls[num] = sc
+			}
+			start = i + 1
+		case tok == ";" && depth == 0:
+			start = i + 1
+		}
+	}
+	return syscalls, errs
+}
+
+//syscallWrapper returns the syscall the function with declaration decl and
+//body body wraps, if it passes a constant to syscall.
+func (lib *TypeLib) syscallWrapper(decl, body []string) (int, Syscall, bool) {
+	open := -1
+	for i, tok := range decl {
+		if tok == "(" {
+			open = i
+			break
+		}
+	}
+	if open < 1 || !isIdent(decl[open-1]) {
+		return 0, Syscall{}, false
+	}
+	//The number is the first argument of the first call to syscall.
+	call := -1
+	for i := 0; i+1 < len(body); i++ {
+		if body[i] == "syscall" && body[i+1] == "(" {
+			call = i + 2
+			break
+		}
+	}
+	if call < 0 {
+		return 0, Syscall{}, false
+	}
+	end, depth := call, 0
+	for ; end < len(body) && (depth > 0 || body[end] != "," && body[end] != ")"); end++ {
+		switch body[end] {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+	}
+	v, err := lib.eval(strings.Join(body[call:end], " "))
+	if err != nil {
+		return 0, Syscall{}, false
+	}
+
+	name := decl[open-1]
+	sc := Syscall{name, paramCount(decl[open:]), nil}
+	if fn, exists := lib.Funcs[name]; exists && fn.Kind == CFunc {
+		sc.Type = fn
+		if !fn.Variadic {
+			sc.Argc = len(fn.Params)
+		}
+	}
+	return -1 - v, sc, true
+}
+
+//paramCount counts the parameters of the parameter list starting at
+//tokens[0], or returns -1 if it's variadic or unterminated.
+func paramCount(tokens []string) int {
+	count, depth, empty := 0, 0, true
+	for _, tok := range tokens[1:] {
+		switch tok {
+		case "(", "[":
+			depth++
+		case "]":
+			depth--
+		case ")":
+			if depth == 0 {
+				if empty {
+					return 0
+				}
+				return count + 1
+			}
+			depth--
+		case ",":
+			if depth == 0 {
+				count++
+			}
+		case "...":
+			return -1
+		case "void":
+			continue
+		}
+		empty = false
+	}
+	return -1
+}
@@ -0,0 +1,513 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+//syscallRun is a run of syscalls numbered down from First. The engine
+//headers number them up from 0 and the QVMs call number n as -1 - n.
+type syscallRun struct {
+	First int
+	Calls []Syscall
+}
+
+//newSyscall returns the syscall name taking argc arguments, argc being -1
+//if unknown.
+func newSyscall(name string, argc int) Syscall {
+	return Syscall{Name: name, Argc: argc}
+}
+
+//q3Syscalls are the syscalls of Quake III Arena 1.32 by module, with the
+//argument counts of the wrappers in the SDK. ioquake3, Team Arena and the
+//mods built on them number them the same.
+var q3Syscalls = map[Module][]syscallRun{
+	ModuleCgame: {
+		{-1, []Syscall{
+			newSyscall("trap_Print", 1),
+			newSyscall("trap_Error", 1),
+			newSyscall("trap_Milliseconds", 0),
+			newSyscall("trap_Cvar_Register", 4),
+			newSyscall("trap_Cvar_Update", 1),
+			newSyscall("trap_Cvar_Set", 2),
+			newSyscall("trap_Cvar_VariableStringBuffer", 3),
+			newSyscall("trap_Argc", 0),
+			newSyscall("trap_Argv", 3),
+			newSyscall("trap_Args", 2),
+			newSyscall("trap_FS_FOpenFile", 3),
+			newSyscall("trap_FS_Read", 3),
+			newSyscall("trap_FS_Write", 3),
+			newSyscall("trap_FS_FCloseFile", 1),
+			newSyscall("trap_SendConsoleCommand", 1),
+			newSyscall("trap_AddCommand", 1),
+			newSyscall("trap_SendClientCommand", 1),
+			newSyscall("trap_UpdateScreen", 0),
+			newSyscall("trap_CM_LoadMap", 1),
+			newSyscall("trap_CM_NumInlineModels", 0),
+			newSyscall("trap_CM_InlineModel", 1),
+			newSyscall("trap_CM_LoadModel", -1),
+			newSyscall("trap_CM_TempBoxModel", 2),
+			newSyscall("trap_CM_PointContents", 2),
+			newSyscall("trap_CM_TransformedPointContents", 4),
+			newSyscall("trap_CM_BoxTrace", 7),
+			newSyscall("trap_CM_TransformedBoxTrace", 9),
+			newSyscall("trap_CM_MarkFragments", 7),
+			newSyscall("trap_S_StartSound", 4),
+			newSyscall("trap_S_StartLocalSound", 2),
+			newSyscall("trap_S_ClearLoopingSounds", 1),
+			newSyscall("trap_S_AddLoopingSound", 4),
+			newSyscall("trap_S_UpdateEntityPosition", 2),
+			newSyscall("trap_S_Respatialize", 4),
+			newSyscall("trap_S_RegisterSound", 2),
+			newSyscall("trap_S_StartBackgroundTrack", 2),
+			newSyscall("trap_R_LoadWorldMap", 1),
+			newSyscall("trap_R_RegisterModel", 1),
+			newSyscall("trap_R_RegisterSkin", 1),
+			newSyscall("trap_R_RegisterShader", 1),
+			newSyscall("trap_R_ClearScene", 0),
+			newSyscall("trap_R_AddRefEntityToScene", 1),
+			newSyscall("trap_R_AddPolyToScene", 3),
+			newSyscall("trap_R_AddLightToScene", 5),
+			newSyscall("trap_R_RenderScene", 1),
+			newSyscall("trap_R_SetColor", 1),
+			newSyscall("trap_R_DrawStretchPic", 9),
+			newSyscall("trap_R_ModelBounds", 3),
+			newSyscall("trap_R_LerpTag", 6),
+			newSyscall("trap_GetGlconfig", 1),
+			newSyscall("trap_GetGameState", 1),
+			newSyscall("trap_GetCurrentSnapshotNumber", 2),
+			newSyscall("trap_GetSnapshot", 2),
+			newSyscall("trap_GetServerCommand", 1),
+			newSyscall("trap_GetCurrentCmdNumber", 0),
+			newSyscall("trap_GetUserCmd", 2),
+			newSyscall("trap_SetUserCmdValue", 2),
+			newSyscall("trap_R_RegisterShaderNoMip", 1),
+			newSyscall("trap_MemoryRemaining", 0),
+			newSyscall("trap_R_RegisterFont", 3),
+			newSyscall("trap_Key_IsDown", 1),
+			newSyscall("trap_Key_GetCatcher", 0),
+			newSyscall("trap_Key_SetCatcher", 1),
+			newSyscall("trap_Key_GetKey", 1),
+			newSyscall("trap_PC_AddGlobalDefine", 1),
+			newSyscall("trap_PC_LoadSource", 1),
+			newSyscall("trap_PC_FreeSource", 1),
+			newSyscall("trap_PC_ReadToken", 2),
+			newSyscall("trap_PC_SourceFileAndLine", 3),
+			newSyscall("trap_S_StopBackgroundTrack", 0),
+			newSyscall("trap_RealTime", 1),
+			newSyscall("trap_SnapVector", 1),
+			newSyscall("trap_RemoveCommand", 1),
+			newSyscall("trap_R_LightForPoint", 4),
+			newSyscall("trap_CIN_PlayCinematic", 6),
+			newSyscall("trap_CIN_StopCinematic", 1),
+			newSyscall("trap_CIN_RunCinematic", 1),
+			newSyscall("trap_CIN_DrawCinematic", 1),
+			newSyscall("trap_CIN_SetExtents", 5),
+			newSyscall("trap_R_RemapShader", 3),
+			newSyscall("trap_S_AddRealLoopingSound", 4),
+			newSyscall("trap_S_StopLoopingSound", 1),
+			newSyscall("trap_CM_TempCapsuleModel", 2),
+			newSyscall("trap_CM_CapsuleTrace", 7),
+			newSyscall("trap_CM_TransformedCapsuleTrace", 9),
+			newSyscall("trap_R_AddAdditiveLightToScene", 5),
+			newSyscall("trap_GetEntityToken", 2),
+			newSyscall("trap_R_AddPolysToScene", 4),
+			newSyscall("trap_R_inPVS", 2),
+			newSyscall("trap_FS_Seek", 3),
+		}},
+		{-101, []Syscall{
+			newSyscall("memset", 3),
+			newSyscall("memcpy", 3),
+			newSyscall("strncpy", 3),
+			newSyscall("sin", 1),
+			newSyscall("cos", 1),
+			newSyscall("atan2", 2),
+			newSyscall("sqrt", 1),
+			newSyscall("floor", 1),
+			newSyscall("ceil", 1),
+			newSyscall("testPrintInt", 2),
+			newSyscall("testPrintFloat", 2),
+			newSyscall("acos", 1),
+		}},
+	},
+	ModuleQagame: {
+		{-1, []Syscall{
+			newSyscall("trap_Printf", 1),
+			newSyscall("trap_Error", 1),
+			newSyscall("trap_Milliseconds", 0),
+			newSyscall("trap_Cvar_Register", 4),
+			newSyscall("trap_Cvar_Update", 1),
+			newSyscall("trap_Cvar_Set", 2),
+			newSyscall("trap_Cvar_VariableIntegerValue", 1),
+			newSyscall("trap_Cvar_VariableStringBuffer", 3),
+			newSyscall("trap_Argc", 0),
+			newSyscall("trap_Argv", 3),
+			newSyscall("trap_FS_FOpenFile", 3),
+			newSyscall("trap_FS_Read", 3),
+			newSyscall("trap_FS_Write", 3),
+			newSyscall("trap_FS_FCloseFile", 1),
+			newSyscall("trap_SendConsoleCommand", 2),
+			newSyscall("trap_LocateGameData", 5),
+			newSyscall("trap_DropClient", 2),
+			newSyscall("trap_SendServerCommand", 2),
+			newSyscall("trap_SetConfigstring", 2),
+			newSyscall("trap_GetConfigstring", 3),
+			newSyscall("trap_GetUserinfo", 3),
+			newSyscall("trap_SetUserinfo", 2),
+			newSyscall("trap_GetServerinfo", 2),
+			newSyscall("trap_SetBrushModel", 2),
+			newSyscall("trap_Trace", 7),
+			newSyscall("trap_PointContents", 2),
+			newSyscall("trap_InPVS", 2),
+			newSyscall("trap_InPVSIgnorePortals", 2),
+			newSyscall("trap_AdjustAreaPortalState", 2),
+			newSyscall("trap_AreasConnected", 2),
+			newSyscall("trap_LinkEntity", 1),
+			newSyscall("trap_UnlinkEntity", 1),
+			newSyscall("trap_EntitiesInBox", 4),
+			newSyscall("trap_EntityContact", 3),
+			newSyscall("trap_BotAllocateClient", 0),
+			newSyscall("trap_BotFreeClient", 1),
+			newSyscall("trap_GetUsercmd", 2),
+			newSyscall("trap_GetEntityToken", 2),
+			newSyscall("trap_FS_GetFileList", 4),
+			newSyscall("trap_DebugPolygonCreate", 3),
+			newSyscall("trap_DebugPolygonDelete", 1),
+			newSyscall("trap_RealTime", 1),
+			newSyscall("trap_SnapVector", 1),
+			newSyscall("trap_TraceCapsule", 7),
+			newSyscall("trap_EntityContactCapsule", 3),
+			newSyscall("trap_FS_Seek", 3),
+		}},
+		{-101, []Syscall{
+			newSyscall("memset", 3),
+			newSyscall("memcpy", 3),
+			newSyscall("strncpy", 3),
+			newSyscall("sin", 1),
+			newSyscall("cos", 1),
+			newSyscall("atan2", 2),
+			newSyscall("sqrt", 1),
+			newSyscall("matrixmultiply", 3),
+			newSyscall("anglevectors", 4),
+			newSyscall("perpendicularvector", 2),
+			newSyscall("floor", 1),
+			newSyscall("ceil", 1),
+			newSyscall("testPrintInt", 2),
+			newSyscall("testPrintFloat", 2),
+		}},
+		{-201, []Syscall{
+			newSyscall("trap_BotLibSetup", 0),
+			newSyscall("trap_BotLibShutdown", 0),
+			newSyscall("trap_BotLibVarSet", 2),
+			newSyscall("trap_BotLibVarGet", 3),
+			newSyscall("trap_BotLibDefine", 1),
+			newSyscall("trap_BotLibStartFrame", 1),
+			newSyscall("trap_BotLibLoadMap", 1),
+			newSyscall("trap_BotLibUpdateEntity", 2),
+			newSyscall("trap_BotLibTest", 4),
+			newSyscall("trap_BotGetSnapshotEntity", 2),
+			newSyscall("trap_BotGetServerCommand", 3),
+			newSyscall("trap_BotUserCommand", 2),
+		}},
+		{-301, []Syscall{
+			newSyscall("trap_AAS_EnableRoutingArea", 2),
+			newSyscall("trap_AAS_BBoxAreas", 4),
+			newSyscall("trap_AAS_AreaInfo", 2),
+			newSyscall("trap_AAS_EntityInfo", 2),
+			newSyscall("trap_AAS_Initialized", 0),
+			newSyscall("trap_AAS_PresenceTypeBoundingBox", 3),
+			newSyscall("trap_AAS_Time", 0),
+			newSyscall("trap_AAS_PointAreaNum", 1),
+			newSyscall("trap_AAS_TraceAreas", 5),
+			newSyscall("trap_AAS_PointContents", 1),
+			newSyscall("trap_AAS_NextBSPEntity", 1),
+			newSyscall("trap_AAS_ValueForBSPEpairKey", 4),
+			newSyscall("trap_AAS_VectorForBSPEpairKey", 3),
+			newSyscall("trap_AAS_FloatForBSPEpairKey", 3),
+			newSyscall("trap_AAS_IntForBSPEpairKey", 3),
+			newSyscall("trap_AAS_AreaReachability", 1),
+			newSyscall("trap_AAS_AreaTravelTimeToGoalArea", 4),
+			newSyscall("trap_AAS_Swimming", 1),
+			newSyscall("trap_AAS_PredictClientMovement", 13),
+		}},
+		{-401, []Syscall{
+			newSyscall("trap_EA_Say", 2),
+			newSyscall("trap_EA_SayTeam", 2),
+			newSyscall("trap_EA_Command", 2),
+			newSyscall("trap_EA_Action", 2),
+			newSyscall("trap_EA_Gesture", 1),
+			newSyscall("trap_EA_Talk", 1),
+			newSyscall("trap_EA_Attack", 1),
+			newSyscall("trap_EA_Use", 1),
+			newSyscall("trap_EA_Respawn", 1),
+			newSyscall("trap_EA_Crouch", 1),
+			newSyscall("trap_EA_MoveUp", 1),
+			newSyscall("trap_EA_MoveDown", 1),
+			newSyscall("trap_EA_MoveForward", 1),
+			newSyscall("trap_EA_MoveBack", 1),
+			newSyscall("trap_EA_MoveLeft", 1),
+			newSyscall("trap_EA_MoveRight", 1),
+			newSyscall("trap_EA_SelectWeapon", 2),
+			newSyscall("trap_EA_Jump", 1),
+			newSyscall("trap_EA_DelayedJump", 1),
+			newSyscall("trap_EA_Move", 3),
+			newSyscall("trap_EA_View", 2),
+			newSyscall("trap_EA_EndRegular", 2),
+			newSyscall("trap_EA_GetInput", 3),
+			newSyscall("trap_EA_ResetInput", 1),
+		}},
+		{-501, []Syscall{
+			newSyscall("trap_BotLoadCharacter", 2),
+			newSyscall("trap_BotFreeCharacter", 1),
+			newSyscall("trap_Characteristic_Float", 2),
+			newSyscall("trap_Characteristic_BFloat", 4),
+			newSyscall("trap_Characteristic_Integer", 2),
+			newSyscall("trap_Characteristic_BInteger", 4),
+			newSyscall("trap_Characteristic_String", 4),
+			newSyscall("trap_BotAllocChatState", 0),
+			newSyscall("trap_BotFreeChatState", 1),
+			newSyscall("trap_BotQueueConsoleMessage", 3),
+			newSyscall("trap_BotRemoveConsoleMessage", 2),
+			newSyscall("trap_BotNextConsoleMessage", 2),
+			newSyscall("trap_BotNumConsoleMessages", 1),
+			newSyscall("trap_BotInitialChat", 11),
+			newSyscall("trap_BotReplyChat", 12),
+			newSyscall("trap_BotChatLength", 1),
+			newSyscall("trap_BotEnterChat", 3),
+			newSyscall("trap_StringContains", 3),
+			newSyscall("trap_BotFindMatch", 3),
+			newSyscall("trap_BotMatchVariable", 4),
+			newSyscall("trap_UnifyWhiteSpaces", 1),
+			newSyscall("trap_BotReplaceSynonyms", 2),
+			newSyscall("trap_BotLoadChatFile", 3),
+			newSyscall("trap_BotSetChatGender", 2),
+			newSyscall("trap_BotSetChatName", 3),
+			newSyscall("trap_BotResetGoalState", 1),
+			newSyscall("trap_BotResetAvoidGoals", 1),
+			newSyscall("trap_BotPushGoal", 2),
+			newSyscall("trap_BotPopGoal", 1),
+			newSyscall("trap_BotEmptyGoalStack", 1),
+			newSyscall("trap_BotDumpAvoidGoals", 1),
+			newSyscall("trap_BotDumpGoalStack", 1),
+			newSyscall("trap_BotGoalName", 3),
+			newSyscall("trap_BotGetTopGoal", 2),
+			newSyscall("trap_BotGetSecondGoal", 2),
+			newSyscall("trap_BotChooseLTGItem", 4),
+			newSyscall("trap_BotChooseNBGItem", 6),
+			newSyscall("trap_BotTouchingGoal", 2),
+			newSyscall("trap_BotItemGoalInVisButNotVisible", 4),
+			newSyscall("trap_BotGetLevelItemGoal", 3),
+			newSyscall("trap_BotAvoidGoalTime", 2),
+			newSyscall("trap_BotInitLevelItems", 0),
+			newSyscall("trap_BotUpdateEntityItems", 0),
+			newSyscall("trap_BotLoadItemWeights", 2),
+			newSyscall("trap_BotFreeItemWeights", 1),
+			newSyscall("trap_BotSaveGoalFuzzyLogic", 2),
+			newSyscall("trap_BotAllocGoalState", 1),
+			newSyscall("trap_BotFreeGoalState", 1),
+			newSyscall("trap_BotResetMoveState", 1),
+			newSyscall("trap_BotMoveToGoal", 4),
+			newSyscall("trap_BotMoveInDirection", 4),
+			newSyscall("trap_BotResetAvoidReach", 1),
+			newSyscall("trap_BotResetLastAvoidReach", 1),
+			newSyscall("trap_BotReachabilityArea", 2),
+			newSyscall("trap_BotMovementViewTarget", 5),
+			newSyscall("trap_BotAllocMoveState", 0),
+			newSyscall("trap_BotFreeMoveState", 1),
+			newSyscall("trap_BotInitMoveState", 2),
+			newSyscall("trap_BotChooseBestFightWeapon", 2),
+			newSyscall("trap_BotGetWeaponInfo", 3),
+			newSyscall("trap_BotLoadWeaponWeights", 2),
+			newSyscall("trap_BotAllocWeaponState", 0),
+			newSyscall("trap_BotFreeWeaponState", 1),
+			newSyscall("trap_BotResetWeaponState", 1),
+			newSyscall("trap_GeneticParentsAndChildSelection", 5),
+			newSyscall("trap_BotInterbreedGoalFuzzyLogic", 3),
+			newSyscall("trap_BotMutateGoalFuzzyLogic", 2),
+			newSyscall("trap_BotGetNextCampSpotGoal", 2),
+			newSyscall("trap_BotGetMapLocationGoal", 2),
+			newSyscall("trap_BotNumInitialChats", 2),
+			newSyscall("trap_BotGetChatMessage", 3),
+			newSyscall("trap_BotRemoveFromAvoidGoals", 2),
+			newSyscall("trap_BotPredictVisiblePosition", 5),
+			newSyscall("trap_BotSetAvoidGoalTime", 3),
+			newSyscall("trap_BotAddAvoidSpot", 4),
+			newSyscall("trap_AAS_AlternativeRouteGoals", 8),
+			newSyscall("trap_AAS_PredictRoute", 11),
+			newSyscall("trap_AAS_PointReachabilityAreaIndex", 1),
+			newSyscall("trap_BotLibLoadSource", 1),
+			newSyscall("trap_BotLibFreeSource", 1),
+			newSyscall("trap_BotLibReadToken", 2),
+			newSyscall("trap_BotLibSourceFileAndLine", 3),
+		}},
+	},
+	ModuleUI: {
+		{-1, []Syscall{
+			newSyscall("trap_Error", 1),
+			newSyscall("trap_Print", 1),
+			newSyscall("trap_Milliseconds", 0),
+			newSyscall("trap_Cvar_Set", 2),
+			newSyscall("trap_Cvar_VariableValue", 1),
+			newSyscall("trap_Cvar_VariableStringBuffer", 3),
+			newSyscall("trap_Cvar_SetValue", 2),
+			newSyscall("trap_Cvar_Reset", 1),
+			newSyscall("trap_Cvar_Create", 3),
+			newSyscall("trap_Cvar_InfoStringBuffer", 3),
+			newSyscall("trap_Argc", 0),
+			newSyscall("trap_Argv", 3),
+			newSyscall("trap_Cmd_ExecuteText", 2),
+			newSyscall("trap_FS_FOpenFile", 3),
+			newSyscall("trap_FS_Read", 3),
+			newSyscall("trap_FS_Write", 3),
+			newSyscall("trap_FS_FCloseFile", 1),
+			newSyscall("trap_FS_GetFileList", 4),
+			newSyscall("trap_R_RegisterModel", 1),
+			newSyscall("trap_R_RegisterSkin", 1),
+			newSyscall("trap_R_RegisterShaderNoMip", 1),
+			newSyscall("trap_R_ClearScene", 0),
+			newSyscall("trap_R_AddRefEntityToScene", 1),
+			newSyscall("trap_R_AddPolyToScene", 3),
+			newSyscall("trap_R_AddLightToScene", 5),
+			newSyscall("trap_R_RenderScene", 1),
+			newSyscall("trap_R_SetColor", 1),
+			newSyscall("trap_R_DrawStretchPic", 9),
+			newSyscall("trap_UpdateScreen", 0),
+			newSyscall("trap_CM_LerpTag", 6),
+			newSyscall("trap_CM_LoadModel", -1),
+			newSyscall("trap_S_RegisterSound", 2),
+			newSyscall("trap_S_StartLocalSound", 2),
+			newSyscall("trap_Key_KeynumToStringBuf", 3),
+			newSyscall("trap_Key_GetBindingBuf", 3),
+			newSyscall("trap_Key_SetBinding", 2),
+			newSyscall("trap_Key_IsDown", 1),
+			newSyscall("trap_Key_GetOverstrikeMode", 0),
+			newSyscall("trap_Key_SetOverstrikeMode", 1),
+			newSyscall("trap_Key_ClearStates", 0),
+			newSyscall("trap_Key_GetCatcher", 0),
+			newSyscall("trap_Key_SetCatcher", 1),
+			newSyscall("trap_GetClipboardData", 2),
+			newSyscall("trap_GetGlconfig", 1),
+			newSyscall("trap_GetClientState", 1),
+			newSyscall("trap_GetConfigString", 3),
+			newSyscall("trap_LAN_GetPingQueueCount", 0),
+			newSyscall("trap_LAN_ClearPing", 1),
+			newSyscall("trap_LAN_GetPing", 4),
+			newSyscall("trap_LAN_GetPingInfo", 3),
+			newSyscall("trap_Cvar_Register", 4),
+			newSyscall("trap_Cvar_Update", 1),
+			newSyscall("trap_MemoryRemaining", 0),
+			newSyscall("trap_GetCDKey", 2),
+			newSyscall("trap_SetCDKey", 1),
+			newSyscall("trap_R_RegisterFont", 3),
+			newSyscall("trap_R_ModelBounds", 3),
+			newSyscall("trap_PC_AddGlobalDefine", 1),
+			newSyscall("trap_PC_LoadSource", 1),
+			newSyscall("trap_PC_FreeSource", 1),
+			newSyscall("trap_PC_ReadToken", 2),
+			newSyscall("trap_PC_SourceFileAndLine", 3),
+			newSyscall("trap_S_StopBackgroundTrack", 0),
+			newSyscall("trap_S_StartBackgroundTrack", 2),
+			newSyscall("trap_RealTime", 1),
+			newSyscall("trap_LAN_GetServerCount", 1),
+			newSyscall("trap_LAN_GetServerAddressString", 4),
+			newSyscall("trap_LAN_GetServerInfo", 4),
+			newSyscall("trap_LAN_MarkServerVisible", 3),
+			newSyscall("trap_LAN_UpdateVisiblePings", 1),
+			newSyscall("trap_LAN_ResetPings", 1),
+			newSyscall("trap_LAN_LoadCachedServers", 0),
+			newSyscall("trap_LAN_SaveCachedServers", 0),
+			newSyscall("trap_LAN_AddServer", 3),
+			newSyscall("trap_LAN_RemoveServer", 2),
+			newSyscall("trap_CIN_PlayCinematic", 6),
+			newSyscall("trap_CIN_StopCinematic", 1),
+			newSyscall("trap_CIN_RunCinematic", 1),
+			newSyscall("trap_CIN_DrawCinematic", 1),
+			newSyscall("trap_CIN_SetExtents", 5),
+			newSyscall("trap_R_RemapShader", 3),
+			newSyscall("trap_VerifyCDKey", 2),
+			newSyscall("trap_LAN_ServerStatus", 3),
+			newSyscall("trap_LAN_GetServerPing", 2),
+			newSyscall("trap_LAN_ServerIsVisible", 2),
+			newSyscall("trap_LAN_CompareServers", 5),
+			newSyscall("trap_FS_Seek", 3),
+			newSyscall("trap_SetPbClStatus", 1),
+		}},
+		{-101, []Syscall{
+			newSyscall("memset", 3),
+			newSyscall("memcpy", 3),
+			newSyscall("strncpy", 3),
+			newSyscall("sin", 1),
+			newSyscall("cos", 1),
+			newSyscall("atan2", 2),
+			newSyscall("sqrt", 1),
+			newSyscall("floor", 1),
+			newSyscall("ceil", 1),
+		}},
+	},
+}
+
+//quake3eSyscalls are what Quake3e adds to every module: trap_GetValue
+//looks up the numbers of further extensions by name.
+var quake3eSyscalls = []syscallRun{
+	{-701, []Syscall{
+		newSyscall("trap_GetValue", 3),
+	}},
+}
+
+//BuiltinSyscalls returns the syscalls module m can call on engine e by
+//number. It is empty when the module is unknown, since the modules number
+//their syscalls differently.
+func BuiltinSyscalls(m Module, e Engine) map[int]Syscall {
+	syscalls := make(map[int]Syscall)
+	runs := q3Syscalls[m]
+	if len(runs) > 0 && e == EngineQuake3e {
+		runs = append(append([]syscallRun{}, runs...), quake3eSyscalls...)
+	}
+	addRuns(syscalls, runs)
+	return syscalls
+}
+
+//addRuns numbers the syscalls of runs into syscalls.
+func addRuns(syscalls map[int]Syscall, runs []syscallRun) {
+	for _, run := range runs {
+		for n, sc := range run.Calls {
+			syscalls[run.First-n] = sc
+		}
+	}
+}
+
+//SelectSyscalls sets ctx.Syscalls to the built-in table of ctx.Module and
+//ctx.Engine with the entries of user replacing theirs. A user entry
+//without an argument count keeps the built-in one. Syscalls without a
+//prototype take the one the type library declares under their name.
+func (ctx *Context) SelectSyscalls(user map[int]Syscall) {
+	ctx.Syscalls = BuiltinSyscalls(ctx.Module, ctx.Engine)
+	for num, sc := range user {
+		if builtin, exists := ctx.Syscalls[num]; exists && sc.Argc < 0 {
+			sc.Argc = builtin.Argc
+		}
+		ctx.Syscalls[num] = sc
+	}
+	for num, sc := range ctx.Syscalls {
+		fn, exists := ctx.TypeLib.Funcs[sc.Name]
+		if !exists || sc.Type != nil || fn.Kind != CFunc {
+			continue
+		}
+		sc.Type = fn
+		if sc.Argc < 0 && !fn.Variadic {
+			sc.Argc = len(fn.Params)
+		}
+		ctx.Syscalls[num] = sc
+	}
+}
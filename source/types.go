@@ -0,0 +1,311 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+//Type is what type inference found a value or variable to be. When
+//evidence conflicts the type listed later wins, so a value that is both
+//added to and used as a float is a float.
+type Type int
+
+const (
+	TypeUnknown Type = iota
+	TypeInt
+	TypePointer
+	TypeFloat
+	TypeShort
+	TypeChar
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypePointer:
+		return "void *"
+	case TypeFloat:
+		return "float"
+	case TypeShort:
+		return "short"
+	case TypeChar:
+		return "char"
+	}
+	return "int"
+}
+
+//PointerTo returns the C type of a pointer to t.
+func (t Type) PointerTo() string {
+	return cDecl(t.String(), "*")
+}
+
+//TypeInfo holds the result of type inference. Arguments are locals of the
+//procedure at their frame offset.
+type TypeInfo struct {
+	Locals  map[int]map[int32]Type //by procedure start, then frame offset
+	Globals map[uint32]Type
+	Returns map[int]Type //by procedure start
+	Consts  map[int]Type //type of the value of every CONST instruction
+}
+
+//Local returns the type of the frame slot at off of proc.
+func (ti *TypeInfo) Local(proc *Procedure, off int) Type {
+	if ti == nil {
+		return TypeUnknown
+	}
+	return ti.Locals[proc.StartInstruction][int32(off)]
+}
+
+//Global returns the type of the global at addr.
+func (ti *TypeInfo) Global(addr uint32) Type {
+	if ti == nil {
+		return TypeUnknown
+	}
+	return ti.Globals[addr]
+}
+
+//Const returns the type of the value CONST instruction insn pushes.
+func (ti *TypeInfo) Const(insn int) Type {
+	if ti == nil {
+		return TypeUnknown
+	}
+	return ti.Consts[insn]
+}
+
+//FloatString prints the float whose bits are v as a C literal, or returns
+//false if it has none.
+func FloatString(v uint32) (string, bool) {
+	f := math.Float32frombits(v)
+	if math.IsInf(float64(f), 0) || math.IsNaN(float64(f)) {
+		return "", false
+	}
+	s := strconv.FormatFloat(float64(f), 'g', -1, 32)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s + "f", true
+}
+
+const (
+	varLocal = iota
+	varGlobal
+	varReturn
+	varField //proc is the variable holding the struct pointer, addr the offset
+)
+
+type typeVar struct {
+	kind int
+	proc int
+	addr int32
+}
+
+//valueType is the type of a 4 byte value read from a variable of type t.
+//Narrow variables are read as ints.
+func valueType(t Type) Type {
+	if t == TypeChar || t == TypeShort {
+		return TypeInt
+	}
+	return t
+}
+
+//ParseTypes infers the types of values, locals, arguments, globals and
+//return values. Float opcodes make floats, the integer only opcodes make
+//ints, loaded and stored addresses are pointers, and LOAD1/STORE1 and
+//LOAD2/STORE2 make char and short variables. Types flow through phis, to
+//and from the variables LOCAL and CONST addresses name, from arguments to
+//parameters and from LEAVE to the results of calls, until nothing changes.
+func (ctx *Context) ParseTypes() error {
+	hdr := ctx.QvmFile.Header
+	imageEnd := hdr.DataLength + hdr.LitLength + hdr.BssLength
+	funcs := make([]*SSAFunc, 0, len(ctx.Procs))
+	for _, proc := range ctx.SortedProcs() {
+		funcs = append(funcs, ctx.Lift(proc))
+	}
+
+	vals := make(map[*Value]Type)
+	vars := make(map[typeVar]Type)
+	changed := true
+	set := func(v *Value, t Type) {
+		if t = valueType(t); t > vals[v] {
+			vals[v] = t
+			changed = true
+		}
+	}
+	setVar := func(tv typeVar, t Type) {
+		if t > vars[tv] {
+			vars[tv] = t
+			changed = true
+		}
+	}
+	location := func(f *SSAFunc, addr *Value) (typeVar, bool) {
+		switch {
+		case addr.Op == OP_LOCAL:
+			return typeVar{varLocal, f.Proc.StartInstruction, addr.Aux}, true
+		case addr.Op == OP_CONST && addr.Aux >= 0 && uint32(addr.Aux) < imageEnd:
+			return typeVar{varGlobal, 0, addr.Aux}, true
+		}
+		return typeVar{}, false
+	}
+	unify := func(a, b *Value) {
+		set(a, vals[b])
+		set(b, vals[a])
+	}
+	widths := map[int]Type{OP_LOAD1: TypeChar, OP_LOAD2: TypeShort, OP_STORE1: TypeChar, OP_STORE2: TypeShort}
+
+	for changed {
+		changed = false
+		for _, f := range funcs {
+			for _, sb := range f.Blocks {
+				for _, v := range sb.Phis {
+					for _, arg := range v.Args {
+						unify(v, arg)
+					}
+				}
+				for _, v := range sb.Values {
+					var a, b *Value
+					if len(v.Args) > 0 {
+						a = v.Args[0]
+					}
+					if len(v.Args) > 1 {
+						b = v.Args[1]
+					}
+					switch op := v.Op; {
+					case op == OP_LOCAL:
+						set(v, TypePointer)
+					case op == OP_LOAD1, op == OP_LOAD2:
+						set(a, TypePointer)
+						set(v, TypeInt)
+						if tv, ok := location(f, a); ok {
+							setVar(tv, widths[op])
+						}
+					case op == OP_LOAD4:
+						set(a, TypePointer)
+						if tv, ok := location(f, a); ok {
+							set(v, vars[tv])
+							setVar(tv, vals[v])
+						}
+					case op == OP_STORE1, op == OP_STORE2:
+						set(a, TypePointer)
+						set(b, TypeInt)
+						if tv, ok := location(f, a); ok {
+							setVar(tv, widths[op])
+						}
+					case op == OP_STORE4:
+						set(a, TypePointer)
+						if tv, ok := location(f, a); ok {
+							setVar(tv, vals[b])
+							set(b, vars[tv])
+						}
+					case op == OP_BLOCK_COPY:
+						set(a, TypePointer)
+						set(b, TypePointer)
+					case op >= OP_ADDF && op <= OP_MULF, op == OP_NEGF:
+						set(v, TypeFloat)
+						for _, arg := range v.Args {
+							set(arg, TypeFloat)
+						}
+					case op >= OP_EQF && op <= OP_GEF:
+						set(a, TypeFloat)
+						set(b, TypeFloat)
+					case op == OP_CVIF:
+						set(a, TypeInt)
+						set(v, TypeFloat)
+					case op == OP_CVFI:
+						set(a, TypeFloat)
+						set(v, TypeInt)
+					case op >= OP_LTI && op <= OP_GEI:
+						set(a, TypeInt)
+						set(b, TypeInt)
+					case op == OP_EQ, op == OP_NE, op >= OP_LTU && op <= OP_GEU:
+						unify(a, b)
+					case op == OP_ADD:
+						if vals[a] == TypePointer || vals[b] == TypePointer {
+							set(v, TypePointer)
+						} else if vals[a] == TypeInt && vals[b] == TypeInt {
+							set(v, TypeInt)
+						}
+					case op == OP_SUB:
+						switch {
+						case vals[a] == TypePointer && vals[b] == TypePointer:
+							set(v, TypeInt)
+						case vals[a] == TypePointer:
+							set(v, TypePointer)
+						case vals[a] == TypeInt && vals[b] == TypeInt:
+							set(v, TypeInt)
+						}
+					case op >= OP_SEX8 && op <= OP_NEGI, op >= OP_DIVI && op <= OP_RSHU:
+						set(v, TypeInt)
+						for _, arg := range v.Args {
+							set(arg, TypeInt)
+						}
+					case op == OP_CALL:
+						if a.Op != OP_CONST {
+							set(a, TypePointer)
+							break
+						}
+						callee, exists := ctx.Procs[int(a.Aux)]
+						if !exists {
+							break
+						}
+						for n, arg := range v.Args[1:] {
+							param := typeVar{varLocal, callee.StartInstruction, int32(callee.FrameSize + 8 + 4*n)}
+							setVar(param, vals[arg])
+							set(arg, vars[param])
+						}
+						ret := typeVar{varReturn, callee.StartInstruction, 0}
+						set(v, vars[ret])
+						setVar(ret, vals[v])
+					case op == OP_LEAVE:
+						if a.Op != OP_PUSH {
+							ret := typeVar{varReturn, f.Proc.StartInstruction, 0}
+							setVar(ret, vals[a])
+							set(a, vars[ret])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	ti := &TypeInfo{make(map[int]map[int32]Type), make(map[uint32]Type), make(map[int]Type), make(map[int]Type)}
+	for tv, t := range vars {
+		switch tv.kind {
+		case varLocal:
+			if ti.Locals[tv.proc] == nil {
+				ti.Locals[tv.proc] = make(map[int32]Type)
+			}
+			ti.Locals[tv.proc][tv.addr] = t
+		case varGlobal:
+			ti.Globals[uint32(tv.addr)] = t
+		case varReturn:
+			ti.Returns[tv.proc] = t
+		}
+	}
+	for _, f := range funcs {
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Values {
+				if v.Op == OP_CONST {
+					ti.Consts[v.Insn] = vals[v]
+				}
+			}
+		}
+	}
+	ctx.Types = ti
+	return nil
+}
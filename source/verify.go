@@ -0,0 +1,189 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"qvm"
+)
+
+//Width in bytes of the memory access done by the load and store opcodes.
+var accessWidth = map[int]uint32{
+	OP_LOAD1: 1, OP_LOAD2: 2, OP_LOAD4: 4,
+	OP_STORE1: 1, OP_STORE2: 2, OP_STORE4: 4,
+}
+
+//Verify runs the checks the engine's loader does before it accepts a QVM
+//and returns every violation it finds. Issues that concern the file rather
+//than an instruction have an Insn of -1.
+//
+//The checks are: the code decodes into InstructionCount instructions with
+//valid opcodes and complete operands; every procedure starts with ENTER
+//and ends with a LEAVE matching its frame size; branch and jump targets
+//stay inside their procedure; CONST call targets are procedure starts
+//within InstructionCount; the VER2 jump table is well formed and covers
+//every computed jump; ARG writes stay inside the caller's frame; constant
+//data addresses used by loads, stores and BLOCK_COPY fit the data mask;
+//and the op stack is used consistently.
+func Verify(qvmFile *qvm.File, ctx *Context) []Issue {
+	issues := make([]Issue, 0)
+	add := func(insn int, format string, args ...interface{}) {
+		issues = append(issues, Issue{insn, fmt.Sprintf(format, args...)})
+	}
+	hdr := qvmFile.Header
+	count := int(hdr.InstructionCount)
+	mask := qvmFile.DataMask()
+
+	if len(ctx.Insns) < count {
+		add(-1, "Code ends after %d of %d instructions", len(ctx.Insns), count)
+	}
+	if len(ctx.Insns) > 0 {
+		last := ctx.Insns[len(ctx.Insns)-1]
+		if end := last.Offset + 1 + last.ArgLength(); last.Valid && end < len(qvmFile.Code) {
+			add(-1, "%d bytes of code after the last instruction", len(qvmFile.Code)-end)
+		}
+	}
+	for i, insn := range ctx.Insns {
+		if insn.Valid {
+			continue
+		}
+		if insn.Op < len(MnemonicTable) {
+			add(i, "%s operand runs past the end of the code", MnemonicTable[insn.Op])
+		} else {
+			add(i, "Invalid opcode %d", insn.Op)
+		}
+	}
+
+	//Jump table
+	jumpTargets := make(map[int]bool)
+	if hdr.Magic == qvm.VM_MAGIC_VER2 {
+		if hdr.JumpTableLength%4 != 0 {
+			add(-1, "Jump table length %d is not a multiple of 4", hdr.JumpTableLength)
+		}
+		if len(qvmFile.JumpTable) != int(hdr.JumpTableLength) {
+			add(-1, "Jump table of %d bytes is missing from the file", hdr.JumpTableLength)
+		}
+		for k, tgt := range qvmFile.JumpTableTargets() {
+			if tgt < 0 || tgt >= count {
+				add(-1, "Jump table entry %d targets instruction %d of %d", k, tgt, count)
+				continue
+			}
+			jumpTargets[tgt] = true
+		}
+	}
+
+	for _, proc := range ctx.SortedProcs() {
+		start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+		if ctx.Insns[start].Op != OP_ENTER {
+			add(start, "Procedure does not start with ENTER")
+		} else if proc.FrameSize%4 != 0 || proc.FrameSize < 8 {
+			add(start, "ENTER frame size 0x%x is not a multiple of 4 of at least 8", proc.FrameSize)
+		}
+		if ctx.Insns[end-1].Op != OP_LEAVE {
+			add(end-1, "Procedure does not end with LEAVE")
+		}
+
+		computedJump := false
+		for i := start; i < end; i++ {
+			insn := ctx.Insns[i]
+			if !insn.Valid {
+				continue
+			}
+			arg := insn.IntArg()
+			switch {
+			case insn.Op == OP_LEAVE:
+				if int(arg) != proc.FrameSize {
+					add(i, "LEAVE 0x%x does not match ENTER 0x%x", arg, proc.FrameSize)
+				}
+			case insn.Op == OP_ENTER && i != start:
+				add(i, "ENTER in the middle of a procedure")
+			case IsBranch(insn.Op):
+				switch tgt := int(arg); {
+				case tgt < 0 || tgt >= count:
+					add(i, "%s target %d outside of the code", insn.Mnemonic(), tgt)
+				case tgt < start || tgt >= end:
+					add(i, "%s target 0x%08x outside of the procedure", insn.Mnemonic(), tgt)
+				}
+			case insn.Op == OP_JUMP:
+				if i > start && ctx.Insns[i-1].Op == OP_CONST {
+					if tgt := int(ctx.Insns[i-1].IntArg()); tgt < start || tgt >= end {
+						add(i, "JUMP target 0x%08x outside of the procedure", uint32(tgt))
+					}
+					break
+				}
+				computedJump = true
+				if hdr.Magic == qvm.VM_MAGIC_VER2 {
+					if _, ok := ctx.JumpTargets(proc, i); !ok {
+						add(i, "Computed JUMP without jump table targets in the procedure")
+					}
+				}
+			case insn.Op == OP_CALL:
+				if i == start || ctx.Insns[i-1].Op != OP_CONST {
+					break
+				}
+				tgt := int(ctx.Insns[i-1].IntArg())
+				switch {
+				case tgt < 0:
+				case tgt >= count || tgt >= len(ctx.Insns):
+					add(i, "CALL target %d outside of the code", tgt)
+				case ctx.Insns[tgt].Op != OP_ENTER:
+					add(i, "CALL target 0x%08x is not a procedure start", tgt)
+				}
+			case insn.Op == OP_ARG:
+				if arg < 8 || int(arg)+4 > proc.FrameSize {
+					add(i, "ARG 0x%x outside of the frame of size 0x%x", arg, proc.FrameSize)
+				}
+			}
+		}
+		for tgt := range jumpTargets {
+			if tgt >= start && tgt < end && !computedJump {
+				add(tgt, "Jump table target in a procedure without a computed JUMP")
+			}
+		}
+
+		//Constant data addresses.
+		for i, operands := range ctx.OperandSources(proc) {
+			insn := ctx.Insns[i]
+			addrs := make([]int, 0, 2)
+			width := accessWidth[insn.Op]
+			switch {
+			case insn.Op >= OP_LOAD1 && insn.Op <= OP_LOAD4:
+				addrs = append(addrs, operands[0])
+			case insn.Op >= OP_STORE1 && insn.Op <= OP_STORE4:
+				addrs = append(addrs, operands[0])
+			case insn.Op == OP_BLOCK_COPY:
+				addrs = append(addrs, operands...)
+				width = uint32(insn.IntArg())
+			}
+			for _, src := range addrs {
+				if src < 0 || ctx.Insns[src].Op != OP_CONST {
+					continue
+				}
+				addr := uint32(ctx.Insns[src].IntArg())
+				if addr&^mask != 0 || uint64(addr)+uint64(width) > uint64(mask)+1 {
+					add(i, "%s of 0x%x bytes at 0x%08x outside of the data mask 0x%08x", insn.Mnemonic(), width, addr, mask)
+				}
+			}
+		}
+
+		for _, issue := range ctx.AnalyzeStack(proc).Issues {
+			issues = append(issues, issue)
+		}
+	}
+	sortIssues(issues)
+	return issues
+}
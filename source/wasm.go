@@ -0,0 +1,775 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"fmt"
+	"sort"
+)
+
+//WebAssembly opcodes and section ids used by the backend and the validator.
+const (
+	wasmUnreachable   = 0x00
+	wasmNop           = 0x01
+	wasmBlock         = 0x02
+	wasmLoop          = 0x03
+	wasmIf            = 0x04
+	wasmElse          = 0x05
+	wasmEnd           = 0x0b
+	wasmBr            = 0x0c
+	wasmBrIf          = 0x0d
+	wasmBrTable       = 0x0e
+	wasmReturn        = 0x0f
+	wasmCall          = 0x10
+	wasmCallIndirect  = 0x11
+	wasmDrop          = 0x1a
+	wasmSelect        = 0x1b
+	wasmLocalGet      = 0x20
+	wasmLocalSet      = 0x21
+	wasmLocalTee      = 0x22
+	wasmGlobalGet     = 0x23
+	wasmGlobalSet     = 0x24
+	wasmI32Load       = 0x28
+	wasmI32Load8U     = 0x2d
+	wasmI32Load16U    = 0x2f
+	wasmI32Store      = 0x36
+	wasmI32Store8     = 0x3a
+	wasmI32Store16    = 0x3b
+	wasmI32Const      = 0x41
+	wasmI32Eq         = 0x46
+	wasmI32Ne         = 0x47
+	wasmI32LtS        = 0x48
+	wasmI32LtU        = 0x49
+	wasmI32GtS        = 0x4a
+	wasmI32GtU        = 0x4b
+	wasmI32LeS        = 0x4c
+	wasmI32LeU        = 0x4d
+	wasmI32GeS        = 0x4e
+	wasmI32GeU        = 0x4f
+	wasmF32Eq         = 0x5b
+	wasmF32Ne         = 0x5c
+	wasmF32Lt         = 0x5d
+	wasmF32Gt         = 0x5e
+	wasmF32Le         = 0x5f
+	wasmF32Ge         = 0x60
+	wasmI32Add        = 0x6a
+	wasmI32Sub        = 0x6b
+	wasmI32Mul        = 0x6c
+	wasmI32DivS       = 0x6d
+	wasmI32DivU       = 0x6e
+	wasmI32RemS       = 0x6f
+	wasmI32RemU       = 0x70
+	wasmI32And        = 0x71
+	wasmI32Or         = 0x72
+	wasmI32Xor        = 0x73
+	wasmI32Shl        = 0x74
+	wasmI32ShrS       = 0x75
+	wasmI32ShrU       = 0x76
+	wasmF32Neg        = 0x8c
+	wasmF32Add        = 0x92
+	wasmF32Sub        = 0x93
+	wasmF32Mul        = 0x94
+	wasmF32Div        = 0x95
+	wasmF32ConvertI32 = 0xb2
+	wasmI32ReinterpF  = 0xbc
+	wasmF32ReinterpI  = 0xbe
+	wasmI32Extend8S   = 0xc0
+	wasmI32Extend16S  = 0xc1
+	wasmPrefixFC      = 0xfc
+
+	//Sub-opcodes behind wasmPrefixFC.
+	wasmI32TruncSatF32S = 0x00
+	wasmMemoryCopy      = 0x0a
+
+	wasmTypeI32    = 0x7f
+	wasmTypeF32    = 0x7d
+	wasmTypeFunc   = 0x60
+	wasmTypeFunc2  = 0x70
+	wasmBlockEmpty = 0x40
+
+	wasmSecCustom   = 0
+	wasmSecType     = 1
+	wasmSecImport   = 2
+	wasmSecFunction = 3
+	wasmSecTable    = 4
+	wasmSecMemory   = 5
+	wasmSecGlobal   = 6
+	wasmSecExport   = 7
+	wasmSecStart    = 8
+	wasmSecElem     = 9
+	wasmSecCode     = 10
+	wasmSecData     = 11
+	wasmSecDataCnt  = 12
+)
+
+//Bytes reserved behind the data image for the op stack of all active
+//procedures.
+const wasmOpStackSize = 0x10000
+
+//Type indices in the generated module.
+const (
+	wasmTypeProc   = 0 //(programStack) -> result, also used by syscalls
+	wasmTypeVmMain = 1 //(command, arg0..arg11) -> result
+	wasmTypeVmCall = 2 //(target, programStack) -> result
+)
+
+//Locals of every translated procedure. Local 0 is the programStack
+//parameter.
+const (
+	wasmLocalPS   = 0
+	wasmLocalOS   = 1 //op stack pointer
+	wasmLocalA    = 2 //scratch, usually r0
+	wasmLocalB    = 3 //scratch, usually r1
+	wasmLocalPC   = 4 //segment index for the dispatch loop
+	wasmLocalT    = 5 //scratch
+	wasmLocalBase = 6 //op stack pointer on entry
+)
+
+//Globals of the generated module.
+const (
+	wasmGlobalOpStack      = 0
+	wasmGlobalProgramStack = 1
+)
+
+type wasmCode []byte
+
+func (c *wasmCode) op(ops ...byte) {
+	*c = append(*c, ops...)
+}
+
+func (c *wasmCode) u32(v uint32) {
+	*c = appendULEB(*c, v)
+}
+
+func (c *wasmCode) i32(v int32) {
+	*c = append(*c, wasmI32Const)
+	*c = appendSLEB(*c, v)
+}
+
+func (c *wasmCode) local(op byte, idx uint32) {
+	c.op(op)
+	c.u32(idx)
+}
+
+func (c *wasmCode) mem(op byte) {
+	//Alignment hint 0 since QVM code is free to do unaligned accesses.
+	c.op(op, 0, 0)
+}
+
+//pop moves the top of the op stack into local idx.
+func (c *wasmCode) pop(idx uint32) {
+	c.local(wasmLocalGet, wasmLocalOS)
+	c.i32(4)
+	c.op(wasmI32Sub)
+	c.local(wasmLocalTee, wasmLocalOS)
+	c.mem(wasmI32Load)
+	c.local(wasmLocalSet, idx)
+}
+
+//push pushes whatever value is computed by the code in value.
+func (c *wasmCode) push(value func()) {
+	c.local(wasmLocalGet, wasmLocalOS)
+	value()
+	c.mem(wasmI32Store)
+	c.local(wasmLocalGet, wasmLocalOS)
+	c.i32(4)
+	c.op(wasmI32Add)
+	c.local(wasmLocalSet, wasmLocalOS)
+}
+
+//masked pushes the value of local idx, masked to the data image.
+func (c *wasmCode) masked(idx uint32, mask uint32) {
+	c.local(wasmLocalGet, idx)
+	c.i32(int32(mask))
+	c.op(wasmI32And)
+}
+
+func appendULEB(b []byte, v uint32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func appendSLEB(b []byte, v int32) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendName(b []byte, name string) []byte {
+	b = appendULEB(b, uint32(len(name)))
+	return append(b, name...)
+}
+
+func appendSection(b []byte, id byte, body []byte) []byte {
+	b = append(b, id)
+	b = appendULEB(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+var wasmIntCompare = map[int]byte{
+	OP_EQ: wasmI32Eq, OP_NE: wasmI32Ne,
+	OP_LTI: wasmI32LtS, OP_LEI: wasmI32LeS, OP_GTI: wasmI32GtS, OP_GEI: wasmI32GeS,
+	OP_LTU: wasmI32LtU, OP_LEU: wasmI32LeU, OP_GTU: wasmI32GtU, OP_GEU: wasmI32GeU,
+}
+
+var wasmFloatCompare = map[int]byte{
+	OP_EQF: wasmF32Eq, OP_NEF: wasmF32Ne, OP_LTF: wasmF32Lt,
+	OP_LEF: wasmF32Le, OP_GTF: wasmF32Gt, OP_GEF: wasmF32Ge,
+}
+
+var wasmIntBinary = map[int]byte{
+	OP_ADD: wasmI32Add, OP_SUB: wasmI32Sub, OP_DIVI: wasmI32DivS, OP_DIVU: wasmI32DivU,
+	OP_MODI: wasmI32RemS, OP_MODU: wasmI32RemU, OP_MULI: wasmI32Mul, OP_MULU: wasmI32Mul,
+	OP_BAND: wasmI32And, OP_BOR: wasmI32Or, OP_BXOR: wasmI32Xor,
+	OP_LSH: wasmI32Shl, OP_RSHI: wasmI32ShrS, OP_RSHU: wasmI32ShrU,
+}
+
+var wasmFloatBinary = map[int]byte{
+	OP_ADDF: wasmF32Add, OP_SUBF: wasmF32Sub, OP_DIVF: wasmF32Div, OP_MULF: wasmF32Mul,
+}
+
+//wasmModule holds what the procedure translator needs to know about the
+//module layout.
+type wasmModule struct {
+	ctx       *Context
+	mask      uint32
+	procIndex map[int]uint32 //StartInstruction -> function index
+	sysIndex  map[int]uint32 //syscall number -> imported function index
+	vmCall    uint32         //function index of the computed call helper
+	syscall   uint32         //function index of the generic syscall import
+}
+
+//CompileWasm translates the QVM into a binary WebAssembly module. The data
+//image lives at address 0 of the exported "memory", initialised from the
+//data and lit sections with bss left zeroed. Every procedure becomes a
+//function taking the programStack, and every syscall the code references
+//becomes a function imported from "env", named after ctx.Syscalls when
+//the number is known there. Procedures keep their current names in the
+//name section. A generic "env.syscall" import handles calls
+//through computed targets. The module exports "vmMain" with the engine's
+//calling convention.
+func (ctx *Context) CompileWasm() ([]byte, error) {
+	qvmFile := ctx.QvmFile
+	procs := ctx.SortedProcs()
+	if len(procs) == 0 {
+		return nil, fmt.Errorf("No procedures to translate")
+	}
+
+	m := &wasmModule{ctx, qvmFile.DataMask(), make(map[int]uint32), make(map[int]uint32), 0, 0}
+	imageSize := m.mask + 1
+
+	//Collect the syscalls referenced through CONST; CALL.
+	sysNums := make([]int, 0)
+	for i := 0; i+1 < len(ctx.Insns); i++ {
+		if ctx.Insns[i].Op == OP_CONST && ctx.Insns[i+1].Op == OP_CALL {
+			if num := int(ctx.Insns[i].IntArg()); num < 0 {
+				if _, exists := m.sysIndex[num]; !exists {
+					m.sysIndex[num] = 0
+					sysNums = append(sysNums, num)
+				}
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sysNums)))
+
+	//Types
+	types := appendULEB(nil, 3)
+	types = append(types, wasmTypeFunc, 1, wasmTypeI32, 1, wasmTypeI32)
+	types = append(types, wasmTypeFunc, 13)
+	for i := 0; i < 13; i++ {
+		types = append(types, wasmTypeI32)
+	}
+	types = append(types, 1, wasmTypeI32)
+	types = append(types, wasmTypeFunc, 2, wasmTypeI32, wasmTypeI32, 1, wasmTypeI32)
+
+	//Imports
+	imports := appendULEB(nil, uint32(len(sysNums)+1))
+	used := make(map[string]bool)
+	for i, num := range sysNums {
+		name := fmt.Sprintf("syscall_%d", -1-num)
+		if sc, exists := ctx.Syscalls[num]; exists && sc.Name != "" && !used[sc.Name] {
+			name = sc.Name
+		}
+		used[name] = true
+		m.sysIndex[num] = uint32(i)
+		imports = appendName(imports, "env")
+		imports = appendName(imports, name)
+		imports = append(imports, 0x00, wasmTypeProc)
+	}
+	m.syscall = uint32(len(sysNums))
+	imports = appendName(imports, "env")
+	imports = appendName(imports, "syscall")
+	imports = append(imports, 0x00, wasmTypeProc)
+
+	//Functions: procedures, then vm_call, then vmMain.
+	base := uint32(len(sysNums) + 1)
+	for i, proc := range procs {
+		m.procIndex[proc.StartInstruction] = base + uint32(i)
+	}
+	m.vmCall = base + uint32(len(procs))
+	vmMain := m.vmCall + 1
+	funcs := appendULEB(nil, uint32(len(procs)+2))
+	for _ = range procs {
+		funcs = appendULEB(funcs, wasmTypeProc)
+	}
+	funcs = appendULEB(funcs, wasmTypeVmCall)
+	funcs = appendULEB(funcs, wasmTypeVmMain)
+
+	//Table indexed by instruction number so computed calls can go through
+	//call_indirect.
+	table := []byte{1, wasmTypeFunc2, 0x00}
+	table = appendULEB(table, qvmFile.Header.InstructionCount)
+
+	pages := (imageSize + wasmOpStackSize + 0xffff) / 0x10000
+	memory := []byte{1, 0x01}
+	memory = appendULEB(memory, pages)
+	memory = appendULEB(memory, pages)
+
+	globals := appendULEB(nil, 2)
+	for i := 0; i < 2; i++ {
+		globals = append(globals, wasmTypeI32, 1, wasmI32Const)
+		globals = appendSLEB(globals, int32(imageSize))
+		globals = append(globals, wasmEnd)
+	}
+
+	exports := appendULEB(nil, 2)
+	exports = appendName(exports, "memory")
+	exports = append(exports, 0x02, 0)
+	exports = appendName(exports, "vmMain")
+	exports = append(exports, 0x00)
+	exports = appendULEB(exports, vmMain)
+
+	elems := appendULEB(nil, uint32(len(procs)))
+	for _, proc := range procs {
+		elems = append(elems, 0x00, wasmI32Const)
+		elems = appendSLEB(elems, int32(proc.StartInstruction))
+		elems = append(elems, wasmEnd, 1)
+		elems = appendULEB(elems, m.procIndex[proc.StartInstruction])
+	}
+
+	code := appendULEB(nil, uint32(len(procs)+2))
+	for _, proc := range procs {
+		body, err := m.compileProc(proc)
+		if err != nil {
+			return nil, err
+		}
+		code = appendULEB(code, uint32(len(body)))
+		code = append(code, body...)
+	}
+	body := m.compileVmCall()
+	code = appendULEB(code, uint32(len(body)))
+	code = append(code, body...)
+	body = m.compileVmMain(m.procIndex[procs[0].StartInstruction])
+	code = appendULEB(code, uint32(len(body)))
+	code = append(code, body...)
+
+	image := append(append([]byte{}, qvmFile.Data...), qvmFile.Lit...)
+	data := []byte{1, 0x00, wasmI32Const, 0, wasmEnd}
+	data = appendULEB(data, uint32(len(image)))
+	data = append(data, image...)
+
+	out := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	out = appendSection(out, wasmSecType, types)
+	out = appendSection(out, wasmSecImport, imports)
+	out = appendSection(out, wasmSecFunction, funcs)
+	out = appendSection(out, wasmSecTable, table)
+	out = appendSection(out, wasmSecMemory, memory)
+	out = appendSection(out, wasmSecGlobal, globals)
+	out = appendSection(out, wasmSecExport, exports)
+	out = appendSection(out, wasmSecElem, elems)
+	out = appendSection(out, wasmSecCode, code)
+	out = appendSection(out, wasmSecData, data)
+	out = appendSection(out, wasmSecCustom, m.nameSection(procs))
+	return out, nil
+}
+
+//nameSection gives the procedure functions their names for debuggers.
+func (m *wasmModule) nameSection(procs []*Procedure) []byte {
+	names := appendULEB(nil, uint32(len(procs)))
+	for _, proc := range procs {
+		names = appendULEB(names, m.procIndex[proc.StartInstruction])
+		names = appendName(names, proc.Name)
+	}
+	sec := appendName(nil, "name")
+	sec = append(sec, 1)
+	sec = appendULEB(sec, uint32(len(names)))
+	return append(sec, names...)
+}
+
+//syscallSeq calls fn with the args pointer of a syscall made from a
+//procedure frame, following the engine: the syscall number goes in front
+//of the arguments and the programStack is lowered so a reentrant vmMain
+//does not clobber the frame. The number is expected in wasmLocalA and
+//the result is left in wasmLocalB.
+func (c *wasmCode) syscallSeq(fn uint32) {
+	c.local(wasmLocalGet, wasmLocalPS)
+	c.i32(4)
+	c.op(wasmI32Add)
+	c.i32(-1)
+	c.local(wasmLocalGet, wasmLocalA)
+	c.op(wasmI32Sub)
+	c.mem(wasmI32Store)
+	c.local(wasmGlobalGet, wasmGlobalProgramStack)
+	c.local(wasmLocalSet, wasmLocalT)
+	c.local(wasmLocalGet, wasmLocalPS)
+	c.i32(4)
+	c.op(wasmI32Sub)
+	c.local(wasmGlobalSet, wasmGlobalProgramStack)
+	c.local(wasmLocalGet, wasmLocalPS)
+	c.i32(4)
+	c.op(wasmI32Add)
+	c.local(wasmCall, fn)
+	c.local(wasmLocalSet, wasmLocalB)
+	c.local(wasmLocalGet, wasmLocalT)
+	c.local(wasmGlobalSet, wasmGlobalProgramStack)
+}
+
+func (m *wasmModule) compileVmCall() []byte {
+	//Params: 0 target, 1 programStack. Locals are laid out so syscallSeq
+	//can be shared with the procedures.
+	c := wasmCode{1, 4, wasmTypeI32}
+	c.local(wasmLocalGet, 0)
+	c.local(wasmLocalSet, wasmLocalA)
+	c.local(wasmLocalGet, 1)
+	c.local(wasmLocalSet, wasmLocalPS)
+	c.local(wasmLocalGet, wasmLocalA)
+	c.i32(0)
+	c.op(wasmI32LtS, wasmIf, wasmBlockEmpty)
+	c.syscallSeq(m.syscall)
+	c.local(wasmLocalGet, wasmLocalB)
+	c.op(wasmReturn, wasmEnd)
+	c.local(wasmLocalGet, wasmLocalPS)
+	c.local(wasmLocalGet, wasmLocalA)
+	c.local(wasmCallIndirect, wasmTypeProc)
+	c.op(0x00, wasmEnd)
+	return c
+}
+
+func (m *wasmModule) compileVmMain(entry uint32) []byte {
+	//Params 0-12 are command and arguments, 13 is saved, 14 programStack.
+	c := wasmCode{1, 2, wasmTypeI32}
+	c.local(wasmGlobalGet, wasmGlobalProgramStack)
+	c.local(wasmLocalTee, 13)
+	c.i32(8 + 4*13)
+	c.op(wasmI32Sub)
+	c.local(wasmLocalSet, 14)
+	c.local(wasmLocalGet, 14)
+	c.i32(-1)
+	c.mem(wasmI32Store)
+	c.local(wasmLocalGet, 14)
+	c.i32(0)
+	c.op(wasmI32Store, 0, 4)
+	for i := uint32(0); i < 13; i++ {
+		c.local(wasmLocalGet, 14)
+		c.local(wasmLocalGet, i)
+		c.op(wasmI32Store, 0)
+		c.u32(8 + 4*i)
+	}
+	c.local(wasmLocalGet, 14)
+	c.local(wasmGlobalSet, wasmGlobalProgramStack)
+	c.local(wasmLocalGet, 14)
+	c.local(wasmCall, entry)
+	c.local(wasmLocalGet, 13)
+	c.local(wasmGlobalSet, wasmGlobalProgramStack)
+	c.op(wasmEnd)
+	return c
+}
+
+func (m *wasmModule) compileProc(proc *Procedure) ([]byte, error) {
+	ctx := m.ctx
+	start, end := proc.StartInstruction, proc.StartInstruction+proc.InstructionCount
+
+	//Split the procedure into segments at branch targets and after
+	//branches. A JUMP through a computed target can land anywhere, so in
+	//that case every instruction starts a segment.
+	leaders := map[int]bool{start: true}
+	computedJump := false
+	for i := start; i < end; i++ {
+		insn := ctx.Insns[i]
+		switch {
+		case !insn.Valid:
+		case insn.Op >= OP_EQ && insn.Op <= OP_GEF:
+			if tgt := int(insn.IntArg()); tgt >= start && tgt < end {
+				leaders[tgt] = true
+			}
+			leaders[i+1] = true
+		case insn.Op == OP_JUMP:
+			if i > start && ctx.Insns[i-1].Op == OP_CONST {
+				if tgt := int(ctx.Insns[i-1].IntArg()); tgt >= start && tgt < end {
+					leaders[tgt] = true
+				}
+			} else {
+				computedJump = true
+			}
+			leaders[i+1] = true
+		}
+	}
+	if computedJump {
+		for i := start; i < end; i++ {
+			leaders[i] = true
+		}
+	}
+	segStarts := make([]int, 0, len(leaders))
+	for i := range leaders {
+		if i < end {
+			segStarts = append(segStarts, i)
+		}
+	}
+	sort.Ints(segStarts)
+	segment := make(map[int]uint32, len(segStarts))
+	for k, i := range segStarts {
+		segment[i] = uint32(k)
+	}
+	n := uint32(len(segStarts))
+
+	c := wasmCode{1, 6, wasmTypeI32}
+	c.local(wasmGlobalGet, wasmGlobalOpStack)
+	c.local(wasmLocalTee, wasmLocalOS)
+	c.local(wasmLocalSet, wasmLocalBase)
+
+	//Dispatch loop: loop { block_n-1 ... block_0 { block_trap { br_table } }
+	//unreachable; segment 0 } segment 1 ... }
+	c.op(wasmLoop, wasmBlockEmpty)
+	for k := uint32(0); k < n+1; k++ {
+		c.op(wasmBlock, wasmBlockEmpty)
+	}
+	c.local(wasmLocalGet, wasmLocalPC)
+	c.op(wasmBrTable)
+	c.u32(n)
+	for k := uint32(0); k < n; k++ {
+		c.u32(k + 1)
+	}
+	c.u32(0)
+	c.op(wasmEnd, wasmUnreachable, wasmEnd)
+
+	//branch continues the dispatch loop at the given segment from inside
+	//segment k, extra levels deep.
+	branch := func(k uint32, target int, extra uint32) {
+		c.i32(int32(segment[target]))
+		c.local(wasmLocalSet, wasmLocalPC)
+		c.op(wasmBr)
+		c.u32(n - 1 - k + extra)
+	}
+
+	k := uint32(0)
+	for i := start; i < end; i++ {
+		if i != start && leaders[i] {
+			c.op(wasmEnd)
+			k++
+		}
+		insn := ctx.Insns[i]
+		if !insn.Valid {
+			c.op(wasmUnreachable)
+			continue
+		}
+		arg := insn.IntArg()
+		switch op := insn.Op; {
+		case op == OP_UNDEF, op == OP_IGNORE, op == OP_BREAK:
+			c.op(wasmNop)
+		case op == OP_ENTER:
+			c.local(wasmLocalGet, wasmLocalPS)
+			c.i32(arg)
+			c.op(wasmI32Sub)
+			c.local(wasmLocalSet, wasmLocalPS)
+		case op == OP_LEAVE:
+			c.local(wasmLocalGet, wasmLocalOS)
+			c.i32(4)
+			c.op(wasmI32Sub)
+			c.mem(wasmI32Load)
+			c.i32(0)
+			c.local(wasmLocalGet, wasmLocalOS)
+			c.local(wasmLocalGet, wasmLocalBase)
+			c.op(wasmI32GtU, wasmSelect, wasmReturn)
+		case op == OP_CALL:
+			target := 0
+			known := i > start && ctx.Insns[i-1].Op == OP_CONST
+			if known {
+				target = int(ctx.Insns[i-1].IntArg())
+			}
+			c.pop(wasmLocalA)
+			c.local(wasmLocalGet, wasmLocalOS)
+			c.local(wasmGlobalSet, wasmGlobalOpStack)
+			fn, isProc := m.procIndex[target]
+			sys, isSys := m.sysIndex[target]
+			switch {
+			case known && isProc:
+				c.push(func() {
+					c.local(wasmLocalGet, wasmLocalPS)
+					c.local(wasmCall, fn)
+				})
+			case known && isSys:
+				c.syscallSeq(sys)
+				c.push(func() { c.local(wasmLocalGet, wasmLocalB) })
+			default:
+				c.push(func() {
+					c.local(wasmLocalGet, wasmLocalA)
+					c.local(wasmLocalGet, wasmLocalPS)
+					c.local(wasmCall, m.vmCall)
+				})
+			}
+		case op == OP_PUSH:
+			c.push(func() { c.i32(0) })
+		case op == OP_POP:
+			c.local(wasmLocalGet, wasmLocalOS)
+			c.i32(4)
+			c.op(wasmI32Sub)
+			c.local(wasmLocalSet, wasmLocalOS)
+		case op == OP_CONST:
+			c.push(func() { c.i32(arg) })
+		case op == OP_LOCAL:
+			c.push(func() {
+				c.local(wasmLocalGet, wasmLocalPS)
+				c.i32(arg)
+				c.op(wasmI32Add)
+			})
+		case op == OP_JUMP:
+			c.pop(wasmLocalA)
+			if i > start && ctx.Insns[i-1].Op == OP_CONST {
+				if tgt := int(ctx.Insns[i-1].IntArg()); tgt >= start && tgt < end {
+					branch(k, tgt, 0)
+					break
+				}
+			}
+			if !computedJump {
+				c.op(wasmUnreachable)
+				break
+			}
+			//Every instruction is a segment, so the segment index is
+			//the target relative to the start. br_table traps on
+			//anything out of range.
+			c.local(wasmLocalGet, wasmLocalA)
+			c.i32(int32(start))
+			c.op(wasmI32Sub)
+			c.local(wasmLocalSet, wasmLocalPC)
+			c.op(wasmBr)
+			c.u32(n - 1 - k)
+		case op >= OP_EQ && op <= OP_GEF:
+			c.pop(wasmLocalA)
+			c.pop(wasmLocalB)
+			c.local(wasmLocalGet, wasmLocalB)
+			if wasmFloatCompare[op] != 0 {
+				c.op(wasmF32ReinterpI)
+				c.local(wasmLocalGet, wasmLocalA)
+				c.op(wasmF32ReinterpI, wasmFloatCompare[op])
+			} else {
+				c.local(wasmLocalGet, wasmLocalA)
+				c.op(wasmIntCompare[op])
+			}
+			c.op(wasmIf, wasmBlockEmpty)
+			if tgt := int(arg); tgt >= start && tgt < end {
+				branch(k, tgt, 1)
+			} else {
+				c.op(wasmUnreachable)
+			}
+			c.op(wasmEnd)
+		case op == OP_LOAD1 || op == OP_LOAD2 || op == OP_LOAD4:
+			load := map[int]byte{OP_LOAD1: wasmI32Load8U, OP_LOAD2: wasmI32Load16U, OP_LOAD4: wasmI32Load}[op]
+			c.pop(wasmLocalA)
+			c.push(func() {
+				c.masked(wasmLocalA, m.mask)
+				c.mem(load)
+			})
+		case op == OP_STORE1 || op == OP_STORE2 || op == OP_STORE4:
+			store := map[int]byte{OP_STORE1: wasmI32Store8, OP_STORE2: wasmI32Store16, OP_STORE4: wasmI32Store}[op]
+			c.pop(wasmLocalA)
+			c.pop(wasmLocalB)
+			c.masked(wasmLocalB, m.mask)
+			c.local(wasmLocalGet, wasmLocalA)
+			c.mem(store)
+		case op == OP_ARG:
+			c.pop(wasmLocalA)
+			c.local(wasmLocalGet, wasmLocalPS)
+			c.i32(arg)
+			c.op(wasmI32Add)
+			c.local(wasmLocalGet, wasmLocalA)
+			c.mem(wasmI32Store)
+		case op == OP_BLOCK_COPY:
+			c.pop(wasmLocalA)
+			c.pop(wasmLocalB)
+			c.masked(wasmLocalB, m.mask)
+			c.masked(wasmLocalA, m.mask)
+			c.i32(arg)
+			c.op(wasmPrefixFC, wasmMemoryCopy, 0, 0)
+		case wasmIntBinary[op] != 0 || wasmFloatBinary[op] != 0:
+			c.pop(wasmLocalA)
+			c.pop(wasmLocalB)
+			c.push(func() {
+				c.local(wasmLocalGet, wasmLocalB)
+				if fop := wasmFloatBinary[op]; fop != 0 {
+					c.op(wasmF32ReinterpI)
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmF32ReinterpI, fop, wasmI32ReinterpF)
+				} else {
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmIntBinary[op])
+				}
+			})
+		case op >= OP_SEX8 && op <= OP_NEGI, op == OP_BCOM, op == OP_NEGF, op == OP_CVIF, op == OP_CVFI:
+			c.pop(wasmLocalA)
+			c.push(func() {
+				switch op {
+				case OP_SEX8:
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmI32Extend8S)
+				case OP_SEX16:
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmI32Extend16S)
+				case OP_NEGI:
+					c.i32(0)
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmI32Sub)
+				case OP_BCOM:
+					c.local(wasmLocalGet, wasmLocalA)
+					c.i32(-1)
+					c.op(wasmI32Xor)
+				case OP_NEGF:
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmF32ReinterpI, wasmF32Neg, wasmI32ReinterpF)
+				case OP_CVIF:
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmF32ConvertI32, wasmI32ReinterpF)
+				case OP_CVFI:
+					c.local(wasmLocalGet, wasmLocalA)
+					c.op(wasmF32ReinterpI, wasmPrefixFC, wasmI32TruncSatF32S)
+				}
+			})
+		default:
+			return nil, fmt.Errorf("Cannot translate %s at %d", insn.Mnemonic(), i)
+		}
+	}
+
+	//Close the last segment and the loop. Falling off the end returns 0
+	//like a procedure without a LEAVE would in the C translation.
+	c.op(wasmEnd)
+	c.i32(0)
+	c.op(wasmEnd)
+	return c, nil
+}
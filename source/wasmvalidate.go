@@ -0,0 +1,533 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//wasmReader decodes the primitive encodings of a module. Errors stick, so
+//a sequence of reads only needs to be checked once at the end.
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wasmReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("offset 0x%x: %s", r.pos, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *wasmReader) done() bool {
+	return r.err != nil || r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.fail("Unexpected end of data")
+		return 0
+	}
+	r.pos++
+	return r.data[r.pos-1]
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(r.pos)+uint64(n) > uint64(len(r.data)) {
+		r.fail("Unexpected end of data reading %d bytes", n)
+		return nil
+	}
+	r.pos += int(n)
+	return r.data[r.pos-int(n) : r.pos]
+}
+
+func (r *wasmReader) u32() uint32 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		if shift == 28 && b&0x70 != 0 {
+			r.fail("Malformed u32")
+			return 0
+		}
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return uint32(v)
+		}
+	}
+}
+
+func (r *wasmReader) sleb(bits uint) int64 {
+	var v int64
+	shift := uint(0)
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		v |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+		if shift >= bits {
+			r.fail("Malformed s%d", bits)
+			return 0
+		}
+	}
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+func (r *wasmReader) valType() byte {
+	t := r.byte()
+	switch t {
+	case 0x7f, 0x7e, 0x7d, 0x7c, 0x7b, 0x70, 0x6f:
+	default:
+		r.fail("Invalid value type 0x%02x", t)
+	}
+	return t
+}
+
+func (r *wasmReader) limits(max uint32) (uint32, bool) {
+	flags := r.byte()
+	min := r.u32()
+	if flags > 1 {
+		r.fail("Invalid limits flags 0x%02x", flags)
+	}
+	if min > max {
+		r.fail("Limit %d exceeds %d", min, max)
+	}
+	if flags == 1 {
+		if hi := r.u32(); hi < min {
+			r.fail("Limit maximum %d below minimum %d", hi, min)
+		}
+	}
+	return min, flags == 1
+}
+
+//wasmModuleInfo is the index space gathered while validating.
+type wasmModuleInfo struct {
+	types     [][2]int //param and result counts
+	funcs     []uint32 //type index of every function, imports first
+	imported  int
+	tables    []uint32 //minimum sizes
+	memories  []uint32 //minimum pages
+	globals   int
+	exports   map[string]bool
+	dataCount int
+}
+
+//ValidateWasm checks a binary module structurally: the header, section
+//order and sizes, every index against its index space, limits, constant
+//initialisers, segment bounds, and the decoding and block nesting of every
+//function body. It does not type check the operand stack.
+func ValidateWasm(module []byte) error {
+	r := &wasmReader{module, 0, nil}
+	if !bytes.Equal(r.bytes(8), []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}) {
+		return fmt.Errorf("Missing wasm magic or unsupported version")
+	}
+	m := &wasmModuleInfo{exports: make(map[string]bool), dataCount: -1}
+	lastID := 0
+	codeSeen := false
+	order := map[byte]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 12: 10, 10: 11, 11: 12}
+	for !r.done() {
+		id := r.byte()
+		size := r.u32()
+		body := r.bytes(size)
+		if r.err != nil {
+			return r.err
+		}
+		base := r.pos - int(size)
+		if id != wasmSecCustom {
+			pos, exists := order[id]
+			if !exists {
+				return fmt.Errorf("offset 0x%x: Unknown section id %d", base, id)
+			}
+			if pos <= lastID {
+				return fmt.Errorf("offset 0x%x: Section %d out of order", base, id)
+			}
+			lastID = pos
+		}
+		sr := &wasmReader{body, 0, nil}
+		m.section(sr, id, &codeSeen)
+		if sr.err == nil && !sr.done() {
+			sr.fail("Section %d has %d trailing bytes", id, len(body)-sr.pos)
+		}
+		if sr.err != nil {
+			return fmt.Errorf("section %d at 0x%x: %s", id, base, sr.err)
+		}
+	}
+	if len(m.funcs) > m.imported && !codeSeen {
+		return fmt.Errorf("Function section without a code section")
+	}
+	return nil
+}
+
+func (m *wasmModuleInfo) constExpr(r *wasmReader) {
+	switch op := r.byte(); op {
+	case wasmI32Const:
+		r.sleb(32)
+	case 0x42:
+		r.sleb(64)
+	case 0x43:
+		r.bytes(4)
+	case 0x44:
+		r.bytes(8)
+	case wasmGlobalGet:
+		if idx := r.u32(); int(idx) >= m.globals {
+			r.fail("Global index %d out of range", idx)
+		}
+	default:
+		r.fail("Unsupported constant expression opcode 0x%02x", op)
+	}
+	if r.byte() != wasmEnd {
+		r.fail("Constant expression not terminated")
+	}
+}
+
+func (m *wasmModuleInfo) section(r *wasmReader, id byte, codeSeen *bool) {
+	switch id {
+	case wasmSecCustom:
+		r.name()
+		r.pos = len(r.data)
+	case wasmSecType:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			if form := r.byte(); form != wasmTypeFunc {
+				r.fail("Invalid function type form 0x%02x", form)
+			}
+			params := r.u32()
+			for i := uint32(0); i < params; i++ {
+				r.valType()
+			}
+			results := r.u32()
+			for i := uint32(0); i < results; i++ {
+				r.valType()
+			}
+			m.types = append(m.types, [2]int{int(params), int(results)})
+		}
+	case wasmSecImport:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.name()
+			r.name()
+			switch kind := r.byte(); kind {
+			case 0x00:
+				idx := r.u32()
+				if int(idx) >= len(m.types) {
+					r.fail("Import type index %d out of range", idx)
+				}
+				m.funcs = append(m.funcs, idx)
+				m.imported++
+			case 0x01:
+				r.valType()
+				min, _ := r.limits(0xffffffff)
+				m.tables = append(m.tables, min)
+			case 0x02:
+				min, _ := r.limits(0x10000)
+				m.memories = append(m.memories, min)
+			case 0x03:
+				r.valType()
+				if mut := r.byte(); mut > 1 {
+					r.fail("Invalid global mutability %d", mut)
+				}
+				m.globals++
+			default:
+				r.fail("Invalid import kind %d", kind)
+			}
+		}
+	case wasmSecFunction:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			idx := r.u32()
+			if int(idx) >= len(m.types) {
+				r.fail("Function type index %d out of range", idx)
+			}
+			m.funcs = append(m.funcs, idx)
+		}
+	case wasmSecTable:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			if t := r.valType(); t != 0x70 && t != 0x6f {
+				r.fail("Table element type 0x%02x is not a reference type", t)
+			}
+			min, _ := r.limits(0xffffffff)
+			m.tables = append(m.tables, min)
+		}
+	case wasmSecMemory:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			min, _ := r.limits(0x10000)
+			m.memories = append(m.memories, min)
+		}
+		if len(m.memories) > 1 {
+			r.fail("Multiple memories")
+		}
+	case wasmSecGlobal:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.valType()
+			if mut := r.byte(); mut > 1 {
+				r.fail("Invalid global mutability %d", mut)
+			}
+			m.constExpr(r)
+			m.globals++
+		}
+	case wasmSecExport:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			name := r.name()
+			if m.exports[name] {
+				r.fail("Duplicate export \"%s\"", name)
+			}
+			m.exports[name] = true
+			kind, idx := r.byte(), int(r.u32())
+			limit := map[byte]int{0: len(m.funcs), 1: len(m.tables), 2: len(m.memories), 3: m.globals}
+			if max, exists := limit[kind]; !exists {
+				r.fail("Invalid export kind %d", kind)
+			} else if idx >= max {
+				r.fail("Export \"%s\" index %d out of range", name, idx)
+			}
+		}
+	case wasmSecStart:
+		if idx := r.u32(); int(idx) >= len(m.funcs) {
+			r.fail("Start function %d out of range", idx)
+		}
+	case wasmSecElem:
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			if flags := r.u32(); flags != 0 {
+				r.fail("Unsupported element segment flags %d", flags)
+				return
+			}
+			if len(m.tables) == 0 {
+				r.fail("Element segment without a table")
+			}
+			offset := m.offsetExpr(r)
+			count := r.u32()
+			for i := uint32(0); i < count; i++ {
+				if idx := r.u32(); int(idx) >= len(m.funcs) {
+					r.fail("Element function index %d out of range", idx)
+				}
+			}
+			if len(m.tables) > 0 && offset >= 0 && uint64(offset)+uint64(count) > uint64(m.tables[0]) {
+				r.fail("Element segment [%d, %d) exceeds table size %d", offset, uint64(offset)+uint64(count), m.tables[0])
+			}
+		}
+	case wasmSecDataCnt:
+		m.dataCount = int(r.u32())
+	case wasmSecCode:
+		*codeSeen = true
+		n := r.u32()
+		if int(n) != len(m.funcs)-m.imported {
+			r.fail("Code section has %d bodies for %d functions", n, len(m.funcs)-m.imported)
+			return
+		}
+		for i := 0; i < int(n) && r.err == nil; i++ {
+			size := r.u32()
+			body := &wasmReader{r.bytes(size), 0, nil}
+			if r.err != nil {
+				return
+			}
+			fn := m.imported + i
+			m.body(body, fn)
+			if body.err != nil {
+				r.fail("Function %d: %s", fn, body.err)
+			}
+		}
+	case wasmSecData:
+		n := r.u32()
+		if m.dataCount >= 0 && int(n) != m.dataCount {
+			r.fail("Data count %d does not match %d segments", m.dataCount, n)
+		}
+		for ; n > 0 && r.err == nil; n-- {
+			flags := r.u32()
+			if flags == 1 {
+				r.bytes(r.u32())
+				continue
+			}
+			if flags != 0 {
+				r.fail("Unsupported data segment flags %d", flags)
+				return
+			}
+			if len(m.memories) == 0 {
+				r.fail("Data segment without a memory")
+			}
+			offset := m.offsetExpr(r)
+			size := r.u32()
+			r.bytes(size)
+			if len(m.memories) > 0 && offset >= 0 && uint64(offset)+uint64(size) > uint64(m.memories[0])*0x10000 {
+				r.fail("Data segment [0x%x, 0x%x) exceeds memory", offset, uint64(offset)+uint64(size))
+			}
+		}
+	}
+}
+
+//offsetExpr reads a segment offset, returning -1 if it is not a constant.
+func (m *wasmModuleInfo) offsetExpr(r *wasmReader) int64 {
+	if len(r.data) > r.pos && r.data[r.pos] == wasmI32Const {
+		r.byte()
+		v := r.sleb(32)
+		if r.byte() != wasmEnd {
+			r.fail("Offset expression not terminated")
+		}
+		return int64(uint32(v))
+	}
+	m.constExpr(r)
+	return -1
+}
+
+//Natural alignment (log2) of the memory instructions, by opcode.
+var wasmNaturalAlign = map[byte]uint32{
+	0x28: 2, 0x29: 3, 0x2a: 2, 0x2b: 3, 0x2c: 0, 0x2d: 0, 0x2e: 1, 0x2f: 1,
+	0x30: 0, 0x31: 0, 0x32: 1, 0x33: 1, 0x34: 2, 0x35: 2, 0x36: 2, 0x37: 3,
+	0x38: 2, 0x39: 3, 0x3a: 0, 0x3b: 1, 0x3c: 0, 0x3d: 1, 0x3e: 2,
+}
+
+func (m *wasmModuleInfo) blockType(r *wasmReader) {
+	if len(r.data) > r.pos {
+		switch b := r.data[r.pos]; {
+		case b == wasmBlockEmpty:
+			r.byte()
+			return
+		case b >= 0x6f && b <= 0x7f:
+			r.valType()
+			return
+		}
+	}
+	if idx := r.sleb(33); idx < 0 || int(idx) >= len(m.types) {
+		r.fail("Block type index %d out of range", idx)
+	}
+}
+
+func (m *wasmModuleInfo) memArg(r *wasmReader, op byte) {
+	if len(m.memories) == 0 {
+		r.fail("Memory instruction 0x%02x without a memory", op)
+	}
+	if align := r.u32(); align > wasmNaturalAlign[op] {
+		r.fail("Alignment 2^%d larger than natural for 0x%02x", align, op)
+	}
+	r.u32()
+}
+
+func (m *wasmModuleInfo) body(r *wasmReader, fn int) {
+	locals := uint64(m.types[m.funcs[fn]][0])
+	for n := r.u32(); n > 0 && r.err == nil; n-- {
+		locals += uint64(r.u32())
+		r.valType()
+	}
+	if locals > 50000 {
+		r.fail("Too many locals: %d", locals)
+	}
+	//Each entry of the control stack records whether it is an if, so
+	//that else is only accepted there.
+	control := []bool{false}
+	label := func() {
+		if depth := r.u32(); int(depth) >= len(control) {
+			r.fail("Branch depth %d exceeds nesting %d", depth, len(control))
+		}
+	}
+	for len(control) > 0 && r.err == nil {
+		op := r.byte()
+		switch {
+		case op == wasmUnreachable, op == wasmNop, op == wasmReturn, op == wasmDrop, op == wasmSelect:
+		case op == wasmBlock, op == wasmLoop, op == wasmIf:
+			m.blockType(r)
+			control = append(control, op == wasmIf)
+		case op == wasmElse:
+			if !control[len(control)-1] {
+				r.fail("else outside of if")
+			}
+			control[len(control)-1] = false
+		case op == wasmEnd:
+			control = control[:len(control)-1]
+		case op == wasmBr, op == wasmBrIf:
+			label()
+		case op == wasmBrTable:
+			for n := r.u32(); n > 0 && r.err == nil; n-- {
+				label()
+			}
+			label()
+		case op == wasmCall:
+			if idx := r.u32(); int(idx) >= len(m.funcs) {
+				r.fail("Call to function %d out of range", idx)
+			}
+		case op == wasmCallIndirect:
+			if idx := r.u32(); int(idx) >= len(m.types) {
+				r.fail("call_indirect type %d out of range", idx)
+			}
+			if idx := r.u32(); int(idx) >= len(m.tables) {
+				r.fail("call_indirect table %d out of range", idx)
+			}
+		case op == 0x1c:
+			if n := r.u32(); n != 1 {
+				r.fail("Typed select with %d types", n)
+			}
+			r.valType()
+		case op >= wasmLocalGet && op <= wasmLocalTee:
+			if idx := r.u32(); uint64(idx) >= locals {
+				r.fail("Local %d out of range", idx)
+			}
+		case op == wasmGlobalGet, op == wasmGlobalSet:
+			if idx := r.u32(); int(idx) >= m.globals {
+				r.fail("Global %d out of range", idx)
+			}
+		case op >= 0x28 && op <= 0x3e:
+			m.memArg(r, op)
+		case op == 0x3f, op == 0x40:
+			if r.byte() != 0 || len(m.memories) == 0 {
+				r.fail("Invalid memory index")
+			}
+		case op == wasmI32Const:
+			r.sleb(32)
+		case op == 0x42:
+			r.sleb(64)
+		case op == 0x43:
+			r.bytes(4)
+		case op == 0x44:
+			r.bytes(8)
+		case op >= 0x45 && op <= 0xc4:
+		case op == wasmPrefixFC:
+			switch sub := r.u32(); {
+			case sub <= 7:
+			case sub == 10:
+				if r.byte() != 0 || r.byte() != 0 || len(m.memories) == 0 {
+					r.fail("Invalid memory.copy")
+				}
+			case sub == 11:
+				if r.byte() != 0 || len(m.memories) == 0 {
+					r.fail("Invalid memory.fill")
+				}
+			default:
+				r.fail("Unsupported 0xfc sub-opcode %d", sub)
+			}
+		default:
+			r.fail("Unsupported opcode 0x%02x", op)
+		}
+	}
+	if r.err == nil && r.pos != len(r.data) {
+		r.fail("Body continues %d bytes past its final end", len(r.data)-r.pos)
+	}
+}
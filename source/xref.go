@@ -0,0 +1,195 @@
+/*
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+                    Version 2, December 2004
+
+ Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+
+ Everyone is permitted to copy and distribute verbatim or modified
+ copies of this license document, and changing it is allowed as long
+ as the name is changed.
+
+            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+
+  0. You just DO WHAT THE FUCK YOU WANT TO.
+*/
+
+package qvmd
+
+import (
+	"sort"
+	"strings"
+)
+
+//XRefKind says how an instruction uses the address it references. A CONST
+//can be used in more than one way, so kinds are combined as flags.
+type XRefKind int
+
+const (
+	XRefRead XRefKind = 1 << iota
+	XRefWrite
+	XRefAddr //The address itself escapes, e.g. as an argument
+)
+
+func (k XRefKind) String() string {
+	kinds := make([]string, 0, 3)
+	if k&XRefRead != 0 {
+		kinds = append(kinds, "read")
+	}
+	if k&XRefWrite != 0 {
+		kinds = append(kinds, "write")
+	}
+	if k&XRefAddr != 0 {
+		kinds = append(kinds, "addr")
+	}
+	return strings.Join(kinds, ",")
+}
+
+//DataXRef is a CONST instruction referencing an address in data, lit or
+//bss.
+type DataXRef struct {
+	Insn int
+	Proc *Procedure
+	Addr uint32
+	Kind XRefKind
+}
+
+type xrefsByInsn []DataXRef
+
+func (x xrefsByInsn) Len() int           { return len(x) }
+func (x xrefsByInsn) Less(i, j int) bool { return x[i].Insn < x[j].Insn }
+func (x xrefsByInsn) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+//ParseDataXRefs finds every CONST whose value is an address in the image
+//and classifies it by following the value to its uses: a load from it is a
+//read, a store to it is a write, and anything else that lets the address
+//escape makes it address-taken. Pointer arithmetic such as array indexing
+//is followed to the load or store it ends in, unless the other operand is
+//a pointer and the constant is just an offset from it. Constants only used
+//as numbers, e.g. compared or multiplied, or that only escape while typed
+//as a number or as NULL, are not references.
+//
+//Small flags and indexes that are only stored, passed or returned look
+//just like addresses, so such a constant only counts if it's typed as a
+//pointer, a string starts there, or another instruction reads or writes
+//there.
+func (ctx *Context) ParseDataXRefs() error {
+	hdr := ctx.QvmFile.Header
+	imageEnd := hdr.DataLength + hdr.LitLength + hdr.BssLength
+	ctx.DataXRefs = make(map[uint32][]DataXRef)
+	escapes := make([]DataXRef, 0)
+	for _, proc := range ctx.SortedProcs() {
+		f := ctx.Lift(proc)
+		uses := make(map[*Value][]*Value)
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Phis {
+				for _, arg := range v.Args {
+					uses[arg] = append(uses[arg], v)
+				}
+			}
+			for _, v := range sb.Values {
+				for _, arg := range v.Args {
+					uses[arg] = append(uses[arg], v)
+				}
+			}
+		}
+
+		//classify follows addr to its uses. Once it has been through
+		//arithmetic an escaping value is more likely a number than an
+		//address, so only loads and stores count.
+		var classify func(addr *Value, depth int, arith bool) XRefKind
+		classify = func(addr *Value, depth int, arith bool) XRefKind {
+			var kind XRefKind
+			if depth > 8 {
+				return 0
+			}
+			escape := XRefAddr
+			if arith {
+				escape = 0
+			}
+			for _, use := range uses[addr] {
+				switch {
+				case use.Op >= OP_LOAD1 && use.Op <= OP_LOAD4:
+					kind |= XRefRead
+				case use.Op >= OP_STORE1 && use.Op <= OP_STORE4:
+					if use.Args[0] == addr {
+						kind |= XRefWrite
+					} else {
+						kind |= escape
+					}
+				case use.Op == OP_BLOCK_COPY:
+					if use.Args[0] == addr {
+						kind |= XRefWrite
+					} else {
+						kind |= XRefRead
+					}
+				case use.Op == OP_CALL:
+					if use.Args[0] != addr {
+						kind |= escape
+					}
+				case use.Op == OP_ADD, use.Op == OP_SUB && use.Args[0] == addr:
+					other := use.Args[0]
+					if other == addr {
+						other = use.Args[1]
+					}
+					if other.Op != OP_CONST && !ctx.isPointer(proc, other) {
+						kind |= classify(use, depth+1, true)
+					}
+				case use.Op == OP_PHI:
+					kind |= classify(use, depth+1, arith)
+				case use.Op == OP_LEAVE:
+					kind |= escape
+				}
+			}
+			return kind
+		}
+
+		for _, sb := range f.Blocks {
+			for _, v := range sb.Values {
+				if v.Op != OP_CONST || v.Aux < 0 || uint32(v.Aux) >= imageEnd {
+					continue
+				}
+				kind := classify(v, 0, false)
+				addr := uint32(v.Aux)
+				t := ctx.Types.Const(v.Insn)
+				switch {
+				case kind == 0:
+				case kind == XRefAddr && (v.Aux == 0 || t == TypeInt || t == TypeFloat):
+					//A NULL or a number stored, passed or returned.
+				case kind == XRefAddr && t != TypePointer:
+					escapes = append(escapes, DataXRef{v.Insn, proc, addr, kind})
+				default:
+					ctx.DataXRefs[addr] = append(ctx.DataXRefs[addr], DataXRef{v.Insn, proc, addr, kind})
+				}
+			}
+		}
+	}
+	for _, x := range escapes {
+		_, referenced := ctx.DataXRefs[x.Addr]
+		if _, str := ctx.Strings[int(x.Addr)]; referenced || str {
+			ctx.DataXRefs[x.Addr] = append(ctx.DataXRefs[x.Addr], x)
+		}
+	}
+	for _, xrefs := range ctx.DataXRefs {
+		sort.Sort(xrefsByInsn(xrefs))
+	}
+	return nil
+}
+
+//isPointer reports whether type inference found v to be a pointer, looking
+//at the variable it was loaded from or the procedure that returned it.
+func (ctx *Context) isPointer(proc *Procedure, v *Value) bool {
+	switch {
+	case v.Op == OP_LOCAL:
+		return true
+	case v.Op == OP_LOAD4 && v.Args[0].Op == OP_LOCAL:
+		return ctx.Types.Local(proc, int(v.Args[0].Aux)) == TypePointer
+	case v.Op == OP_LOAD4 && v.Args[0].Op == OP_CONST:
+		return ctx.Types.Global(uint32(v.Args[0].Aux)) == TypePointer
+	case v.Op == OP_CALL && v.Args[0].Op == OP_CONST:
+		if callee, exists := ctx.Procs[int(v.Args[0].Aux)]; exists && ctx.Types != nil {
+			return ctx.Types.Returns[callee.StartInstruction] == TypePointer
+		}
+	}
+	return false
+}